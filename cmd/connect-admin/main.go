@@ -0,0 +1,368 @@
+// Command connect-admin runs maintenance tasks against the data store:
+// the same team commands as /connect, checking and repairing the data,
+// moving it between storage backends, managing the secrets key and running
+// a sync pass on demand.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/joho/godotenv"
+
+	"slack-connect-manager/internal/commands"
+	"slack-connect-manager/internal/config"
+	"slack-connect-manager/internal/health"
+	"slack-connect-manager/internal/logging"
+	"slack-connect-manager/internal/secrets"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/syncer"
+	"slack-connect-manager/internal/webhooks"
+)
+
+const usage = `Usage: connect-admin [flags] <command> [args]
+
+Data commands:
+  validate               Check the data for problems, like duplicate members
+  repair                 Fix the problems validate finds
+  migrate <json|sqlite>  Copy the data to another storage backend. Add --force to overwrite data already there
+  sync                   Run one sync pass over the tracked channels
+
+Secrets commands:
+  generate-key           Print a new key for encrypting secrets
+  encrypt                Encrypt a secret read from stdin, e.g. a bot token for the .env file
+  rotate-key <key-file>  Re-encrypt the stored secrets with the key in key-file
+
+Team commands take the same arguments as /connect, e.g.
+  connect-admin create-team acme
+  connect-admin print members acme
+Run "connect-admin help" for the full list.
+
+Flags are the same as the server's, e.g. -data-dir, -storage and -config.
+Commands that talk to Slack need SLACK_BOT_TOKEN.
+
+Add -workspace <team_id> to work on the data of a workspace the app was
+installed in with OAuth, instead of the top-level data. Commands then use
+that workspace's bot token.
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Run the command in args and return the exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	// Read the same .env file as the server, if there is one
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(stderr, "Error loading .env file: %v\n", err)
+		return 1
+	}
+
+	// The workspace to work on, if not the top-level data
+	var teamID string
+	cfg, args, err := config.Parse("connect-admin", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&teamID, "workspace", "", "team ID of a workspace installed with OAuth, to work on its data")
+	})
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	if err == nil {
+		err = cfg.ValidateOffline()
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	logging.Setup(cfg.LogLevel, cfg.LogFormat)
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	// These don't need the data
+	switch args[0] {
+	case "generate-key":
+		return generateKey(stdout, stderr)
+	case "encrypt":
+		return encrypt(cfg, stdin, stdout, stderr)
+	}
+
+	st, err := store.Open(cfg.Storage, cfg.DataDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error opening data store: %v\n", err)
+		return 1
+	}
+	defer st.Close()
+	st.SetKeyring(cfg.Keyring())
+
+	// These work on every workspace at once
+	switch args[0] {
+	case "rotate-key", "migrate":
+		if teamID != "" {
+			fmt.Fprintf(stderr, "%s works on every workspace at once, so it doesn't take -workspace\n", args[0])
+			return 2
+		}
+		if args[0] == "rotate-key" {
+			return rotateKey(cfg, st, args[1:], stdout, stderr)
+		}
+		return migrate(cfg, st, args[1:], stdout, stderr)
+	}
+
+	data, token := st, cfg.SlackBotToken
+	if teamID != "" {
+		if data, token, err = openWorkspace(st, teamID); err != nil {
+			fmt.Fprintf(stderr, "Error opening workspace %s: %v\n", teamID, err)
+			return 1
+		}
+	}
+
+	switch args[0] {
+	case "validate":
+		return validate(data, stdout, stderr)
+	case "repair":
+		return repair(data, stdout, stderr)
+	}
+
+	// Everything else works on the data, so make sure it's there
+	if err := data.EnsureFiles(); err != nil {
+		fmt.Fprintf(stderr, "Error creating data files: %v\n", err)
+		return 1
+	}
+
+	api := slackapi.New(token, cfg.SlackAPIURL)
+	// Events are only queued here. The server delivers them.
+	hooks := webhooks.New(ctx, data)
+	worker := syncer.New(ctx, data, api, health.New(cfg.SyncInterval, cfg.SyncStallTimeout), cfg.SyncInterval, hooks)
+	worker.SetLimits(cfg.SyncConcurrency, cfg.SyncMaxInterval)
+
+	if args[0] == "sync" {
+		if token == "" && teamID != "" {
+			fmt.Fprintf(stderr, "sync needs a Slack bot token, and workspace %s isn't installed\n", teamID)
+			return 2
+		}
+		if token == "" {
+			fmt.Fprintf(stderr, "sync needs a Slack bot token (set %s)\n", config.EnvSlackToken)
+			return 2
+		}
+		if err := worker.SyncAll(ctx); err != nil {
+			fmt.Fprintf(stderr, "Sync failed: %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(stdout, "Synced all tracked channels.")
+		return 0
+	}
+
+	router := commands.NewRouter(&commands.Service{Store: data, Slack: api, Sync: worker, Webhooks: hooks})
+	if len(args) == 1 && args[0] == "help" {
+		fmt.Fprint(stdout, usage+"\n")
+	}
+	resp := router.Run(ctx, args, commands.Request{})
+	// Let any syncs the command started finish before exiting
+	worker.Wait()
+
+	if resp.Error {
+		fmt.Fprintln(stderr, resp.Text)
+		return 1
+	}
+	fmt.Fprintln(stdout, resp.Text)
+	return 0
+}
+
+// The data of a workspace installed with OAuth, and its bot token. The
+// token is empty if the app was uninstalled from the workspace since.
+func openWorkspace(st *store.Store, teamID string) (*store.Store, string, error) {
+	teamIDs, err := st.Workspaces()
+	if err != nil {
+		return nil, "", err
+	}
+	if i := sort.SearchStrings(teamIDs, teamID); i == len(teamIDs) || teamIDs[i] != teamID {
+		return nil, "", fmt.Errorf("no data found in %s", st.Location())
+	}
+	ws, err := st.Workspace(teamID)
+	if err != nil {
+		return nil, "", err
+	}
+	installations, err := st.ReadInstallations()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading installations: %w", err)
+	}
+	return ws, installations[teamID].BotToken, nil
+}
+
+// Report problems in the data. Exits with 1 if there are any.
+func validate(st *store.Store, stdout, stderr io.Writer) int {
+	if exists, err := st.HasData(); err == nil && !exists {
+		fmt.Fprintf(stderr, "No data found in %s\n", st.Location())
+		return 1
+	}
+
+	problems, err := st.Check()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading data: %v\n", err)
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(stdout, "No problems found in %s.\n", st.Location())
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Found %d problem(s) in %s:\n", len(problems), st.Location())
+	for _, problem := range problems {
+		fmt.Fprintf(stdout, "  - %s\n", problem)
+	}
+	fmt.Fprintln(stdout, `Run "connect-admin repair" to fix them.`)
+	return 1
+}
+
+// Fix the problems validate finds
+func repair(st *store.Store, stdout, stderr io.Writer) int {
+	fixes, err := st.Repair()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error repairing data: %v\n", err)
+		return 1
+	}
+	if len(fixes) == 0 {
+		fmt.Fprintln(stdout, "Nothing to repair.")
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Fixed %d problem(s):\n", len(fixes))
+	for _, fix := range fixes {
+		fmt.Fprintf(stdout, "  - %s\n", fix)
+	}
+	return 0
+}
+
+// Copy the data to another storage backend
+func migrate(cfg config.Config, src *store.Store, args []string, stdout, stderr io.Writer) int {
+	var target string
+	force := false
+	for _, arg := range args {
+		if arg == "--force" || arg == "-force" {
+			force = true
+		} else {
+			target = arg
+		}
+	}
+	if target == "" {
+		fmt.Fprintln(stderr, "Usage: connect-admin migrate <json|sqlite> [--force]")
+		return 2
+	}
+	if target == cfg.Storage {
+		fmt.Fprintf(stderr, "The data is already stored as %s. Use -storage to pick the backend to copy from.\n", target)
+		return 2
+	}
+
+	dst, err := store.Open(target, cfg.DataDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error opening %s store: %v\n", target, err)
+		return 1
+	}
+	defer dst.Close()
+	dst.SetKeyring(cfg.Keyring())
+
+	exists, err := dst.HasData()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading %s: %v\n", dst.Location(), err)
+		return 1
+	}
+	if exists && !force {
+		fmt.Fprintf(stderr, "%s already has data. Add --force to overwrite it.\n", dst.Location())
+		return 1
+	}
+
+	if err := store.Copy(dst, src); err != nil {
+		fmt.Fprintf(stderr, "Error copying data: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Copied the data from %s to %s.\n", src.Location(), dst.Location())
+	fmt.Fprintf(stdout, "Set storage: %s in the config (or %s=%s) to use it.\n", target, config.EnvStorage, target)
+	return 0
+}
+
+// Print a new secrets key
+func generateKey(stdout, stderr io.Writer) int {
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error generating key: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, key)
+	return 0
+}
+
+// Encrypt a secret from stdin so it can be put in the config or .env file.
+// Reading it from stdin keeps it out of the shell history.
+func encrypt(cfg config.Config, stdin io.Reader, stdout, stderr io.Writer) int {
+	keyring := cfg.Keyring()
+	if keyring == nil {
+		fmt.Fprintf(stderr, "encrypt needs a secrets key (set %s or %s)\n", config.EnvSecretsKeyFile, config.EnvSecretsKey)
+		return 2
+	}
+
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading the secret: %v\n", err)
+		return 1
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		fmt.Fprintln(stderr, "Please provide the secret to encrypt on stdin.")
+		return 2
+	}
+
+	encrypted, err := keyring.Encrypt(secret)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error encrypting: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, encrypted)
+	return 0
+}
+
+// Re-encrypt the stored secrets with a new key
+func rotateKey(cfg config.Config, st *store.Store, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "Usage: connect-admin rotate-key <new-key-file>")
+		return 2
+	}
+	key, err := secrets.ReadKeyFile(args[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading the new key: %v\n", err)
+		return 1
+	}
+	// The configured key still decrypts, so a rotation that stopped partway
+	// can be run again
+	keyring, err := cfg.Keyring().Rotate(key)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading the new key: %v\n", err)
+		return 1
+	}
+
+	count, err := st.RotateKey(keyring)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error re-encrypting secrets: %v\n", err)
+		fmt.Fprintln(stderr, "Keep the current secrets key configured until a rotation succeeds.")
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Re-encrypted %d secret(s) in %s with key %s.\n", count, st.Location(), keyring.KeyID())
+	fmt.Fprintf(stdout, "Set secrets_key_file: %s in the config (or %s=%s) to use it, and re-encrypt any encrypted values in the config with the encrypt command.\n",
+		args[0], config.EnvSecretsKeyFile, args[0])
+	return 0
+}
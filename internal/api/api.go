@@ -0,0 +1,482 @@
+// Package api serves a read-only JSON REST API over the stored teams,
+// members, channels and users, for other tools that need the rosters.
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"slack-connect-manager/internal/metrics"
+	"slack-connect-manager/internal/store"
+)
+
+// Prefix is the path the API is served under
+const Prefix = "/api/v1/"
+
+// Page sizes for the list endpoints
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Handler serves the API for requests under Prefix. Every request except
+// the one for the OpenAPI spec needs one of tokens as a bearer token.
+func Handler(st *store.Store, tokens []string) http.Handler {
+	return &handler{store: st, tokens: tokens}
+}
+
+type handler struct {
+	store  *store.Store
+	tokens []string
+}
+
+// An API error, sent as {"error": code, "message": message}
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &apiError{http.StatusNotFound, "not_found", fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, "invalid_request", fmt.Sprintf(format, args...)}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		metrics.APIRequestsTotal.Inc("unknown")
+		writeError(w, r, badRequest("Invalid path."))
+		return
+	}
+
+	route, serve := h.route(segments)
+	metrics.APIRequestsTotal.Inc(route)
+	slog.DebugContext(r.Context(), "Received API request", "route", route, "method", r.Method)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "Only GET and HEAD are supported."})
+		return
+	}
+
+	if route == "openapi" {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="slack-connect-manager"`)
+		writeError(w, r, &apiError{http.StatusUnauthorized, "unauthorized", "A valid bearer token is required."})
+		return
+	}
+	if serve == nil {
+		writeError(w, r, notFound("No such endpoint."))
+		return
+	}
+	if teamID := r.URL.Query().Get("team_id"); teamID != "" {
+		ws, err := h.workspace(teamID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		_, serve = ws.route(segments)
+	}
+
+	body, err := serve(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, body)
+}
+
+// Match the path segments after Prefix to an endpoint. Returns the metrics
+// label for the route and the function that builds the response body, or
+// nil if there's no such endpoint.
+func (h *handler) route(segments []string) (string, func(*http.Request) (interface{}, error)) {
+	switch {
+	case len(segments) == 1 && segments[0] == "openapi.yaml":
+		return "openapi", nil
+	case len(segments) == 1 && segments[0] == "teams":
+		return "teams", h.listTeams
+	case len(segments) == 2 && segments[0] == "teams":
+		return "team", func(r *http.Request) (interface{}, error) { return h.getTeam(segments[1]) }
+	case len(segments) == 3 && segments[0] == "teams" && segments[2] == "members":
+		return "team_members", func(r *http.Request) (interface{}, error) { return h.listMembers(r, segments[1]) }
+	case len(segments) == 1 && segments[0] == "channels":
+		return "channels", h.listChannels
+	case len(segments) == 2 && segments[0] == "users":
+		return "user", func(r *http.Request) (interface{}, error) { return h.getUser(segments[1]) }
+	}
+	return "unknown", nil
+}
+
+// A handler serving the data of an installed workspace instead of the
+// top-level data. Only workspaces that have data can be picked, so a typo
+// doesn't look like an empty workspace.
+func (h *handler) workspace(teamID string) (*handler, error) {
+	teamIDs, err := h.store.Workspaces()
+	if err != nil {
+		return nil, err
+	}
+	if i := sort.SearchStrings(teamIDs, teamID); i == len(teamIDs) || teamIDs[i] != teamID {
+		return nil, notFound("Workspace '%s' has no data.", teamID)
+	}
+	st, err := h.store.Workspace(teamID)
+	if err != nil {
+		return nil, err
+	}
+	return &handler{store: st, tokens: h.tokens}, nil
+}
+
+// Split the escaped path after Prefix into unescaped segments, so team
+// names can contain anything, even slashes, as long as they're escaped
+func splitPath(escapedPath string) ([]string, error) {
+	rest := strings.Trim(strings.TrimPrefix(escapedPath, strings.TrimSuffix(Prefix, "/")), "/")
+	if rest == "" {
+		return nil, nil
+	}
+
+	segments := strings.Split(rest, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
+
+// Check the bearer token against the configured ones
+func (h *handler) authorized(r *http.Request) bool {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return false
+	}
+
+	valid := false
+	for _, t := range h.tokens {
+		// Compare every token in constant time so timing doesn't give them away
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Send a JSON body with an ETag, or 304 Not Modified if the client
+// already has this version
+func writeJSON(w http.ResponseWriter, r *http.Request, body interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// Whether an If-None-Match header lists the ETag. Weak comparison, as the
+// HTTP spec asks for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		slog.ErrorContext(r.Context(), "Error serving API request", "path", r.URL.Path, "error", err)
+		apiErr = &apiError{http.StatusInternalServerError, "internal_error", "Something went wrong reading the data."}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.status)
+	json.NewEncoder(w).Encode(map[string]string{"error": apiErr.code, "message": apiErr.message})
+}
+
+// A page of a list endpoint. NextCursor is empty on the last page.
+type page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Cut one page out of items, which must be sorted by key, using the limit
+// and cursor query parameters. The cursor is the key of the last item of
+// the previous page, so pages stay consistent while items are added or
+// removed.
+func paginate[T any](r *http.Request, items []T, key func(T) string) (page[T], error) {
+	query := r.URL.Query()
+
+	limit := DefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxLimit {
+			return page[T]{}, badRequest("limit must be a number from 1 to %d.", MaxLimit)
+		}
+		limit = n
+	}
+
+	start := 0
+	if v := query.Get("cursor"); v != "" {
+		after, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return page[T]{}, badRequest("Invalid cursor.")
+		}
+		start = sort.Search(len(items), func(i int) bool { return key(items[i]) > string(after) })
+	}
+
+	end := min(start+limit, len(items))
+	p := page[T]{Items: items[start:end]}
+	if end < len(items) {
+		p.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(key(items[end-1])))
+	}
+	return p, nil
+}
+
+type channelJSON struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Teams of the other organizations the channel is shared with. Only in the channel list.
+	SharedWith []string `json:"shared_with,omitempty"`
+}
+
+type teamJSON struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Aliases     []string          `json:"aliases"`
+	Owners      []string          `json:"owners"`
+	Subteams    []string          `json:"subteams"`
+	Tags        map[string]string `json:"tags"`
+	// ID of the channel ping uses when none is given
+	DefaultChannel string `json:"default_channel,omitempty"`
+	// Including the members of subteams, counted once
+	MemberCount int        `json:"member_count"`
+	CreatedBy   string     `json:"created_by,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+type memberJSON struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Channels []channelJSON `json:"channels"`
+}
+
+type userJSON struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	UpdatedAt *time.Time    `json:"updated_at,omitempty"`
+	Channels  []channelJSON `json:"channels"`
+	// Teams the user is in, directly or through a subteam
+	Teams []string `json:"teams"`
+}
+
+func newTeamJSON(teams store.Teams, name string) teamJSON {
+	team := teams.Teams[name]
+	t := teamJSON{
+		Name:           name,
+		Description:    team.Description,
+		Aliases:        nonNil(team.Aliases),
+		Owners:         nonNil(team.Owners),
+		Subteams:       nonNil(team.Subteams),
+		Tags:           team.Tags,
+		DefaultChannel: team.DefaultChannel,
+		MemberCount:    len(teams.Members(name)),
+		CreatedBy:      team.CreatedBy,
+	}
+	if t.Tags == nil {
+		t.Tags = map[string]string{}
+	}
+	if !team.CreatedAt.IsZero() {
+		t.CreatedAt = &team.CreatedAt
+	}
+	return t
+}
+
+// The tracked channels in a member's or user's channel map, sorted by ID
+func channelList(channels store.Channels, memberChannels map[string]string) []channelJSON {
+	list := []channelJSON{}
+	for id := range memberChannels {
+		list = append(list, channelJSON{ID: id, Name: channels[id].Name})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// GET /api/v1/teams
+func (h *handler) listTeams(r *http.Request) (interface{}, error) {
+	teams, err := h.store.ReadTeams()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(teams.Teams))
+	for name := range teams.Teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]teamJSON, len(names))
+	for i, name := range names {
+		list[i] = newTeamJSON(teams, name)
+	}
+	return paginate(r, list, func(t teamJSON) string { return t.Name })
+}
+
+// GET /api/v1/teams/{team}, where team can also be an alias
+func (h *handler) getTeam(nameOrAlias string) (interface{}, error) {
+	teams, err := h.store.ReadTeams()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := teams.Resolve(nameOrAlias)
+	if !ok {
+		return nil, notFound("Team '%s' does not exist.", nameOrAlias)
+	}
+	return newTeamJSON(teams, name), nil
+}
+
+// GET /api/v1/teams/{team}/members. Includes the members of subteams
+// unless ?direct=true.
+func (h *handler) listMembers(r *http.Request, nameOrAlias string) (interface{}, error) {
+	direct := false
+	if v := r.URL.Query().Get("direct"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, badRequest("direct must be true or false.")
+		}
+		direct = b
+	}
+
+	teams, err := h.store.ReadTeams()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := h.store.ReadChannels()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := teams.Resolve(nameOrAlias)
+	if !ok {
+		return nil, notFound("Team '%s' does not exist.", nameOrAlias)
+	}
+
+	members := teams.Members(name)
+	if direct {
+		members = teams.Teams[name].Members
+	}
+
+	list := make([]memberJSON, len(members))
+	for i, member := range members {
+		list[i] = memberJSON{ID: member.MemberID, Name: member.Name, Channels: channelList(channels, member.Channels)}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return paginate(r, list, func(m memberJSON) string { return m.ID })
+}
+
+// GET /api/v1/channels
+func (h *handler) listChannels(r *http.Request) (interface{}, error) {
+	channels, err := h.store.ReadChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]channelJSON, 0, len(channels))
+	for id, channel := range channels {
+		list = append(list, channelJSON{ID: id, Name: channel.Name, SharedWith: channel.SharedWith})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return paginate(r, list, func(c channelJSON) string { return c.ID })
+}
+
+// GET /api/v1/users/{id}. Works for anyone the sync has seen or who is in a team.
+func (h *handler) getUser(id string) (interface{}, error) {
+	teams, err := h.store.ReadTeams()
+	if err != nil {
+		return nil, err
+	}
+	users, err := h.store.ReadUsers()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := h.store.ReadChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	u := userJSON{ID: id, Teams: []string{}}
+	user, known := users[id]
+	if known {
+		u.Name = user.Name
+		u.Channels = channelList(channels, user.Channels)
+		if !user.UpdatedAt.IsZero() {
+			u.UpdatedAt = &user.UpdatedAt
+		}
+	}
+
+	for name := range teams.Teams {
+		for _, member := range teams.Members(name) {
+			if member.MemberID != id {
+				continue
+			}
+			u.Teams = append(u.Teams, name)
+			if !known {
+				u.Name = member.Name
+				u.Channels = channelList(channels, member.Channels)
+			}
+		}
+	}
+	if !known && len(u.Teams) == 0 {
+		return nil, notFound("User '%s' is not known.", id)
+	}
+	sort.Strings(u.Teams)
+	return u, nil
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"slack-connect-manager/internal/store"
+)
+
+const testToken = "test-api-token-0123456789"
+
+// A store with teams acme (Alice and Bob, plus the infra subteam) and
+// infra (Carol), and two tracked channels
+func setupStore(t *testing.T) *store.Store {
+	t.Helper()
+	st := store.New(t.TempDir())
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	teams := store.Teams{Teams: map[string]store.Team{
+		"acme": {
+			Members: []store.Member{
+				{MemberID: "U2", Name: "Bob", Channels: map[string]string{}},
+				{MemberID: "U1", Name: "Alice", Channels: map[string]string{"C1": "U1"}},
+			},
+			Subteams:    []string{"infra"},
+			Description: "Acme partners",
+			Aliases:     []string{"partners"},
+			Tags:        map[string]string{"partner": "acme"},
+			CreatedBy:   "UADMIN",
+			CreatedAt:   created,
+		},
+		"infra": {Members: []store.Member{{MemberID: "U3", Name: "Carol", Channels: map[string]string{"C2": "U3"}}}},
+	}}
+	if err := st.WriteTeams(teams); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WriteUsers(store.Users{
+		"U1": {MemberID: "U1", Name: "Alice", UpdatedAt: created, Channels: map[string]string{"C1": "U1"}},
+		"U4": {MemberID: "U4", Name: "Dave", UpdatedAt: created, Channels: map[string]string{}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WriteChannels(store.Channels{
+		"C1": {ID: "C1", Name: "proj-x"},
+		"C2": {ID: "C2", Name: "proj-y"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func get(t *testing.T, h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+testToken)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	h := Handler(setupStore(t), []string{"other-token-0123456789", testToken})
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/api/v1/teams", 200, `{"items":[{"name":"acme","description":"Acme partners","aliases":["partners"],"owners":[],"subteams":["infra"],"tags":{"partner":"acme"},"member_count":3,"created_by":"UADMIN","created_at":"2024-05-01T12:00:00Z"},{"name":"infra","aliases":[],"owners":[],"subteams":[],"tags":{},"member_count":1}]}`},
+		{"/api/v1/teams/partners", 200, `"name":"acme"`},
+		{"/api/v1/teams/globex", 404, `{"error":"not_found","message":"Team 'globex' does not exist."}`},
+		{"/api/v1/teams/acme/members", 200, `{"items":[{"id":"U1","name":"Alice","channels":[{"id":"C1","name":"proj-x"}]},{"id":"U2","name":"Bob","channels":[]},{"id":"U3","name":"Carol","channels":[{"id":"C2","name":"proj-y"}]}]}`},
+		{"/api/v1/teams/acme/members?direct=true", 200, `{"items":[{"id":"U1","name":"Alice","channels":[{"id":"C1","name":"proj-x"}]},{"id":"U2","name":"Bob","channels":[]}]}`},
+		{"/api/v1/teams/acme/members?direct=maybe", 400, `"error":"invalid_request"`},
+		{"/api/v1/channels", 200, `{"items":[{"id":"C1","name":"proj-x"},{"id":"C2","name":"proj-y"}]}`},
+		{"/api/v1/users/U1", 200, `{"id":"U1","name":"Alice","updated_at":"2024-05-01T12:00:00Z","channels":[{"id":"C1","name":"proj-x"}],"teams":["acme"]}`},
+		{"/api/v1/users/U3", 200, `{"id":"U3","name":"Carol","channels":[{"id":"C2","name":"proj-y"}],"teams":["acme","infra"]}`},
+		{"/api/v1/users/U4", 200, `"teams":[]`},
+		{"/api/v1/users/U9", 404, `"error":"not_found"`},
+		{"/api/v1/nothing", 404, `"error":"not_found"`},
+		{"/api/v1/channels?limit=0", 400, "limit must be a number from 1 to 1000."},
+	}
+	for _, tt := range tests {
+		rec := get(t, h, tt.path, nil)
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("GET %s = %d %s\nwant %d containing %s", tt.path, rec.Code, rec.Body, tt.status, tt.want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s: Content-Type = %q", tt.path, ct)
+		}
+	}
+}
+
+func TestEscapedTeamNames(t *testing.T) {
+	st := setupStore(t)
+	teams, _ := st.ReadTeams()
+	teams.Teams["Platform Team/EU"] = store.Team{Members: []store.Member{}}
+	if err := st.WriteTeams(teams); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get(t, Handler(st, []string{testToken}), "/api/v1/teams/Platform%20Team%2FEU", nil)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"name":"Platform Team/EU"`) {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	st := setupStore(t)
+	ws, err := st.Workspace("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteTeams(store.Teams{Teams: map[string]store.Team{"globex": {Members: []store.Member{}}}}); err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(st, []string{testToken})
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/api/v1/teams?team_id=T1", 200, `{"items":[{"name":"globex","aliases":[],"owners":[],"subteams":[],"tags":{},"member_count":0}]}`},
+		{"/api/v1/teams/globex?team_id=T1", 200, `"name":"globex"`},
+		{"/api/v1/teams/acme?team_id=T1", 404, `{"error":"not_found","message":"Team 'acme' does not exist."}`},
+		{"/api/v1/teams/globex", 404, `"error":"not_found"`},
+		{"/api/v1/teams?team_id=T9", 404, `{"error":"not_found","message":"Workspace 'T9' has no data."}`},
+		{"/api/v1/teams?team_id=..%2F..", 404, `"error":"not_found"`},
+	}
+	for _, tt := range tests {
+		rec := get(t, h, tt.path, nil)
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("GET %s = %d %s\nwant %d containing %s", tt.path, rec.Code, rec.Body, tt.status, tt.want)
+		}
+	}
+
+	// Whether a workspace exists isn't given away without a token
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/teams?team_id=T9", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown workspace without token: got %d, want 401", rec.Code)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	h := Handler(setupStore(t), []string{testToken})
+
+	for _, auth := range []string{"", "Bearer", "Bearer wrong-token", "Basic " + testToken, "Bearer " + testToken + "x"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/teams", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: got %d, want 401 with WWW-Authenticate", auth, rec.Code)
+		}
+	}
+
+	// Unknown paths don't reveal anything without a token either
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/nothing", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown path without token: got %d, want 401", rec.Code)
+	}
+
+	if rec := get(t, h, "/api/v1/teams", http.Header{"Authorization": {"bearer " + testToken}}); rec.Code != 200 {
+		t.Errorf("lower case scheme: got %d, want 200", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/teams", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: got %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestPagination(t *testing.T) {
+	st := setupStore(t)
+	teams, _ := st.ReadTeams()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		teams.Teams[name] = store.Team{Members: []store.Member{}}
+	}
+	if err := st.WriteTeams(teams); err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(st, []string{testToken})
+
+	var names []string
+	path := "/api/v1/teams?limit=3"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+		rec := get(t, h, path, nil)
+		if rec.Code != 200 {
+			t.Fatalf("GET %s = %d %s", path, rec.Code, rec.Body)
+		}
+		var p page[teamJSON]
+		decode(t, rec, &p)
+		for _, team := range p.Items {
+			names = append(names, team.Name)
+		}
+		if p.NextCursor == "" {
+			break
+		}
+		path = "/api/v1/teams?limit=3&cursor=" + p.NextCursor
+	}
+
+	want := []string{"a", "acme", "b", "c", "d", "e", "infra"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("paged through %v, want %v", names, want)
+	}
+
+	if rec := get(t, h, "/api/v1/teams?cursor=!!!", nil); rec.Code != 400 {
+		t.Errorf("bad cursor: got %d, want 400", rec.Code)
+	}
+}
+
+func TestETags(t *testing.T) {
+	st := setupStore(t)
+	h := Handler(st, []string{testToken})
+
+	first := get(t, h, "/api/v1/teams/acme", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != 200 || etag == "" {
+		t.Fatalf("got %d with ETag %q", first.Code, etag)
+	}
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		rec := get(t, h, "/api/v1/teams/acme", http.Header{"If-None-Match": {ifNoneMatch}})
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: got %d %s, want 304", ifNoneMatch, rec.Code, rec.Body)
+		}
+	}
+
+	// Changing the team changes the ETag
+	teams, _ := st.ReadTeams()
+	acme := teams.Teams["acme"]
+	acme.Description = "Acme Corp"
+	teams.Teams["acme"] = acme
+	if err := st.WriteTeams(teams); err != nil {
+		t.Fatal(err)
+	}
+	rec := get(t, h, "/api/v1/teams/acme", http.Header{"If-None-Match": {etag}})
+	if rec.Code != 200 || rec.Header().Get("ETag") == etag {
+		t.Errorf("after a change: got %d with ETag %q, want 200 and a new ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	h := Handler(setupStore(t), []string{testToken})
+
+	// The spec is public
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.yaml", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("got %d", rec.Code)
+	}
+
+	var spec struct {
+		Paths map[string]interface{} `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/teams", "/teams/{team}", "/teams/{team}/members", "/channels", "/users/{id}"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("spec is missing %s", path)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"slack-connect-manager/internal/reports"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+)
+
+// The period /connect activity looks at by default
+const defaultActivitySince = 30 * 24 * time.Hour
+
+func (s *Service) registerActivityCommands(r *Router) {
+	r.Register(Command{
+		Name:    "activity",
+		Usage:   []string{"activity <team> [--since <period>]"},
+		Summary: "Show how many messages each member of a team posted in the tracked channels, and who hasn't posted at all.",
+		Flags: []Flag{
+			{Name: "since", Usage: "How far back to count, e.g. 7d, 2w or 12h. 30d if left out"},
+		},
+		Examples: []string{"activity acme", "activity acme --since 7d"},
+		Run:      s.activity,
+	})
+	r.Register(Command{
+		Name:     "activity-report",
+		Usage:    []string{"activity-report [<#channel>|off]"},
+		Summary:  "Post a weekly report of every team's activity to a channel, or stop posting it.",
+		Examples: []string{"activity-report #partner-ops", "activity-report off"},
+		Run:      s.activityReport,
+	})
+}
+
+// Show how much a team's members posted
+func (s *Service) activity(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a team name.")
+	}
+	since := defaultActivitySince
+	if flag := req.Flag("since"); flag != "" {
+		var err error
+		if since, err = parsePeriod(flag); err != nil {
+			return Failure(fmt.Sprintf("'%s' isn't a period like 30d, 2w or 12h.", flag))
+		}
+		if since > store.ActivityRetention {
+			return Failure(fmt.Sprintf("Activity is only kept for %s.", formatPeriod(store.ActivityRetention)))
+		}
+	}
+
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+	team, err := findTeam(teams, req.Args[0])
+	if err != nil {
+		return responseFor(err)
+	}
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+	activity, err := s.Store.ReadActivity()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading activity", "error", err)
+		return Failure("Error reading activity.")
+	}
+
+	from := time.Now().Add(-since)
+	engagement := activity.Engagement(teams, team, channels, from)
+	if len(engagement) == 0 {
+		return Success(fmt.Sprintf("Team '%s' has no members.", team))
+	}
+
+	var active, inactive []string
+	messages := 0
+	for _, member := range engagement {
+		label := fmt.Sprintf("%s (%s)", member.Name, member.MemberID)
+		lastActive := "never seen posting"
+		if !member.LastActive.IsZero() {
+			lastActive = "last active " + member.LastActive.Format(historyTime)
+		}
+		if member.Messages == 0 {
+			inactive = append(inactive, fmt.Sprintf("  - %s: %s", label, lastActive))
+			continue
+		}
+		messages += member.Messages
+		active = append(active, fmt.Sprintf("  - %s: %d message(s), %s", label, member.Messages, lastActive))
+	}
+
+	lines := []string{fmt.Sprintf("Activity of team '%s' in the last %s: %d message(s) from %d of %d member(s).",
+		team, formatPeriod(since), messages, len(active), len(engagement))}
+	lines = append(lines, active...)
+	if len(inactive) > 0 {
+		lines = append(lines, "Inactive, to review:")
+		lines = append(lines, inactive...)
+	}
+	if partial := partlyCounted(activity, channels, from); len(partial) > 0 {
+		lines = append(lines, "Not counted for the whole period: "+strings.Join(partial, ", ")+".")
+	}
+	return Success(strings.Join(lines, "\n"))
+}
+
+// The tracked channels whose messages aren't counted all the way back to a time
+func partlyCounted(activity store.Activity, channels store.Channels, from time.Time) []string {
+	var partial []string
+	for id, channel := range channels {
+		countedFrom, ok := activity.CountedFrom(id)
+		switch {
+		case !ok:
+			partial = append(partial, fmt.Sprintf("#%s (not yet)", channel.Name))
+		case countedFrom.After(from):
+			partial = append(partial, fmt.Sprintf("#%s (from %s)", channel.Name, countedFrom.Format(historyTime)))
+		}
+	}
+	sort.Strings(partial)
+	return partial
+}
+
+// Turn the weekly activity report on or off, or show where it goes
+func (s *Service) activityReport(ctx context.Context, req Request) Response {
+	if len(req.Args) == 0 {
+		settings, err := s.Store.ReadReports()
+		if err != nil {
+			return Failure("Error reading the report settings.")
+		}
+		if settings.ActivityChannel == "" {
+			return Success("The weekly activity report is off. Turn it on with /connect activity-report #channel.")
+		}
+		return Success(fmt.Sprintf("The weekly activity report is posted to <#%s>.", settings.ActivityChannel))
+	}
+
+	arg := req.Args[0]
+	if arg == "off" {
+		resp, ok := s.update(func() error {
+			settings, err := s.Store.ReadReports()
+			if err != nil {
+				return fail("Error reading the report settings.")
+			}
+			settings.ActivityChannel = ""
+			return s.Store.WriteReports(settings)
+		})
+		if !ok {
+			return resp
+		}
+		return Success("The weekly activity report is off now.")
+	}
+
+	id, name, ok := ParseChannelRef(arg)
+	if !ok && slackapi.IsChannelID(arg) {
+		id, ok = arg, true
+	}
+	if !ok {
+		return Failure(fmt.Sprintf("Please mention the channel, e.g. #%s, or give its ID.", strings.TrimPrefix(arg, "#")))
+	}
+	// The bot has to be in the channel to post there
+	if _, err := s.joinChannel(ctx, id, name); err != nil {
+		return Failure(fmt.Sprintf("Can't post to <#%s>: %s.", id, err.Error()))
+	}
+
+	var next time.Time
+	resp, ok := s.update(func() error {
+		settings, err := s.Store.ReadReports()
+		if err != nil {
+			return fail("Error reading the report settings.")
+		}
+		// The first report is a week from now
+		if settings.ActivityChannel == "" {
+			settings.ActivitySentAt = time.Now()
+		}
+		settings.ActivityChannel = id
+		next = settings.ActivitySentAt.Add(reports.Every)
+		return s.Store.WriteReports(settings)
+	})
+	if !ok {
+		return resp
+	}
+	slog.InfoContext(ctx, "Activity report channel set", "channel_id", id, "user_id", req.UserID)
+	return Success(fmt.Sprintf("The weekly activity report will be posted to <#%s>, next on %s.", id, next.Format(historyTime)))
+}
+
+// Parse a period like 30d, 2w or a Go duration like 12h
+func parsePeriod(text string) (time.Duration, error) {
+	var period time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(text, "d"), strings.HasSuffix(text, "w"):
+		var n int
+		n, err = strconv.Atoi(text[:len(text)-1])
+		period = time.Duration(n) * 24 * time.Hour
+		if strings.HasSuffix(text, "w") {
+			period *= 7
+		}
+	default:
+		period, err = time.ParseDuration(text)
+	}
+	if err == nil && period <= 0 {
+		err = fmt.Errorf("period %s isn't positive", text)
+	}
+	return period, err
+}
+
+// Write a period in days if it's whole days
+func formatPeriod(period time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case period == day:
+		return "day"
+	case period%day == 0:
+		return fmt.Sprintf("%d days", period/day)
+	}
+	return period.String()
+}
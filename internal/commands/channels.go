@@ -0,0 +1,579 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+func (s *Service) registerChannelCommands(r *Router) {
+	r.Register(Command{
+		Name:    "ping",
+		Usage:   []string{"ping <team> [channel] [--message <text>]"},
+		Summary: "Mention every member of a team in a tracked channel. Without a channel, the team's default channel is used.",
+		Flags: []Flag{
+			{Name: "message", Usage: "Text to post after the mentions"},
+		},
+		Examples: []string{"ping platform #proj-x", `ping platform proj-x --message "Standup in 5 minutes"`},
+		Run:      s.ping,
+	})
+	r.Register(Command{
+		Name:     "add-channel",
+		Usage:    []string{"add-channel", "add-channel <#channel>..."},
+		Summary:  "Start tracking the mentioned channels, or the channel the command is run in. Private channels need /invite @connect-management first.",
+		Examples: []string{"add-channel", "add-channel #ext-acme #ext-globex", "add-channel C0123ABCD"},
+		// Each channel is joined and synced in turn
+		Slow: func(req Request) bool { return len(req.Args) > 1 },
+		Run:  s.addChannel,
+	})
+	r.Register(Command{
+		Name:    "add-channels",
+		Usage:   []string{"add-channels --pattern <pattern>"},
+		Summary: "Start tracking every Slack Connect channel whose name matches a pattern, where * matches any characters.",
+		Flags: []Flag{
+			{Name: "pattern", Usage: "Channel names to match, e.g. ext-*"},
+		},
+		Examples: []string{"add-channels --pattern ext-*", "add-channels --pattern *-partners"},
+		Slow:     Always,
+		Run:      s.addChannels,
+	})
+	r.Register(Command{
+		Name:     "discover",
+		Usage:    []string{"discover"},
+		Summary:  "Start tracking every Slack Connect channel the bot can see, and record which organizations each one is shared with. With auto discovery on, this also happens every discover interval.",
+		Examples: []string{"discover"},
+		Slow:     Always,
+		Run:      s.discover,
+	})
+	r.Register(Command{
+		Name:     "sync",
+		Usage:    []string{"sync [channel]"},
+		Summary:  "Refresh the members of a tracked channel from Slack now, or of every tracked channel.",
+		Examples: []string{"sync", "sync #proj-x"},
+		Run:      s.sync,
+	})
+	r.Register(Command{
+		Name:     "whereis",
+		Usage:    []string{"whereis <user>"},
+		Summary:  "List the tracked channels a user was in at the last sync. The user can be a mention, an ID or a display name.",
+		Examples: []string{"whereis @alice", "whereis U0123ABCD", `whereis "Alice Smith"`},
+		Run:      s.whereis,
+	})
+	r.Register(Command{
+		Name:     "remove-channel",
+		Usage:    []string{"remove-channel <channel>"},
+		Summary:  "Stop tracking a channel, given by name, ID or mention.",
+		Examples: []string{"remove-channel #proj-x", "remove-channel C0123ABCD"},
+		Run:      s.removeChannel,
+	})
+}
+
+// Ping all members of a team in a specific channel
+func (s *Service) ping(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a team name and a channel name to ping.")
+	}
+
+	team, channelArg := req.Args[0], ""
+	if len(req.Args) > 1 {
+		channelArg = req.Args[1]
+	}
+	slog.InfoContext(ctx, "Attempting to ping team", "team", team, "channel", channelArg)
+
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading teams", "error", err)
+		return Failure("Error reading teams.")
+	}
+
+	team, err = findTeam(teams, team)
+	if err != nil {
+		return responseFor(err)
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+
+	var channelID, channelName string
+	if channelArg != "" {
+		channelID, channelName, err = resolveChannel(channels, channelArg)
+	} else if defaultChannel := teams.Teams[team].DefaultChannel; defaultChannel != "" {
+		channelID, channelName, err = resolveChannel(channels, "<#"+defaultChannel+">")
+	} else {
+		return Failure(fmt.Sprintf("Team '%s' has no default channel. Please provide a channel name to ping, or set one with /connect set %s default-channel <channel>.", team, quoteArg(team)))
+	}
+	if err != nil {
+		return responseFor(err)
+	}
+	if channelID == "" {
+		return Failure(fmt.Sprintf("Channel '%s' not found.", channelName))
+	}
+
+	slog.DebugContext(ctx, "Found channel", "channel", channelName, "channel_id", channelID)
+
+	var mentions []string
+	for _, member := range teams.Members(team) {
+		if member.MemberID != "" {
+			mentions = append(mentions, fmt.Sprintf("<@%s>", member.MemberID))
+		}
+	}
+
+	if len(mentions) == 0 {
+		return Failure(fmt.Sprintf("No members of team '%s' found.", team))
+	}
+
+	text := strings.Join(mentions, " ")
+	if message := req.Flag("message"); message != "" {
+		text += " " + message
+	}
+
+	slog.DebugContext(ctx, "Posting mentions", "channel_id", channelID, "count", len(mentions))
+	_, _, err = s.Slack.PostMessageContext(ctx, channelID, slack.MsgOptionText(text, false))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error pinging team", "team", team, "channel_id", channelID, "error", err)
+		return Failure(fmt.Sprintf("Error pinging team: %v", err))
+	}
+
+	slog.InfoContext(ctx, "Pinged team", "team", team, "channel", channelName)
+	return Success(fmt.Sprintf("Successfully pinged team '%s' in #%s.", team, channelName))
+}
+
+const notInChannelMessage = "You need to run the command inside the channel you want to add. If you are trying to add a private channel please run /invite @connect-management."
+
+// Add channels to the tracking list: the ones given, or the channel the
+// command was run in
+func (s *Service) addChannel(ctx context.Context, req Request) Response {
+	if len(req.Args) == 0 {
+		return s.addCurrentChannel(ctx, req)
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+
+	var report channelReport
+	seen := make(map[string]bool)
+	for _, arg := range req.Args {
+		id, name, ok := ParseChannelRef(arg)
+		if !ok && slackapi.IsChannelID(arg) {
+			id, ok = arg, true
+		}
+		if !ok {
+			report.failed = append(report.failed, fmt.Sprintf("%s: please mention the channel, e.g. #%s, or give its ID", arg, strings.TrimPrefix(arg, "#")))
+			continue
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if channel, tracked := channels[id]; tracked {
+			report.tracked = append(report.tracked, channel)
+			continue
+		}
+		channel, err := s.joinChannel(ctx, id, name)
+		if err != nil {
+			report.failed = append(report.failed, fmt.Sprintf("<#%s>: %s", id, err.Error()))
+			continue
+		}
+		report.candidates = append(report.candidates, channel)
+	}
+
+	return s.trackChannels(ctx, req, report)
+}
+
+// Add the channel the command was run in
+func (s *Service) addCurrentChannel(ctx context.Context, req Request) Response {
+	channelID, channelName := req.ChannelID, req.ChannelName
+	slog.InfoContext(ctx, "Attempting to add channel", "channel", channelName, "channel_id", channelID)
+
+	// Check if we're actually in the channel we're trying to add
+	if channelID == "" || channelName == "" {
+		slog.InfoContext(ctx, "Channel ID or name is empty")
+		return Failure(notInChannelMessage)
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure(notInChannelMessage)
+	}
+
+	if _, exists := channels[channelID]; exists {
+		return Failure(fmt.Sprintf("Channel #%s is already being tracked.", channelName))
+	}
+
+	channel, err := s.joinChannel(ctx, channelID, channelName)
+	if err != nil {
+		return Failure(notInChannelMessage)
+	}
+	return s.trackChannels(ctx, req, channelReport{candidates: []store.Channel{channel}})
+}
+
+// Add every Slack Connect channel whose name matches a pattern
+func (s *Service) addChannels(ctx context.Context, req Request) Response {
+	pattern := strings.ToLower(strings.TrimPrefix(req.Flag("pattern"), "#"))
+	if pattern == "" {
+		return Failure("Please provide a pattern to match channel names, e.g. /connect add-channels --pattern ext-*")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return Failure(fmt.Sprintf("'%s' isn't a valid pattern. Use * to match any characters, e.g. ext-*", pattern))
+	}
+	slog.InfoContext(ctx, "Attempting to add channels", "pattern", pattern)
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+
+	// Private channels are only listed if the bot is in them
+	var matches []slack.Channel
+	params := &slack.GetConversationsParameters{
+		Types:           []string{"public_channel", "private_channel"},
+		ExcludeArchived: true,
+		Limit:           200,
+	}
+	for {
+		page, cursor, err := s.Slack.GetConversationsContext(ctx, params)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error listing channels", "error", err)
+			return Failure(fmt.Sprintf("Error listing channels: %v", err))
+		}
+		for _, channel := range page {
+			if ok, _ := path.Match(pattern, strings.ToLower(channel.Name)); ok && channel.IsExtShared {
+				matches = append(matches, channel)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+		params.Cursor = cursor
+	}
+	if len(matches) == 0 {
+		return Failure(fmt.Sprintf("No Slack Connect channels match '%s'. Private channels only show up once @connect-management has been invited.", pattern))
+	}
+
+	var report channelReport
+	for _, match := range matches {
+		if channel, tracked := channels[match.ID]; tracked {
+			report.tracked = append(report.tracked, channel)
+			continue
+		}
+		if !match.IsMember {
+			if _, _, _, err := s.Slack.JoinConversationContext(ctx, match.ID); err != nil {
+				slog.ErrorContext(ctx, "Error joining channel", "channel_id", match.ID, "error", err)
+				report.failed = append(report.failed, fmt.Sprintf("#%s: %v", match.Name, err))
+				continue
+			}
+		}
+		report.candidates = append(report.candidates, store.Channel{ID: match.ID, Name: match.Name})
+	}
+
+	return s.trackChannels(ctx, req, report)
+}
+
+// Track every shared channel now, rather than waiting for auto discovery
+func (s *Service) discover(ctx context.Context, req Request) Response {
+	slog.InfoContext(ctx, "Discovering shared channels")
+	result, err := s.Sync.Discover(ctx)
+	if err != nil {
+		return Failure(fmt.Sprintf("Error discovering shared channels: %v", err))
+	}
+	if result.Shared == 0 {
+		return Success("No Slack Connect channels found. Private channels only show up once @connect-management has been invited.")
+	}
+
+	// The sync pass would get to them, but the person asking wants them now
+	for _, channel := range result.Added {
+		s.Sync.SyncInBackground(ctx, channel.ID)
+	}
+
+	var text string
+	if len(result.Added) > 0 {
+		text = fmt.Sprintf("Found %d Slack Connect channel(s). Now tracking %s.", result.Shared, channelList(result.Added))
+	} else {
+		text = fmt.Sprintf("Found %d Slack Connect channel(s), all already tracked.", result.Shared)
+	}
+	if len(result.Failed) > 0 {
+		names := make([]string, len(result.Failed))
+		for i, name := range result.Failed {
+			names[i] = "#" + name
+		}
+		text += fmt.Sprintf("\nCouldn't join %s.", strings.Join(names, ", "))
+	}
+	return Success(text)
+}
+
+// Make sure the bot is in a channel it's about to track, joining it if it
+// can. Bots can't join private channels, so they have to be invited. The
+// name is used if Slack doesn't tell us the channel's name.
+func (s *Service) joinChannel(ctx context.Context, channelID, name string) (store.Channel, error) {
+	info, err := s.Slack.GetConversationInfoContext(ctx, &slack.GetConversationInfoInput{ChannelID: channelID})
+	if err != nil {
+		// Private channels are hidden from bots that aren't in them
+		slog.ErrorContext(ctx, "Error getting channel info", "channel_id", channelID, "error", err)
+		return store.Channel{}, errors.New("I can't see this channel. If it's private, please run /invite @connect-management in it first")
+	}
+	if info.Name != "" {
+		name = info.Name
+	}
+	if name == "" {
+		name = channelID
+	}
+	channel := store.Channel{ID: channelID, Name: name}
+
+	if info.IsMember {
+		slog.DebugContext(ctx, "Already in channel", "channel_id", channelID)
+		return channel, nil
+	}
+	if info.IsPrivate {
+		return store.Channel{}, errors.New("this is a private channel, please run /invite @connect-management in it first")
+	}
+	if _, _, _, err := s.Slack.JoinConversationContext(ctx, channelID); err != nil {
+		slog.ErrorContext(ctx, "Error joining channel", "channel_id", channelID, "error", err)
+		return store.Channel{}, fmt.Errorf("error joining the channel: %v", err)
+	}
+	return channel, nil
+}
+
+// What happened to each channel of an add-channel or add-channels
+type channelReport struct {
+	// Channels the bot is in, to be tracked
+	candidates []store.Channel
+	// Channels that were tracked already
+	tracked []store.Channel
+	// Why each channel that couldn't be added wasn't
+	failed []string
+}
+
+// Start tracking the report's candidates, then sync them and send their events
+func (s *Service) trackChannels(ctx context.Context, req Request, report channelReport) Response {
+	var added []store.Channel
+	if len(report.candidates) > 0 {
+		resp, ok := s.update(func() error {
+			channels, err := s.Store.ReadChannels()
+			if err != nil {
+				return fail("Error reading channels.")
+			}
+
+			for _, channel := range report.candidates {
+				// Someone may have added it while we were joining
+				if existing, tracked := channels[channel.ID]; tracked {
+					report.tracked = append(report.tracked, existing)
+					continue
+				}
+				channels[channel.ID] = channel
+				added = append(added, channel)
+			}
+			if err := s.Store.WriteChannels(channels); err != nil {
+				slog.ErrorContext(ctx, "Error writing to channels file", "error", err)
+				return fail("Error writing to channels file.")
+			}
+			return nil
+		})
+		if !ok {
+			return resp
+		}
+	}
+
+	var events []webhooks.Event
+	for _, channel := range added {
+		// Update user information for this channel
+		s.Sync.SyncInBackground(ctx, channel.ID)
+
+		event := newEvent(webhooks.ChannelTracked, req)
+		event.Channel = &webhooks.Channel{ID: channel.ID, Name: channel.Name}
+		events = append(events, event)
+		slog.InfoContext(ctx, "Added channel to the tracking list", "channel", channel.Name, "channel_id", channel.ID)
+	}
+	s.emit(ctx, events...)
+
+	// A single channel gets a single sentence
+	switch {
+	case len(added) == 1 && len(report.tracked) == 0 && len(report.failed) == 0:
+		return Success(fmt.Sprintf("Channel #%s has been added to the tracking list.", added[0].Name))
+	case len(added) == 0 && len(report.tracked) == 1 && len(report.failed) == 0:
+		return Failure(fmt.Sprintf("Channel #%s is already being tracked.", report.tracked[0].Name))
+	case len(added) == 0 && len(report.tracked) == 0 && len(report.failed) == 1:
+		return Failure(fmt.Sprintf("Couldn't add %s.", report.failed[0]))
+	}
+
+	var lines []string
+	if len(added) > 0 {
+		lines = append(lines, fmt.Sprintf("Added %d channel(s) to the tracking list: %s.", len(added), channelList(added)))
+	}
+	if len(report.tracked) > 0 {
+		lines = append(lines, fmt.Sprintf("Already tracked: %s.", channelList(report.tracked)))
+	}
+	if len(report.failed) > 0 {
+		lines = append(lines, "Couldn't add:")
+		for _, reason := range report.failed {
+			lines = append(lines, "• "+reason)
+		}
+	}
+	text := strings.Join(lines, "\n")
+	if len(added) == 0 && len(report.failed) > 0 {
+		return Failure(text)
+	}
+	return Success(text)
+}
+
+// List channels as #name, #name in order of name
+func channelList(channels []store.Channel) string {
+	names := make([]string, len(channels))
+	for i, channel := range channels {
+		names[i] = "#" + channel.Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Sync one or every tracked channel now, instead of waiting for its turn
+func (s *Service) sync(ctx context.Context, req Request) Response {
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+
+	if len(req.Args) > 0 {
+		channelID, channelName, err := resolveChannel(channels, req.Args[0])
+		if err != nil {
+			return responseFor(err)
+		}
+		if channelID == "" {
+			return Failure(fmt.Sprintf("Channel #%s is not being tracked.", channelName))
+		}
+		s.Sync.SyncInBackground(ctx, channelID)
+		return Success(fmt.Sprintf("Syncing #%s now.", channelName))
+	}
+
+	if len(channels) == 0 {
+		return Failure("No channels are being tracked.")
+	}
+	for channelID := range channels {
+		s.Sync.SyncInBackground(ctx, channelID)
+	}
+	return Success(fmt.Sprintf("Syncing %d tracked channel(s) now.", len(channels)))
+}
+
+// List the tracked channels a user is in
+func (s *Service) whereis(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a user to look for.")
+	}
+
+	users, err := s.Store.ReadUsers()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading users", "error", err)
+		return Failure("Error reading users.")
+	}
+	user, err := findUser(users, req.Args[0])
+	if err != nil {
+		return responseFor(err)
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+	// Users keep channels that have since stopped being tracked
+	var in []store.Channel
+	for channelID := range user.Channels {
+		if channel, tracked := channels[channelID]; tracked {
+			in = append(in, channel)
+		}
+	}
+
+	label := fmt.Sprintf("%s (%s)", user.Name, user.MemberID)
+	if len(in) == 0 {
+		return Success(fmt.Sprintf("%s isn't in any tracked channels.", label))
+	}
+	return Success(fmt.Sprintf("%s is in %d tracked channel(s): %s.", label, len(in), channelList(in)))
+}
+
+// Find a user the sync has seen by mention, ID or display name, ignoring case
+func findUser(users store.Users, arg string) (store.User, error) {
+	id := parseUserArg(arg)
+	if user, ok := users[id]; ok {
+		return user, nil
+	}
+
+	name := strings.TrimPrefix(arg, "@")
+	var matches []store.User
+	for _, user := range users {
+		if strings.EqualFold(user.Name, name) {
+			matches = append(matches, user)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return store.User{}, fail(fmt.Sprintf("User '%s' hasn't been seen in any tracked channel.", name))
+	case 1:
+		return matches[0], nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].MemberID < matches[j].MemberID })
+	candidates := make([]string, len(matches))
+	for i, user := range matches {
+		candidates[i] = fmt.Sprintf("<@%s> (%s)", user.MemberID, user.MemberID)
+	}
+	return store.User{}, fail(fmt.Sprintf("%d users are called '%s': %s. Please use the user's ID or mention them instead.",
+		len(matches), name, strings.Join(candidates, ", ")))
+}
+
+// Remove a channel from the tracking list
+func (s *Service) removeChannel(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a channel name to remove.")
+	}
+
+	channelName := req.Args[0]
+	var channelID string
+	resp, ok := s.update(func() error {
+		channels, err := s.Store.ReadChannels()
+		if err != nil {
+			return fail("Error reading channels.")
+		}
+
+		channelID, channelName, err = resolveChannel(channels, req.Args[0])
+		if err != nil {
+			return err
+		}
+		if channelID == "" {
+			return fail(fmt.Sprintf("Channel #%s is not being tracked.", channelName))
+		}
+
+		delete(channels, channelID)
+		if err := s.Store.WriteChannels(channels); err != nil {
+			return fail("Error writing to channels file.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	event := newEvent(webhooks.ChannelUntracked, req)
+	event.Channel = &webhooks.Channel{ID: channelID, Name: channelName}
+	s.emit(ctx, event)
+
+	return Success(fmt.Sprintf("Channel #%s has been removed from the tracking list.", channelName))
+}
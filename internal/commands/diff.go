@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"slack-connect-manager/internal/store"
+)
+
+func (s *Service) registerDiffCommands(r *Router) {
+	r.Register(Command{
+		Name:    "diff",
+		Usage:   []string{"diff <team> <channel> [--invite]"},
+		Summary: "Show which team members are missing from a tracked channel and who is there without being in the team.",
+		Flags: []Flag{
+			{Name: "invite", Usage: "Invite the missing members to the channel", Bool: true},
+		},
+		Examples: []string{"diff platform #proj-x", "diff platform proj-x --invite"},
+		Run:      s.diff,
+	})
+	r.Register(Command{
+		Name:     "reconcile",
+		Usage:    []string{"reconcile"},
+		Summary:  "Show the missing and extra members of every team in the tracked channels it is part of.",
+		Examples: []string{"reconcile"},
+		Run:      s.reconcile,
+	})
+}
+
+// The result of comparing a team against the members of a tracked channel
+type channelDiff struct {
+	Missing []store.Member
+	Extra   []store.User
+}
+
+// Compare the members of a team, including its subteams, with the people
+// seen in a channel. Team members are checked against their Channels data,
+// and anyone else we've seen in the channel counts as extra.
+func diffTeamChannel(members []store.Member, users store.Users, channelID string) channelDiff {
+	var diff channelDiff
+	inTeam := make(map[string]bool)
+	for _, member := range members {
+		inTeam[member.MemberID] = true
+		if _, ok := member.Channels[channelID]; !ok {
+			diff.Missing = append(diff.Missing, member)
+		}
+	}
+
+	for memberID, user := range users {
+		if inTeam[memberID] {
+			continue
+		}
+		if _, ok := user.Channels[channelID]; ok {
+			diff.Extra = append(diff.Extra, user)
+		}
+	}
+
+	sort.Slice(diff.Missing, func(i, j int) bool { return diff.Missing[i].MemberID < diff.Missing[j].MemberID })
+	sort.Slice(diff.Extra, func(i, j int) bool { return diff.Extra[i].MemberID < diff.Extra[j].MemberID })
+	return diff
+}
+
+// Format a member for a report, including when we last saw them in the channel
+func describeMember(memberID, name string, memberships store.Memberships, channelID, channelName string) string {
+	label := memberID
+	if name != "" {
+		label = fmt.Sprintf("%s (%s)", name, memberID)
+	}
+	if membership, ok := memberships[channelID][memberID]; ok && !membership.LastSeen.IsZero() {
+		return fmt.Sprintf("%s, last seen in #%s %s", label, channelName, membership.LastSeen.Format("2006-01-02 15:04"))
+	}
+	return fmt.Sprintf("%s, never seen in #%s", label, channelName)
+}
+
+// Format the missing and extra members of a diff as report lines
+func formatChannelDiff(diff channelDiff, memberships store.Memberships, channelID, channelName string) []string {
+	var lines []string
+	if len(diff.Missing) == 0 {
+		lines = append(lines, "Missing: none")
+	} else {
+		lines = append(lines, "Missing:")
+		for _, member := range diff.Missing {
+			lines = append(lines, "  - "+describeMember(member.MemberID, member.Name, memberships, channelID, channelName))
+		}
+	}
+
+	if len(diff.Extra) == 0 {
+		lines = append(lines, "Extra: none")
+	} else {
+		lines = append(lines, "Extra:")
+		for _, user := range diff.Extra {
+			lines = append(lines, "  - "+describeMember(user.MemberID, user.Name, memberships, channelID, channelName))
+		}
+	}
+	return lines
+}
+
+// Show which members of a team are missing from a channel, and optionally invite them
+func (s *Service) diff(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide a team name and a channel name to compare.")
+	}
+
+	team, channelArg := req.Args[0], req.Args[1]
+	// A trailing "invite" is still accepted from before --invite existed
+	invite := req.Bool("invite") || (len(req.Args) > 2 && req.Args[2] == "invite")
+
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	team, err = findTeam(teams, team)
+	if err != nil {
+		return responseFor(err)
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		return Failure("Error reading channels.")
+	}
+
+	channelID, channelName, err := resolveChannel(channels, channelArg)
+	if err != nil {
+		return responseFor(err)
+	}
+	if channelID == "" {
+		return Failure(fmt.Sprintf("Channel #%s is not being tracked.", channelName))
+	}
+
+	users, err := s.Store.ReadUsers()
+	if err != nil {
+		return Failure("Error reading users.")
+	}
+
+	diff := diffTeamChannel(teams.Members(team), users, channelID)
+
+	if invite {
+		if len(diff.Missing) == 0 {
+			return Success(fmt.Sprintf("All members of team '%s' are already in #%s.", team, channelName))
+		}
+
+		memberIDs := make([]string, len(diff.Missing))
+		for i, member := range diff.Missing {
+			memberIDs[i] = member.MemberID
+		}
+
+		slog.InfoContext(ctx, "Inviting team members to channel", "user_ids", memberIDs, "channel_id", channelID)
+		_, err = s.Slack.InviteUsersToConversationContext(ctx, channelID, memberIDs...)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error inviting members to channel", "channel_id", channelID, "error", err)
+			return Failure(fmt.Sprintf("Error inviting members: %v", err))
+		}
+
+		// Pick up the new members right away instead of waiting for the next sync
+		s.Sync.SyncInBackground(ctx, channelID)
+
+		return Success(fmt.Sprintf("Invited %d member(s) of team '%s' to #%s.", len(memberIDs), team, channelName))
+	}
+
+	memberships, err := s.Store.ReadMemberships()
+	if err != nil {
+		return Failure("Error reading the membership history.")
+	}
+
+	lines := []string{fmt.Sprintf("Team '%s' vs #%s:", team, channelName)}
+	lines = append(lines, formatChannelDiff(diff, memberships, channelID, channelName)...)
+	if len(diff.Missing) > 0 {
+		lines = append(lines, fmt.Sprintf("Run /connect diff %s %s --invite to invite the missing members.", quoteArg(team), quoteArg(channelName)))
+	}
+
+	return Success(strings.Join(lines, "\n"))
+}
+
+// Report, for every team, the tracked channels it has members in and who is missing or extra
+func (s *Service) reconcile(ctx context.Context, req Request) Response {
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		return Failure("Error reading channels.")
+	}
+
+	users, err := s.Store.ReadUsers()
+	if err != nil {
+		return Failure("Error reading users.")
+	}
+
+	memberships, err := s.Store.ReadMemberships()
+	if err != nil {
+		return Failure("Error reading the membership history.")
+	}
+
+	teamNames := make([]string, 0, len(teams.Teams))
+	for team := range teams.Teams {
+		teamNames = append(teamNames, team)
+	}
+	sort.Strings(teamNames)
+
+	channelIDs := make([]string, 0, len(channels))
+	for id := range channels {
+		channelIDs = append(channelIDs, id)
+	}
+	sort.Slice(channelIDs, func(i, j int) bool { return channels[channelIDs[i]].Name < channels[channelIDs[j]].Name })
+
+	var lines []string
+	for _, team := range teamNames {
+		for _, channelID := range channelIDs {
+			members := teams.Members(team)
+			diff := diffTeamChannel(members, users, channelID)
+
+			// Only report channels the team is actually part of
+			if len(diff.Missing) == len(members) {
+				continue
+			}
+			if len(diff.Missing) == 0 && len(diff.Extra) == 0 {
+				continue
+			}
+
+			lines = append(lines, fmt.Sprintf("Team '%s' vs #%s:", team, channels[channelID].Name))
+			lines = append(lines, formatChannelDiff(diff, memberships, channelID, channels[channelID].Name)...)
+		}
+	}
+
+	if len(lines) == 0 {
+		return Success("All teams are in sync with their tracked channels.")
+	}
+
+	return Success(strings.Join(lines, "\n"))
+}
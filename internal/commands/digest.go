@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"slack-connect-manager/internal/reports"
+)
+
+func (s *Service) registerDigestCommands(r *Router) {
+	r.Register(Command{
+		Name:    "digest",
+		Usage:   []string{"digest [on|off]", "digest preview [team]"},
+		Summary: "Turn the team owners' weekly digest on or off, or see this week's digest of a team, or of the teams you own.",
+		Examples: []string{
+			"digest off",
+			"digest preview acme",
+		},
+		Run: s.digest,
+	})
+}
+
+func (s *Service) digest(ctx context.Context, req Request) Response {
+	sub := ""
+	if len(req.Args) > 0 {
+		sub = req.Args[0]
+	}
+
+	switch sub {
+	case "":
+		settings, err := s.Store.ReadReports()
+		if err != nil {
+			return Failure("Error reading the report settings.")
+		}
+		if settings.DigestOff {
+			return Success("The weekly digest is off. Turn it on with /connect digest on.")
+		}
+		if settings.DigestSentAt.IsZero() {
+			return Success("Team owners get a weekly digest of their teams by direct message.")
+		}
+		return Success(fmt.Sprintf("Team owners get a weekly digest of their teams by direct message, next on %s.",
+			settings.DigestSentAt.Add(reports.Every).Format(historyTime)))
+	case "on", "off":
+		off := sub == "off"
+		resp, ok := s.update(func() error {
+			settings, err := s.Store.ReadReports()
+			if err != nil {
+				return fail("Error reading the report settings.")
+			}
+			if settings.DigestOff && !off {
+				// The first digest is a week from now
+				settings.DigestSentAt = time.Now()
+			}
+			settings.DigestOff = off
+			return s.Store.WriteReports(settings)
+		})
+		if !ok {
+			return resp
+		}
+		slog.InfoContext(ctx, "Weekly digest turned "+sub, "user_id", req.UserID)
+		if off {
+			return Success("The weekly digest is off now.")
+		}
+		return Success("Team owners will get a weekly digest of their teams by direct message.")
+	case "preview":
+		return s.previewDigest(req)
+	}
+	return Failure(fmt.Sprintf("Unknown digest command '%s'. Use on, off or preview.", sub))
+}
+
+// Show the digest of a team, or of the teams the user owns, for the past week
+func (s *Service) previewDigest(req Request) Response {
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	var names []string
+	if len(req.Args) > 1 {
+		team, err := findTeam(teams, req.Args[1])
+		if err != nil {
+			return responseFor(err)
+		}
+		names = []string{team}
+	} else {
+		names = reports.OwnedTeams(teams)[req.UserID]
+		if len(names) == 0 {
+			return Failure("You don't own any teams. Use /connect digest preview <team> to see a team's digest.")
+		}
+	}
+
+	text, _, err := reports.BuildDigest(s.Store, names, time.Now())
+	if err != nil {
+		return Failure("Error building the digest.")
+	}
+	return Success(text)
+}
@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"slack-connect-manager/internal/store"
+)
+
+func (s *Service) registerHistoryCommands(r *Router) {
+	r.Register(Command{
+		Name:    "history",
+		Usage:   []string{"history <channel> [--team <team>] [--left]"},
+		Summary: "Show when people joined and left a tracked channel, as seen by the sync and Slack's events.",
+		Flags: []Flag{
+			{Name: "team", Usage: "Only show the members of this team, including the ones never seen in the channel"},
+			{Name: "left", Usage: "Only show the people who left", Bool: true},
+		},
+		Examples: []string{"history #proj-x", "history #proj-x --team acme-eng --left"},
+		Run:      s.history,
+	})
+}
+
+// The time format used in the membership history
+const historyTime = "2006-01-02 15:04"
+
+// A line of the membership history
+type historyEntry struct {
+	id, name   string
+	membership store.Membership
+	seen       bool
+}
+
+// Show the membership history of a tracked channel
+func (s *Service) history(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a channel to show the history of.")
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return Failure("Error reading channels.")
+	}
+	channelID, channelName, err := resolveChannel(channels, req.Args[0])
+	if err != nil {
+		return responseFor(err)
+	}
+	if channelID == "" {
+		return Failure(fmt.Sprintf("Channel #%s is not being tracked.", channelName))
+	}
+
+	memberships, err := s.Store.ReadMemberships()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading memberships", "error", err)
+		return Failure("Error reading the membership history.")
+	}
+	users, err := s.Store.ReadUsers()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading users", "error", err)
+		return Failure("Error reading users.")
+	}
+
+	var entries []historyEntry
+	heading := fmt.Sprintf("Membership history of #%s", channelName)
+	nobody := "Nobody"
+	if team := req.Flag("team"); team != "" {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return Failure("Error reading teams.")
+		}
+		if team, err = findTeam(teams, team); err != nil {
+			return responseFor(err)
+		}
+		heading = fmt.Sprintf("Membership history of team '%s' in #%s", team, channelName)
+		nobody = fmt.Sprintf("Nobody in team '%s'", team)
+		for _, member := range teams.Members(team) {
+			membership, seen := memberships[channelID][member.MemberID]
+			entries = append(entries, historyEntry{id: member.MemberID, name: member.Name, membership: membership, seen: seen})
+		}
+	} else {
+		for id, membership := range memberships[channelID] {
+			entries = append(entries, historyEntry{id: id, membership: membership, seen: true})
+		}
+	}
+
+	var lines []string
+	for i := range entries {
+		if user, ok := users[entries[i].id]; ok && user.Name != "" {
+			entries[i].name = user.Name
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if a, b := strings.ToLower(entries[i].name), strings.ToLower(entries[j].name); a != b {
+			return a < b
+		}
+		return entries[i].id < entries[j].id
+	})
+	for _, entry := range entries {
+		if req.Bool("left") && (!entry.seen || entry.membership.LeftAt == nil) {
+			continue
+		}
+		lines = append(lines, "  - "+formatHistoryEntry(entry, channelName))
+	}
+
+	if len(lines) == 0 {
+		if req.Bool("left") {
+			return Success(fmt.Sprintf("%s has left #%s.", nobody, channelName))
+		}
+		return Success(fmt.Sprintf("%s has been seen in #%s yet. It may not have been synced.", nobody, channelName))
+	}
+	return Success(heading + ":\n" + strings.Join(lines, "\n"))
+}
+
+// Format one person's time in a channel
+func formatHistoryEntry(entry historyEntry, channelName string) string {
+	label := entry.id
+	if entry.name != "" {
+		label = fmt.Sprintf("%s (%s)", entry.name, entry.id)
+	}
+	if !entry.seen {
+		return fmt.Sprintf("%s: never seen in #%s", label, channelName)
+	}
+
+	m := entry.membership
+	text := fmt.Sprintf("%s: joined %s", label, m.JoinedAt.Format(historyTime))
+	if m.FirstSeen.Before(m.JoinedAt) {
+		text += fmt.Sprintf(" (first seen %s)", m.FirstSeen.Format(historyTime))
+	}
+	if m.LeftAt != nil {
+		return text + ", left " + m.LeftAt.Format(historyTime)
+	}
+	return text + ", still there"
+}
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"slack-connect-manager/internal/webhooks"
+)
+
+func (s *Service) registerMergeCommands(r *Router) {
+	r.Register(Command{
+		Name:     "rename-team",
+		Usage:    []string{"rename-team <team> <new_name>"},
+		Summary:  "Rename a team, keeping its members and details. Teams that include it are updated.",
+		Examples: []string{"rename-team acme acme-corp"},
+		Run:      s.renameTeam,
+	})
+	r.Register(Command{
+		Name:     "merge-teams",
+		Usage:    []string{"merge-teams <source> <target>"},
+		Summary:  "Move the members, subteams, owners, aliases and tags of one team into another and remove it. People in both teams are kept once.",
+		Examples: []string{"merge-teams acme-old acme"},
+		Run:      s.mergeTeams,
+	})
+}
+
+// Rename a team
+func (s *Service) renameTeam(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide the team to rename and its new name.")
+	}
+
+	team, newName := req.Args[0], req.Args[1]
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		team, err = findTeam(teams, team)
+		if err != nil {
+			return err
+		}
+
+		if owner, taken := teams.Resolve(newName); taken {
+			if owner == newName {
+				return fail(fmt.Sprintf("Team '%s' already exists.", newName))
+			}
+			if owner != team {
+				return fail(fmt.Sprintf("'%s' is already an alias of team '%s'.", newName, owner))
+			}
+		}
+
+		teams.Rename(team, newName)
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	event := newEvent(webhooks.TeamRenamed, req)
+	event.Team = newName
+	event.PreviousName = team
+	s.emit(ctx, event)
+
+	return Success(fmt.Sprintf("Team '%s' has been renamed to '%s'.", team, newName))
+}
+
+// Merge one team into another
+func (s *Service) mergeTeams(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide the team to merge and the team to merge it into.")
+	}
+
+	source, target := req.Args[0], req.Args[1]
+	var memberCount int
+	var events []webhooks.Event
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		source, err = findTeam(teams, source)
+		if err != nil {
+			return err
+		}
+		target, err = findTeam(teams, target)
+		if err != nil {
+			return err
+		}
+		if source == target {
+			return fail("Please provide two different teams to merge.")
+		}
+
+		// Everyone in the source who wasn't in the target is new to it
+		existing := make(map[string]bool)
+		for _, member := range teams.Teams[target].Members {
+			existing[member.MemberID] = true
+		}
+		for _, member := range teams.Teams[source].Members {
+			if !existing[member.MemberID] {
+				event := newEvent(webhooks.MemberAdded, req)
+				event.Team = target
+				event.Member = &webhooks.Member{ID: member.MemberID, Name: member.Name}
+				events = append(events, event)
+			}
+		}
+		removed := newEvent(webhooks.TeamRemoved, req)
+		removed.Team = source
+		removed.MergedInto = target
+		events = append(events, removed)
+
+		teams.Merge(source, target)
+
+		// Merging can close a loop, e.g. when the source included a team that
+		// includes the target
+		for _, subteam := range teams.Teams[target].Subteams {
+			if teams.Contains(subteam, target) {
+				return fail(fmt.Sprintf("Can't merge team '%s' into '%s' because '%s' would end up including itself through '%s'.", source, target, target, subteam))
+			}
+		}
+
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		memberCount = len(teams.Teams[target].Members)
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	s.emit(ctx, events...)
+
+	return Success(fmt.Sprintf("Team '%s' has been merged into '%s', which now has %d member(s).", source, target, memberCount))
+}
@@ -0,0 +1,238 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"slack-connect-manager/internal/store"
+)
+
+// Slack clients often turn straight quotes into curly ones, so accept both
+var closingQuote = map[rune]rune{
+	'"':      '"',
+	'\'':     '\'',
+	'\u201c': '\u201d',
+	'\u2018': '\u2019',
+}
+
+// Slack escapes these in the text of a command
+var unescapeSlack = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// Split the text of a command into words. Words can be quoted with single
+// or double quotes to include spaces, e.g. `create-team "Platform Team"`.
+// A quote only opens at the start of a word, so `O'Reilly` is one word.
+func splitArgs(text string) ([]string, error) {
+	text = unescapeSlack.Replace(text)
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for _, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case closingQuote[r] != 0 && !inWord:
+			quote = closingQuote[r]
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\u00a0':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fail(fmt.Sprintf("Missing closing quote (%c) in your command.", quote))
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// Flag is an option a command accepts, written as --name value or --name=value
+type Flag struct {
+	Name  string
+	Usage string
+	// Bool flags take no value, e.g. --invite
+	Bool bool
+}
+
+// Separate a command's flags from its positional arguments. Everything
+// after a bare "--" is positional.
+func parseFlags(cmd Command, args []string) (positional []string, flags map[string]string, err error) {
+	flags = make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg[2:], "=")
+		flag, ok := cmd.flag(name)
+		if !ok {
+			return nil, nil, fail(fmt.Sprintf("Unknown option --%s for %s. Run /connect help %s for usage.", name, cmd.Name, cmd.Name))
+		}
+
+		switch {
+		case flag.Bool && hasValue:
+			return nil, nil, fail(fmt.Sprintf("Option --%s doesn't take a value.", name))
+		case flag.Bool:
+			value = "true"
+		case !hasValue:
+			if i+1 >= len(args) {
+				return nil, nil, fail(fmt.Sprintf("Option --%s needs a value.", name))
+			}
+			i++
+			value = args[i]
+		}
+		flags[name] = value
+	}
+	return positional, flags, nil
+}
+
+// Look up one of the command's flags by name
+func (c Command) flag(name string) (Flag, bool) {
+	for _, f := range c.Flags {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Flag{}, false
+}
+
+// ParseChannelRef parses a channel reference the way Slack escapes them in
+// slash commands, e.g. <#C123|general> or <#C123>. The name may be empty.
+func ParseChannelRef(arg string) (id, name string, ok bool) {
+	if !strings.HasPrefix(arg, "<#") || !strings.HasSuffix(arg, ">") {
+		return "", "", false
+	}
+	id, name, _ = strings.Cut(arg[2:len(arg)-1], "|")
+	if id == "" {
+		return "", "", false
+	}
+	return id, name, true
+}
+
+// Quote an argument if it needs it, so commands we suggest can be pasted back
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'") {
+		return arg
+	}
+	if strings.Contains(arg, `"`) {
+		return "'" + arg + "'"
+	}
+	return `"` + arg + `"`
+}
+
+// Suggest the registered command closest to a mistyped one, or "" if
+// nothing is close enough
+func (r *Router) suggest(action string) string {
+	best, bestDistance := "", 0
+	candidates := append([]string{"help"}, r.names...)
+	for _, name := range candidates {
+		d := editDistance(action, name)
+		// Allow roughly one mistake per three letters, and at most two
+		limit := len(name) / 3
+		if limit > 2 {
+			limit = 2
+		}
+		if d > limit && !strings.HasPrefix(name, action) {
+			continue
+		}
+		if best == "" || d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// The number of single letter edits between two strings. Swapping two
+// neighbouring letters counts as one edit, since that's a common typo.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+// Find a tracked channel from a command argument, which can be a channel
+// reference, a channel ID, a name or a #name. Returns the channel's ID and
+// name, or "" and the name that was asked for if it isn't tracked. A name
+// shared by several tracked channels is an error listing them, since
+// guessing would act on the wrong one.
+func resolveChannel(channels store.Channels, arg string) (id, name string, err error) {
+	if refID, refName, ok := ParseChannelRef(arg); ok {
+		if channel, tracked := channels[refID]; tracked {
+			return refID, channel.Name, nil
+		}
+		if refName != "" {
+			return "", refName, nil
+		}
+		return "", refID, nil
+	}
+
+	if channel, tracked := channels[arg]; tracked {
+		return arg, channel.Name, nil
+	}
+
+	name = strings.TrimPrefix(arg, "#")
+	ids := channels.FindIDs(name)
+	switch len(ids) {
+	case 0:
+		return "", name, nil
+	case 1:
+		return ids[0], channels[ids[0]].Name, nil
+	}
+
+	candidates := make([]string, len(ids))
+	for i, id := range ids {
+		candidates[i] = fmt.Sprintf("<#%s|%s> (%s)", id, channels[id].Name, id)
+	}
+	return "", name, fail(fmt.Sprintf("%d tracked channels are called #%s: %s. Please use the channel's ID or mention it instead.",
+		len(ids), name, strings.Join(candidates, ", ")))
+}
+
+// Get a user ID from a command argument, which can be a plain ID or a user
+// mention the way Slack escapes them, e.g. <@U123|alice>
+func parseUserArg(arg string) string {
+	if strings.HasPrefix(arg, "<@") && strings.HasSuffix(arg, ">") {
+		id, _, _ := strings.Cut(arg[2:len(arg)-1], "|")
+		return id
+	}
+	return arg
+}
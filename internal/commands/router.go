@@ -0,0 +1,306 @@
+// Package commands implements the /connect commands. Commands return a
+// Response instead of writing HTTP, so the same commands can be served over
+// HTTP, a CLI or straight from tests.
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"slack-connect-manager/internal/metrics"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/syncer"
+	"slack-connect-manager/internal/webhooks"
+)
+
+// Request is a parsed /connect command
+type Request struct {
+	// The words after the action, e.g. ["acme", "U123"] for "add acme U123"
+	Args []string
+	// The --flags that were given, by name. Bool flags are set to "true".
+	Flags map[string]string
+	// Who ran the command and where
+	UserID      string
+	TeamID      string
+	ChannelID   string
+	ChannelName string
+	// Sends a response after the command has returned, e.g. to the slash
+	// command's response_url. Slow commands run in the background when it's
+	// set. Nil when the caller waits for the result, like the command line.
+	Respond func(ctx context.Context, resp Response)
+}
+
+// Flag returns the value of a --flag, or "" if it wasn't given
+func (r Request) Flag(name string) string {
+	return r.Flags[name]
+}
+
+// Bool reports whether a bool --flag was given
+func (r Request) Bool(name string) bool {
+	return r.Flags[name] == "true"
+}
+
+// Response is what a command sends back to the user
+type Response struct {
+	Text string
+	// Set when the command failed
+	Error bool
+}
+
+// Success builds a successful response
+func Success(text string) Response {
+	return Response{Text: text}
+}
+
+// Failure builds an error response
+func Failure(text string) Response {
+	return Response{Text: text, Error: true}
+}
+
+// errResponse lets a failure response escape from inside Store.Update
+type errResponse struct {
+	Response
+}
+
+func (e errResponse) Error() string {
+	return e.Text
+}
+
+// Run fn inside Store.Update. If it fails, ok is false and resp is the failure to send back.
+func (s *Service) update(fn func() error) (resp Response, ok bool) {
+	err := s.Store.Update(fn)
+	if err != nil {
+		return responseFor(err), false
+	}
+	return Response{}, true
+}
+
+// Turn an error into a failure response, keeping the text of an errResponse
+func responseFor(err error) Response {
+	var resp errResponse
+	if errors.As(err, &resp) {
+		return resp.Response
+	}
+	return Failure(err.Error())
+}
+
+// Fail with a response from inside Store.Update
+func fail(text string) error {
+	return errResponse{Failure(text)}
+}
+
+// Command is a single /connect action
+type Command struct {
+	// The action, e.g. "create-team"
+	Name string
+	// One line per form of the command, without the "/connect" prefix
+	Usage []string
+	// A one line description for /connect help <command>
+	Summary string
+	// Options the command accepts
+	Flags []Flag
+	// Example invocations, without the "/connect" prefix
+	Examples []string
+	// Reports whether a run makes a Slack call per person or channel, so it
+	// could take longer than the 3 seconds Slack waits for a response. Nil
+	// means never.
+	Slow func(req Request) bool
+	Run  func(ctx context.Context, req Request) Response
+}
+
+// Always is a Command.Slow for commands that are slow however they're run
+func Always(Request) bool {
+	return true
+}
+
+// How long a slow command can run in the background before it's given up on
+const slowCommandTimeout = 10 * time.Minute
+
+// Syncer refreshes the stored members of a tracked channel and finds
+// the shared channels to track
+type Syncer interface {
+	SyncInBackground(ctx context.Context, channelID string)
+	Discover(ctx context.Context) (syncer.Discovery, error)
+}
+
+// Service holds what the commands need to do their work
+type Service struct {
+	Store *store.Store
+	Slack slackapi.Client
+	Sync  Syncer
+	// Told about every change. May be nil.
+	Webhooks *webhooks.Dispatcher
+}
+
+// Router looks up commands by action
+type Router struct {
+	commands map[string]Command
+	// Registration order, used for the help text
+	names []string
+	// Slow commands running in the background
+	wg sync.WaitGroup
+}
+
+// NewRouter creates a router with all the /connect commands registered
+func NewRouter(svc *Service) *Router {
+	r := &Router{commands: make(map[string]Command)}
+	svc.registerTeamCommands(r)
+	svc.registerSubteamCommands(r)
+	svc.registerTeamInfoCommands(r)
+	svc.registerMergeCommands(r)
+	svc.registerTransferCommands(r)
+	svc.registerChannelCommands(r)
+	svc.registerDiffCommands(r)
+	svc.registerHistoryCommands(r)
+	svc.registerActivityCommands(r)
+	svc.registerDigestCommands(r)
+	svc.registerWebhookCommands(r)
+	return r
+}
+
+// Register adds a command to the router
+func (r *Router) Register(cmd Command) {
+	if _, exists := r.commands[cmd.Name]; exists {
+		panic(fmt.Sprintf("command %q registered twice", cmd.Name))
+	}
+	r.commands[cmd.Name] = cmd
+	r.names = append(r.names, cmd.Name)
+}
+
+// Has reports whether an action is a registered command
+func (r *Router) Has(action string) bool {
+	_, ok := r.commands[action]
+	return ok
+}
+
+// Dispatch runs the command for the text typed after /connect
+func (r *Router) Dispatch(ctx context.Context, text string, req Request) Response {
+	args, err := splitArgs(text)
+	if err != nil {
+		metrics.CommandsTotal.Inc("invalid")
+		return responseFor(err)
+	}
+	return r.Run(ctx, args, req)
+}
+
+// Run runs a command that has already been split into words, e.g. from a
+// command line
+func (r *Router) Run(ctx context.Context, args []string, req Request) Response {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		metrics.CommandsTotal.Inc("help")
+		if len(args) > 1 {
+			return r.CommandHelp(args[1])
+		}
+		return r.Help()
+	}
+
+	action := args[0]
+	slog.DebugContext(ctx, "Processing action", "action", action)
+
+	cmd, ok := r.commands[action]
+	if !ok {
+		// Typos all count as "unknown" so they don't each create a new time series
+		metrics.CommandsTotal.Inc("unknown")
+		slog.InfoContext(ctx, "Invalid action received", "action", action)
+		return r.unknownCommand(action)
+	}
+	metrics.CommandsTotal.Inc(action)
+
+	for _, arg := range args[1:] {
+		if arg == "--help" || arg == "-h" {
+			return r.CommandHelp(action)
+		}
+	}
+
+	var err error
+	req.Args, req.Flags, err = parseFlags(cmd, args[1:])
+	if err != nil {
+		return responseFor(err)
+	}
+	if cmd.Slow != nil && cmd.Slow(req) && req.Respond != nil {
+		r.runInBackground(ctx, cmd, req)
+		return Success("Working on it, the result will be posted here when it's done.")
+	}
+	return cmd.Run(ctx, req)
+}
+
+// Run a slow command after the request that started it has been answered,
+// and send its response with req.Respond
+func (r *Router) runInBackground(ctx context.Context, cmd Command, req Request) {
+	// Keeps the request ID for the logs, without being cancelled when the request ends
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), slowCommandTimeout)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		slog.DebugContext(ctx, "Running command in the background", "action", cmd.Name)
+		req.Respond(ctx, cmd.Run(ctx, req))
+	}()
+}
+
+// Wait blocks until the slow commands running in the background have finished
+func (r *Router) Wait() {
+	r.wg.Wait()
+}
+
+// Tell the user an action doesn't exist, suggesting the closest one
+func (r *Router) unknownCommand(action string) Response {
+	if suggestion := r.suggest(action); suggestion != "" {
+		return Failure(fmt.Sprintf("Unknown command '%s'. Did you mean '%s'? Run /connect help %s for usage.", action, suggestion, suggestion))
+	}
+	help := r.Help()
+	return Failure(fmt.Sprintf("Unknown command '%s'.\n%s", action, help.Text))
+}
+
+// Help lists the usage of every registered command
+func (r *Router) Help() Response {
+	lines := []string{"Available commands:"}
+	for _, name := range r.names {
+		for _, usage := range r.commands[name].Usage {
+			lines = append(lines, "- /connect "+usage)
+		}
+	}
+	lines = append(lines, "- /connect help or /connect -h (shows this help message)")
+	lines = append(lines, "- /connect help <command> (shows the options and examples for a command)")
+	return Success(strings.Join(lines, "\n"))
+}
+
+// CommandHelp shows the usage, options and examples of a single command
+func (r *Router) CommandHelp(action string) Response {
+	cmd, ok := r.commands[action]
+	if !ok {
+		return r.unknownCommand(action)
+	}
+
+	var lines []string
+	if cmd.Summary != "" {
+		lines = append(lines, cmd.Summary)
+	}
+	lines = append(lines, "Usage:")
+	for _, usage := range cmd.Usage {
+		lines = append(lines, "  /connect "+usage)
+	}
+	if len(cmd.Flags) > 0 {
+		lines = append(lines, "Options:")
+		for _, flag := range cmd.Flags {
+			name := "--" + flag.Name
+			if !flag.Bool {
+				name += " <value>"
+			}
+			lines = append(lines, fmt.Sprintf("  %s: %s", name, flag.Usage))
+		}
+	}
+	if len(cmd.Examples) > 0 {
+		lines = append(lines, "Examples:")
+		for _, example := range cmd.Examples {
+			lines = append(lines, "  /connect "+example)
+		}
+	}
+	return Success(strings.Join(lines, "\n"))
+}
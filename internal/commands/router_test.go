@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDispatch(t *testing.T) {
+	r := &Router{commands: make(map[string]Command)}
+	var got Request
+	r.Register(Command{Name: "echo", Usage: []string{"echo <words>"}, Run: func(ctx context.Context, req Request) Response {
+		got = req
+		return Success(strings.Join(req.Args, " "))
+	}})
+
+	resp := r.Dispatch(context.Background(), "  echo a   b ", Request{UserID: "U1", ChannelID: "C1"})
+	if resp.Error || resp.Text != "a b" {
+		t.Errorf("response = %+v, want success with %q", resp, "a b")
+	}
+	if got.UserID != "U1" || got.ChannelID != "C1" {
+		t.Errorf("request = %+v, want the caller's user and channel", got)
+	}
+
+	for _, text := range []string{"", "help", "-h", "nope"} {
+		resp := r.Dispatch(context.Background(), text, Request{})
+		if !strings.Contains(resp.Text, "- /connect echo <words>") {
+			t.Errorf("Dispatch(%q) = %q, want the help text", text, resp.Text)
+		}
+	}
+}
+
+func TestSlowCommands(t *testing.T) {
+	r := &Router{commands: make(map[string]Command)}
+	r.Register(Command{Name: "slow", Usage: []string{"slow"}, Slow: Always, Run: func(ctx context.Context, req Request) Response {
+		return Success("done")
+	}})
+
+	// Without a way to respond later, the caller waits for the result
+	if resp := r.Dispatch(context.Background(), "slow", Request{}); resp.Text != "done" {
+		t.Errorf("response = %+v, want the result", resp)
+	}
+
+	var later []Response
+	resp := r.Dispatch(context.Background(), "slow", Request{Respond: func(ctx context.Context, resp Response) {
+		later = append(later, resp)
+	}})
+	r.Wait()
+	if !strings.HasPrefix(resp.Text, "Working on it") {
+		t.Errorf("response = %+v, want an acknowledgement", resp)
+	}
+	if len(later) != 1 || later[0].Text != "done" {
+		t.Errorf("responded later with %+v, want the result", later)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    []string
+		wantErr bool
+	}{
+		{text: "add acme U1", want: []string{"add", "acme", "U1"}},
+		{text: `create-team "Platform Team"`, want: []string{"create-team", "Platform Team"}},
+		{text: `create-team "Bob's team"`, want: []string{"create-team", "Bob's team"}},
+		{text: `create-team 'Platform Team'`, want: []string{"create-team", "Platform Team"}},
+		{text: "add-alias acme O'Reilly", want: []string{"add-alias", "acme", "O'Reilly"}},
+		{text: `set acme description say "hi"`, want: []string{"set", "acme", "description", "say", "hi"}},
+		{text: `set acme description R&amp;D &lt;core&gt;`, want: []string{"set", "acme", "description", "R&D", "<core>"}},
+		{text: `create-team "R&amp;D"`, want: []string{"create-team", "R&D"}},
+		{text: "create-team “Platform Team”", want: []string{"create-team", "Platform Team"}},
+		{text: `ping acme proj-x --message ""`, want: []string{"ping", "acme", "proj-x", "--message", ""}},
+		{text: "ping <#C1|proj-x>", want: []string{"ping", "<#C1|proj-x>"}},
+		{text: `create-team "Platform`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := splitArgs(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitArgs(%q) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	cmd := Command{Name: "diff", Flags: []Flag{
+		{Name: "invite", Bool: true},
+		{Name: "message"},
+	}}
+
+	args, flags, err := parseFlags(cmd, []string{"acme", "--invite", "--message", "hi there", "proj-x", "--", "--not-a-flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, "|") != "acme|proj-x|--not-a-flag" {
+		t.Errorf("args = %q", args)
+	}
+	if flags["invite"] != "true" || flags["message"] != "hi there" {
+		t.Errorf("flags = %v", flags)
+	}
+
+	_, flags, err = parseFlags(cmd, []string{"--message=hi"})
+	if err != nil || flags["message"] != "hi" {
+		t.Errorf("--message=hi gave %v, %v", flags, err)
+	}
+
+	for _, args := range [][]string{{"--nope"}, {"--message"}, {"--invite=yes"}} {
+		if _, _, err := parseFlags(cmd, args); err == nil {
+			t.Errorf("parseFlags(%q) succeeded, want an error", args)
+		}
+	}
+}
+
+func TestParseChannelRef(t *testing.T) {
+	tests := []struct {
+		arg      string
+		id, name string
+		ok       bool
+	}{
+		{arg: "<#C123|general>", id: "C123", name: "general", ok: true},
+		{arg: "<#C123>", id: "C123", ok: true},
+		{arg: "<#|general>"},
+		{arg: "#general"},
+		{arg: "general"},
+	}
+
+	for _, tt := range tests {
+		id, name, ok := ParseChannelRef(tt.arg)
+		if id != tt.id || name != tt.name || ok != tt.ok {
+			t.Errorf("ParseChannelRef(%q) = %q, %q, %v, want %q, %q, %v", tt.arg, id, name, ok, tt.id, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	r := &Router{commands: make(map[string]Command)}
+	for _, name := range []string{"create-team", "remove-team", "add", "add-channel", "reconcile"} {
+		r.Register(Command{Name: name})
+	}
+
+	tests := map[string]string{
+		"create-tema": "create-team",
+		"remvoe-team": "remove-team",
+		"ad":          "add",
+		"reconcil":    "reconcile",
+		"hlep":        "help",
+		"frobnicate":  "",
+	}
+	for action, want := range tests {
+		if got := r.suggest(action); got != want {
+			t.Errorf("suggest(%q) = %q, want %q", action, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"slack-connect-manager/internal/store"
+)
+
+func (s *Service) registerSubteamCommands(r *Router) {
+	r.Register(Command{
+		Name:     "add-subteam",
+		Usage:    []string{"add-subteam <team> <subteam>"},
+		Summary:  "Include another team in a team. Its members are pinged, invited and listed along with the team's own.",
+		Examples: []string{"add-subteam acme acme-eng"},
+		Run:      s.addSubteam,
+	})
+	r.Register(Command{
+		Name:     "remove-subteam",
+		Usage:    []string{"remove-subteam <team> <subteam>"},
+		Summary:  "Stop including a team in another team.",
+		Examples: []string{"remove-subteam acme acme-eng"},
+		Run:      s.removeSubteam,
+	})
+}
+
+// Include a team in another team
+func (s *Service) addSubteam(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide a team name and the name of the team to include in it.")
+	}
+
+	team, subteam := req.Args[0], req.Args[1]
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		team, err = findTeam(teams, team)
+		if err != nil {
+			return err
+		}
+		subteam, err = findTeam(teams, subteam)
+		if err != nil {
+			return err
+		}
+
+		for _, existing := range teams.Teams[team].Subteams {
+			if existing == subteam {
+				return fail(fmt.Sprintf("Team '%s' is already part of team '%s'.", subteam, team))
+			}
+		}
+
+		// Including a team that already includes this one would make a loop
+		if teams.Contains(subteam, team) {
+			return fail(fmt.Sprintf("Can't add team '%s' to team '%s' because '%s' already includes '%s'.", subteam, team, subteam, team))
+		}
+
+		updatedTeam := teams.Teams[team]
+		updatedTeam.Subteams = append(updatedTeam.Subteams, subteam)
+		teams.Teams[team] = updatedTeam
+
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	return Success(fmt.Sprintf("Team '%s' is now part of team '%s'.", subteam, team))
+}
+
+// Stop including a team in another team
+func (s *Service) removeSubteam(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide a team name and the name of the team to remove from it.")
+	}
+
+	team, subteam := req.Args[0], req.Args[1]
+	var affected []string
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		team, err = findTeam(teams, team)
+		if err != nil {
+			return err
+		}
+
+		if name, ok := teams.Resolve(subteam); ok {
+			subteam = name
+		}
+		// Only the team and the teams above it can lose members, and only
+		// the ones that don't also get them some other way
+		candidates := append([]string{team}, teams.Parents(team)...)
+		before := make(map[string][]store.Member, len(candidates))
+		for _, name := range candidates {
+			before[name] = teams.Members(name)
+		}
+
+		if !teams.RemoveSubteam(team, subteam) {
+			return fail(fmt.Sprintf("Team '%s' is not part of team '%s'.", subteam, team))
+		}
+
+		// Removing a subteam never adds members, so a change in the count
+		// means someone was lost
+		for _, name := range candidates {
+			if len(teams.Members(name)) != len(before[name]) {
+				affected = append(affected, name)
+			}
+		}
+
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	if len(affected) == 0 {
+		return Success(fmt.Sprintf("Team '%s' is no longer part of team '%s'. No team lost any members.", subteam, team))
+	}
+	return Success(fmt.Sprintf("Team '%s' is no longer part of team '%s'. Affected teams: %s", subteam, team, strings.Join(affected, ", ")))
+}
@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"slack-connect-manager/internal/store"
+)
+
+// The team fields /connect set can change
+var teamFields = []string{"description", "owners", "aliases", "default-channel", "tag"}
+
+func (s *Service) registerTeamInfoCommands(r *Router) {
+	r.Register(Command{
+		Name:     "team-info",
+		Usage:    []string{"team-info <team>"},
+		Summary:  "Show a team's description, owners, aliases, default channel, tags, subteams and members.",
+		Examples: []string{"team-info acme"},
+		Run:      s.teamInfo,
+	})
+	r.Register(Command{
+		Name: "set",
+		Usage: []string{
+			"set <team> description <text>",
+			"set <team> owners <user>...",
+			"set <team> aliases <alias>...",
+			"set <team> default-channel <channel>",
+			"set <team> tag <key> [value]",
+		},
+		Summary: "Change a team's details. Leave out the value to clear a field, or a tag.",
+		Examples: []string{
+			`set acme description "Acme Corp partner engineers"`,
+			"set acme owners @alice @bob",
+			"set acme aliases ac acme-corp",
+			"set acme default-channel #proj-x",
+			"set acme tag partner acme-corp",
+		},
+		Run: s.set,
+	})
+}
+
+// Show everything we know about a team
+func (s *Service) teamInfo(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a team name.")
+	}
+
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	name, err := findTeam(teams, req.Args[0])
+	if err != nil {
+		return responseFor(err)
+	}
+
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		return Failure("Error reading channels.")
+	}
+
+	team := teams.Teams[name]
+	lines := []string{fmt.Sprintf("Team '%s'", name)}
+	if team.Description != "" {
+		lines = append(lines, "Description: "+team.Description)
+	}
+	if len(team.Aliases) > 0 {
+		lines = append(lines, "Aliases: "+strings.Join(team.Aliases, ", "))
+	}
+	if len(team.Owners) > 0 {
+		lines = append(lines, "Owners: "+mentionAll(team.Owners))
+	}
+	if team.DefaultChannel != "" {
+		channelName := team.DefaultChannel
+		if channel, tracked := channels[team.DefaultChannel]; tracked {
+			channelName = channel.Name
+		}
+		lines = append(lines, "Default channel: #"+channelName)
+	}
+	if len(team.Tags) > 0 {
+		lines = append(lines, "Tags: "+formatTags(team.Tags))
+	}
+	if len(team.Subteams) > 0 {
+		lines = append(lines, "Subteams: "+strings.Join(team.Subteams, ", "))
+	}
+	if parents := teams.Parents(name); len(parents) > 0 {
+		lines = append(lines, "Part of: "+strings.Join(parents, ", "))
+	}
+
+	members := fmt.Sprintf("Members: %d", len(team.Members))
+	if len(team.Subteams) > 0 {
+		members += fmt.Sprintf(" (%d including subteams)", len(teams.Members(name)))
+	}
+	lines = append(lines, members)
+
+	switch {
+	case team.CreatedBy != "" && !team.CreatedAt.IsZero():
+		lines = append(lines, fmt.Sprintf("Created by <@%s> on %s", team.CreatedBy, team.CreatedAt.Format("2006-01-02")))
+	case !team.CreatedAt.IsZero():
+		lines = append(lines, "Created on "+team.CreatedAt.Format("2006-01-02"))
+	}
+
+	return Success(strings.Join(lines, "\n"))
+}
+
+// Change one of a team's details
+func (s *Service) set(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure(fmt.Sprintf("Please provide a team name and a field to set: %s.", strings.Join(teamFields, ", ")))
+	}
+
+	team, field, values := req.Args[0], req.Args[1], req.Args[2:]
+	var message string
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		team, err = findTeam(teams, team)
+		if err != nil {
+			return err
+		}
+
+		updatedTeam := teams.Teams[team]
+		switch field {
+		case "description":
+			updatedTeam.Description = strings.Join(values, " ")
+			message = fmt.Sprintf("Description of team '%s' has been updated.", team)
+
+		case "owners":
+			updatedTeam.Owners = nil
+			for _, value := range values {
+				updatedTeam.Owners = append(updatedTeam.Owners, parseUserArg(value))
+			}
+			message = fmt.Sprintf("Owners of team '%s' have been updated.", team)
+
+		case "aliases":
+			for _, alias := range values {
+				if err := checkAlias(teams, team, alias); err != nil {
+					return err
+				}
+			}
+			updatedTeam.Aliases = values
+			message = fmt.Sprintf("Aliases of team '%s' have been updated.", team)
+
+		case "default-channel":
+			if len(values) == 0 {
+				updatedTeam.DefaultChannel = ""
+				message = fmt.Sprintf("Default channel of team '%s' has been cleared.", team)
+				break
+			}
+
+			channels, err := s.Store.ReadChannels()
+			if err != nil {
+				return fail("Error reading channels.")
+			}
+			channelID, channelName, err := resolveChannel(channels, values[0])
+			if err != nil {
+				return err
+			}
+			if channelID == "" {
+				return fail(fmt.Sprintf("Channel #%s is not being tracked.", channelName))
+			}
+			updatedTeam.DefaultChannel = channelID
+			message = fmt.Sprintf("Default channel of team '%s' is now #%s.", team, channelName)
+
+		case "tag":
+			if len(values) == 0 {
+				return fail("Please provide a tag name, and a value to set it to.")
+			}
+			key := values[0]
+			if len(values) == 1 {
+				delete(updatedTeam.Tags, key)
+				message = fmt.Sprintf("Tag '%s' has been removed from team '%s'.", key, team)
+				break
+			}
+			if updatedTeam.Tags == nil {
+				updatedTeam.Tags = make(map[string]string)
+			}
+			updatedTeam.Tags[key] = strings.Join(values[1:], " ")
+			message = fmt.Sprintf("Tag '%s' of team '%s' has been set.", key, team)
+
+		default:
+			return fail(fmt.Sprintf("Unknown field '%s'. You can set: %s.", field, strings.Join(teamFields, ", ")))
+		}
+
+		teams.Teams[team] = updatedTeam
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	return Success(message)
+}
+
+// Check that an alias can be given to a team. It must not be the name or
+// alias of any other team.
+func checkAlias(teams store.Teams, team, alias string) error {
+	if alias == "" || alias == team {
+		return fail(fmt.Sprintf("'%s' can't be used as an alias of team '%s'.", alias, team))
+	}
+	if owner, taken := teams.Resolve(alias); taken && owner != team {
+		if owner == alias {
+			return fail(fmt.Sprintf("'%s' is already the name of a team.", alias))
+		}
+		return fail(fmt.Sprintf("'%s' is already an alias of team '%s'.", alias, owner))
+	}
+	return nil
+}
+
+// Format user IDs as Slack mentions
+func mentionAll(userIDs []string) string {
+	mentions := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		mentions[i] = fmt.Sprintf("<@%s>", id)
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// Format tags as key=value pairs, sorted by key
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + tags[key]
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,511 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+func (s *Service) registerTeamCommands(r *Router) {
+	r.Register(Command{
+		Name:     "create-team",
+		Usage:    []string{"create-team <team>"},
+		Summary:  "Create a new team. Quote the name if it has spaces.",
+		Examples: []string{"create-team platform", `create-team "Platform Team"`},
+		Run:      s.createTeam,
+	})
+	r.Register(Command{
+		Name:     "remove-team",
+		Usage:    []string{"remove-team <team>"},
+		Summary:  "Remove a team and all its members. Teams that included it lose its members.",
+		Examples: []string{"remove-team platform"},
+		Run:      s.removeTeam,
+	})
+	r.Register(Command{
+		Name:     "add",
+		Usage:    []string{"add <team> <member_id>"},
+		Summary:  "Add a Slack user to a team.",
+		Examples: []string{"add platform U0123ABCD"},
+		Run:      s.add,
+	})
+	r.Register(Command{
+		Name:     "remove",
+		Usage:    []string{"remove <team> <member_id>"},
+		Summary:  "Remove a Slack user from a team.",
+		Examples: []string{"remove platform U0123ABCD"},
+		Run:      s.remove,
+	})
+	r.Register(Command{
+		Name:  "print",
+		Usage: []string{"print teams", "print channels [--with-counts]", "print members <team>", "print channel-members <channel> [--team <team>]"},
+		Summary: "List the teams, the tracked channels, the members of a team, including its subteams, or the members of a tracked channel " +
+			"as of the last sync.",
+		Flags: []Flag{
+			{Name: "with-counts", Usage: "Show how many members each channel has", Bool: true},
+			{Name: "team", Usage: "Only list the channel members in this team"},
+		},
+		Examples: []string{"print teams", "print members platform", "print channels --with-counts", "print channel-members #proj-x --team platform"},
+		Run:      s.print,
+	})
+	r.Register(Command{
+		Name:     "invite",
+		Usage:    []string{"invite <team>"},
+		Summary:  "List the member IDs of a team, ready to paste into an invite.",
+		Examples: []string{"invite platform"},
+		Run:      s.invite,
+	})
+}
+
+// Create a new team
+func (s *Service) createTeam(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a team name to create.")
+	}
+
+	team := req.Args[0]
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		if _, exists := teams.Teams[team]; exists {
+			return fail(fmt.Sprintf("Team '%s' already exists.", team))
+		}
+		if owner, taken := teams.Resolve(team); taken {
+			return fail(fmt.Sprintf("'%s' is already an alias of team '%s'.", team, owner))
+		}
+
+		teams.Teams[team] = store.Team{
+			Members:   []store.Member{},
+			CreatedBy: req.UserID,
+			CreatedAt: time.Now(),
+		}
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	event := newEvent(webhooks.TeamCreated, req)
+	event.Team = team
+	s.emit(ctx, event)
+
+	return Success(fmt.Sprintf("Team '%s' has been created.", team))
+}
+
+// Remove a team
+func (s *Service) removeTeam(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a team name to remove.")
+	}
+
+	team := req.Args[0]
+	var parents []string
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		team, err = findTeam(teams, team)
+		if err != nil {
+			return err
+		}
+
+		// Work out who loses members before the team is unlinked from them
+		parents = teams.Parents(team)
+		for name := range teams.Teams {
+			teams.RemoveSubteam(name, team)
+		}
+
+		delete(teams.Teams, team)
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	event := newEvent(webhooks.TeamRemoved, req)
+	event.Team = team
+	s.emit(ctx, event)
+
+	if len(parents) > 0 {
+		return Success(fmt.Sprintf("Team '%s' has been removed. Affected parent teams: %s", team, strings.Join(parents, ", ")))
+	}
+	return Success(fmt.Sprintf("Team '%s' has been removed.", team))
+}
+
+// Find a team by its name or one of its aliases
+func findTeam(teams store.Teams, nameOrAlias string) (string, error) {
+	if name, ok := teams.Resolve(nameOrAlias); ok {
+		return name, nil
+	}
+	return "", fail(fmt.Sprintf("Team '%s' does not exist.", nameOrAlias))
+}
+
+// Check that a member can be added to a team
+func checkCanAdd(teams store.Teams, team, memberID string) error {
+	if _, exists := teams.Teams[team]; !exists {
+		return fail(fmt.Sprintf("Team '%s' does not exist.", team))
+	}
+
+	for _, member := range teams.Teams[team].Members {
+		if member.MemberID == memberID {
+			return fail(fmt.Sprintf("User %s is already in team '%s'.", memberID, team))
+		}
+	}
+	return nil
+}
+
+// Add a member to a team
+func (s *Service) add(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide a team name and a member ID to add.")
+	}
+
+	team, memberID := req.Args[0], req.Args[1]
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	team, err = findTeam(teams, team)
+	if err != nil {
+		return responseFor(err)
+	}
+	if err := checkCanAdd(teams, team, memberID); err != nil {
+		return responseFor(err)
+	}
+
+	// Get info about the user from Slack
+	userInfo, err := s.Slack.GetUserInfoContext(ctx, memberID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting user info", "user_id", memberID, "error", err)
+		return Failure(fmt.Sprintf("Error getting user info: %v", err))
+	}
+
+	displayName := slackapi.DisplayName(userInfo)
+	slog.InfoContext(ctx, "Adding user to team", "user_id", memberID, "display_name", displayName, "team", team)
+
+	resp, ok := s.update(func() error {
+		// Read again, the team may have changed while we were asking Slack
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+		if err := checkCanAdd(teams, team, memberID); err != nil {
+			return err
+		}
+
+		users, err := s.Store.ReadUsers()
+		if err != nil {
+			return fail("Error reading users.")
+		}
+		// Keep the channels we've already seen them in, so the sync doesn't
+		// report them as joining every one of them again
+		user, known := users[memberID]
+		if !known {
+			user = store.User{MemberID: memberID}
+		}
+		if user.Channels == nil {
+			user.Channels = make(map[string]string)
+		}
+		user.Name = displayName
+		user.UpdatedAt = time.Now()
+		users[memberID] = user
+
+		newMember := store.Member{
+			MemberID: memberID,
+			Name:     displayName,
+			Channels: make(map[string]string),
+		}
+		for channelID, id := range user.Channels {
+			newMember.Channels[channelID] = id
+		}
+		updatedTeam := teams.Teams[team]
+		updatedTeam.Members = append(updatedTeam.Members, newMember)
+		teams.Teams[team] = updatedTeam
+
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		if err := s.Store.WriteUsers(users); err != nil {
+			slog.ErrorContext(ctx, "Error writing users", "error", err)
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	event := newEvent(webhooks.MemberAdded, req)
+	event.Team = team
+	event.Member = &webhooks.Member{ID: memberID, Name: displayName}
+	s.emit(ctx, event)
+
+	return Success(fmt.Sprintf("Added user %s (%s) to team '%s'.", displayName, memberID, team))
+}
+
+// Remove a member from a team
+func (s *Service) remove(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide a team name and a member ID to remove.")
+	}
+
+	team, memberID := req.Args[0], req.Args[1]
+	var removed store.Member
+	resp, ok := s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+
+		team, err = findTeam(teams, team)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		updatedTeam := teams.Teams[team]
+		for i, member := range updatedTeam.Members {
+			if member.MemberID == memberID {
+				removed = member
+				updatedTeam.Members = append(updatedTeam.Members[:i], updatedTeam.Members[i+1:]...)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fail(fmt.Sprintf("User %s is not in team '%s'.", memberID, team))
+		}
+
+		teams.Teams[team] = updatedTeam
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	event := newEvent(webhooks.MemberRemoved, req)
+	event.Team = team
+	event.Member = &webhooks.Member{ID: memberID, Name: removed.Name}
+	s.emit(ctx, event)
+
+	return Success(fmt.Sprintf("Removed user %s from team '%s'.", memberID, team))
+}
+
+// Print information about teams, channels, or members
+func (s *Service) print(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please specify what to print: teams, channels, members <team> or channel-members <channel>.")
+	}
+
+	option := req.Args[0]
+	if req.Flag("team") != "" && option != "channel-members" {
+		return Failure("--team only works with print channel-members.")
+	}
+	if req.Bool("with-counts") && option != "channels" {
+		return Failure("--with-counts only works with print channels.")
+	}
+	switch option {
+	case "teams":
+		return s.printTeams()
+	case "channels":
+		return s.printChannels(req.Bool("with-counts"))
+	case "members":
+		if len(req.Args) < 2 {
+			return Failure("Please provide a team name to print members.")
+		}
+		return s.printMembers(req.Args[1])
+	case "channel-members":
+		if len(req.Args) < 2 {
+			return Failure("Please provide a channel to print members.")
+		}
+		return s.printChannelMembers(req.Args[1], req.Flag("team"))
+	default:
+		return Failure("Invalid print option. Use 'teams', 'channels', 'members <team>' or 'channel-members <channel>'.")
+	}
+}
+
+// Print all teams
+func (s *Service) printTeams() Response {
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	teamNames := make([]string, 0, len(teams.Teams))
+	for team := range teams.Teams {
+		teamNames = append(teamNames, team)
+	}
+	sort.Strings(teamNames)
+
+	if len(teamNames) == 0 {
+		return Success("No teams found.")
+	}
+	return Success(fmt.Sprintf("Teams: %s", strings.Join(teamNames, ", ")))
+}
+
+// Print all channels, optionally with how many members the sync found in each
+func (s *Service) printChannels(withCounts bool) Response {
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		return Failure("Error reading channels.")
+	}
+
+	var counts map[string]int
+	if withCounts {
+		users, err := s.Store.ReadUsers()
+		if err != nil {
+			return Failure("Error reading users.")
+		}
+		counts = users.CountByChannel()
+	}
+
+	channelNames := make([]string, 0, len(channels))
+	for id, channel := range channels {
+		if withCounts {
+			channelNames = append(channelNames, fmt.Sprintf("%s (%d)", channel.Name, counts[id]))
+		} else {
+			channelNames = append(channelNames, channel.Name)
+		}
+	}
+	sort.Strings(channelNames)
+
+	if len(channelNames) == 0 {
+		return Success("No channels found.")
+	}
+	return Success(fmt.Sprintf("Channels: %s", strings.Join(channelNames, ", ")))
+}
+
+// Print all members of a specific team
+func (s *Service) printMembers(team string) Response {
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	team, err = findTeam(teams, team)
+	if err != nil {
+		return responseFor(err)
+	}
+
+	allMembers := teams.Members(team)
+	members := make([]string, len(allMembers))
+	for i, member := range allMembers {
+		if member.Name != "" {
+			members[i] = fmt.Sprintf("%s (%s)", member.Name, member.MemberID)
+		} else {
+			members[i] = member.MemberID
+		}
+	}
+
+	if len(members) == 0 {
+		return Success(fmt.Sprintf("No members found in team '%s'.", team))
+	}
+	if subteams := teams.Teams[team].Subteams; len(subteams) > 0 {
+		return Success(fmt.Sprintf("Members of team '%s' (including %s): %s", team, strings.Join(subteams, ", "), strings.Join(members, ", ")))
+	}
+	return Success(fmt.Sprintf("Members of team '%s': %s", team, strings.Join(members, ", ")))
+}
+
+// Print the members of a tracked channel as of the last sync, optionally
+// only the ones in a team
+func (s *Service) printChannelMembers(channelArg, team string) Response {
+	channels, err := s.Store.ReadChannels()
+	if err != nil {
+		return Failure("Error reading channels.")
+	}
+	channelID, channelName, err := resolveChannel(channels, channelArg)
+	if err != nil {
+		return responseFor(err)
+	}
+	if channelID == "" {
+		return Failure(fmt.Sprintf("Channel #%s is not being tracked.", channelName))
+	}
+
+	users, err := s.Store.ReadUsers()
+	if err != nil {
+		return Failure("Error reading users.")
+	}
+	inChannel := users.InChannel(channelID)
+
+	heading := fmt.Sprintf("Members of #%s", channelName)
+	if team != "" {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return Failure("Error reading teams.")
+		}
+		if team, err = findTeam(teams, team); err != nil {
+			return responseFor(err)
+		}
+		inTeam := make(map[string]bool)
+		for _, member := range teams.Members(team) {
+			inTeam[member.MemberID] = true
+		}
+		var filtered []store.User
+		for _, user := range inChannel {
+			if inTeam[user.MemberID] {
+				filtered = append(filtered, user)
+			}
+		}
+		inChannel = filtered
+		heading = fmt.Sprintf("Members of team '%s' in #%s", team, channelName)
+	}
+
+	if len(inChannel) == 0 {
+		if team != "" {
+			return Success(fmt.Sprintf("No members of team '%s' found in #%s.", team, channelName))
+		}
+		return Success(fmt.Sprintf("No members found in #%s. It may not have been synced yet.", channelName))
+	}
+	members := make([]string, len(inChannel))
+	for i, user := range inChannel {
+		members[i] = fmt.Sprintf("%s (%s)", user.Name, user.MemberID)
+	}
+	return Success(fmt.Sprintf("%s (%d): %s", heading, len(members), strings.Join(members, ", ")))
+}
+
+// Handle the invite command
+func (s *Service) invite(ctx context.Context, req Request) Response {
+	if len(req.Args) < 1 {
+		return Failure("Please provide a team name for invitation.")
+	}
+
+	team := req.Args[0]
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	team, err = findTeam(teams, team)
+	if err != nil {
+		return responseFor(err)
+	}
+
+	members := teams.Members(team)
+	memberIDs := make([]string, len(members))
+	for i, member := range members {
+		memberIDs[i] = member.MemberID
+	}
+
+	return Success(fmt.Sprintf("To invite team '%s', use these member IDs: %s", team, strings.Join(memberIDs, ", ")))
+}
@@ -0,0 +1,418 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+// Slack file IDs, e.g. F0123ABCD
+var fileIDPattern = regexp.MustCompile(`^F[A-Z0-9]+$`)
+
+// The errors users.lookupByEmail and users.info give for people who aren't in Slack
+var lookupNotFound = map[string]bool{"users_not_found": true, "user_not_found": true, "not_found": true}
+
+func (s *Service) registerTransferCommands(r *Router) {
+	r.Register(Command{
+		Name:    "export",
+		Usage:   []string{"export [team] [--format csv|json]"},
+		Summary: "Send yourself a file with the members of one team, or of all teams.",
+		Flags: []Flag{
+			{Name: "format", Usage: "csv (the default) or json"},
+		},
+		Examples: []string{"export", "export acme --format json"},
+		Slow:     Always,
+		Run:      s.export,
+	})
+	r.Register(Command{
+		Name:    "import",
+		Usage:   []string{"import <team> <file> [--apply]"},
+		Summary: "Make a team's members match a CSV file of emails or member IDs shared in Slack. Shows what would change unless --apply is given.",
+		Flags: []Flag{
+			{Name: "apply", Usage: "Add and remove the members instead of only showing what would change", Bool: true},
+		},
+		Examples: []string{
+			"import acme https://example.slack.com/files/U0123ABCD/F0123ABCD/roster.csv",
+			"import acme F0123ABCD --apply",
+		},
+		Slow: Always,
+		Run:  s.importTeam,
+	})
+}
+
+// Send the requester a file with the members of a team, or of all teams
+func (s *Service) export(ctx context.Context, req Request) Response {
+	format := req.Flag("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		return Failure(fmt.Sprintf("Unknown format '%s'. Use csv or json.", format))
+	}
+	if req.UserID == "" {
+		return Failure("Export sends you a direct message, so it has to be run from Slack.")
+	}
+
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+
+	filename := "teams"
+	if len(req.Args) > 0 {
+		team, err := findTeam(teams, req.Args[0])
+		if err != nil {
+			return responseFor(err)
+		}
+		teams = store.Teams{Teams: map[string]store.Team{team: teams.Teams[team]}}
+		filename = team
+	}
+	filename += "." + format
+
+	var content []byte
+	if format == "json" {
+		content, err = json.MarshalIndent(teams, "", "  ")
+	} else {
+		content, err = teamsCSV(teams)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding export", "format", format, "error", err)
+		return Failure("Error creating the export.")
+	}
+
+	// Files can only be shared to a channel, so open a DM with the requester
+	dm, _, _, err := s.Slack.OpenConversationContext(ctx, &slack.OpenConversationParameters{Users: []string{req.UserID}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error opening DM", "user_id", req.UserID, "error", err)
+		return Failure(fmt.Sprintf("Error sending the export: %v", err))
+	}
+
+	_, err = s.Slack.UploadFileV2Context(ctx, slack.UploadFileV2Parameters{
+		Filename: filename,
+		Title:    filename,
+		Content:  string(content),
+		FileSize: len(content),
+		Channel:  dm.ID,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error uploading export", "filename", filename, "error", err)
+		return Failure(fmt.Sprintf("Error sending the export: %v", err))
+	}
+
+	return Success(fmt.Sprintf("Sent you %s with %d team(s).", filename, len(teams.Teams)))
+}
+
+// Write one row per team member, sorted by team
+func teamsCSV(teams store.Teams) ([]byte, error) {
+	names := make([]string, 0, len(teams.Teams))
+	for name := range teams.Teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"team", "member_id", "name"})
+	for _, name := range names {
+		for _, member := range teams.Teams[name].Members {
+			w.Write([]string{name, member.MemberID, member.Name})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// The changes an import would make to a team
+type importPlan struct {
+	Add    []store.Member
+	Remove []store.Member
+	// Emails and IDs that didn't match anyone in Slack
+	NotFound []string
+	// How many people in the file were found in Slack
+	Found int
+}
+
+// Make a team's members match a CSV file shared in Slack
+func (s *Service) importTeam(ctx context.Context, req Request) Response {
+	if len(req.Args) < 2 {
+		return Failure("Please provide a team name and a link to a CSV file shared in Slack.")
+	}
+
+	team, fileArg := req.Args[0], req.Args[1]
+	teams, err := s.Store.ReadTeams()
+	if err != nil {
+		return Failure("Error reading teams.")
+	}
+	team, err = findTeam(teams, team)
+	if err != nil {
+		return responseFor(err)
+	}
+
+	fileID := parseFileArg(fileArg)
+	if fileID == "" {
+		return Failure(fmt.Sprintf("'%s' isn't a link to a Slack file. Share the CSV in Slack and use its link.", fileArg))
+	}
+
+	rows, resp, ok := s.downloadCSV(ctx, fileID)
+	if !ok {
+		return resp
+	}
+
+	plan, err := s.planImport(ctx, teams.Teams[team], rows)
+	if err != nil {
+		return responseFor(err)
+	}
+	// An empty or unreadable file would otherwise remove everyone
+	if len(plan.NotFound) > 0 && plan.Found == 0 {
+		return Failure(fmt.Sprintf("None of the %d people in the file were found in Slack, so nothing was changed.", len(plan.NotFound)))
+	}
+	if plan.Found == 0 {
+		return Failure("No emails or member IDs found in the file.")
+	}
+
+	if !req.Bool("apply") {
+		lines := []string{fmt.Sprintf("Importing into team '%s' would make these changes:", team)}
+		lines = append(lines, formatImportPlan(plan)...)
+		if len(plan.Add) > 0 || len(plan.Remove) > 0 {
+			lines = append(lines, fmt.Sprintf("Run /connect import %s %s --apply to make them.", quoteArg(team), fileID))
+		}
+		return Success(strings.Join(lines, "\n"))
+	}
+
+	resp, ok = s.update(func() error {
+		teams, err := s.Store.ReadTeams()
+		if err != nil {
+			return fail("Error reading teams.")
+		}
+		if _, exists := teams.Teams[team]; !exists {
+			return fail(fmt.Sprintf("Team '%s' does not exist.", team))
+		}
+
+		users, err := s.Store.ReadUsers()
+		if err != nil {
+			return fail("Error reading users.")
+		}
+
+		updatedTeam := teams.Teams[team]
+		for _, removed := range plan.Remove {
+			for i, member := range updatedTeam.Members {
+				if member.MemberID == removed.MemberID {
+					updatedTeam.Members = append(updatedTeam.Members[:i], updatedTeam.Members[i+1:]...)
+					break
+				}
+			}
+		}
+		for _, added := range plan.Add {
+			// Keep the channels we've already seen them in, so diff is right straight away
+			user, known := users[added.MemberID]
+			for channelID, memberID := range user.Channels {
+				added.Channels[channelID] = memberID
+			}
+			updatedTeam.Members = mergeNewMember(updatedTeam.Members, added)
+
+			if !known {
+				users[added.MemberID] = store.User{
+					MemberID:  added.MemberID,
+					Name:      added.Name,
+					UpdatedAt: time.Now(),
+					Channels:  make(map[string]string),
+				}
+			}
+		}
+		teams.Teams[team] = updatedTeam
+
+		if err := s.Store.WriteTeams(teams); err != nil {
+			return fail("Error writing to teams.")
+		}
+		if err := s.Store.WriteUsers(users); err != nil {
+			slog.ErrorContext(ctx, "Error writing users", "error", err)
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	var events []webhooks.Event
+	for _, added := range plan.Add {
+		event := newEvent(webhooks.MemberAdded, req)
+		event.Team = team
+		event.Member = &webhooks.Member{ID: added.MemberID, Name: added.Name}
+		events = append(events, event)
+	}
+	for _, removed := range plan.Remove {
+		event := newEvent(webhooks.MemberRemoved, req)
+		event.Team = team
+		event.Member = &webhooks.Member{ID: removed.MemberID, Name: removed.Name}
+		events = append(events, event)
+	}
+	s.emit(ctx, events...)
+
+	lines := []string{fmt.Sprintf("Imported into team '%s': added %d, removed %d.", team, len(plan.Add), len(plan.Remove))}
+	if len(plan.NotFound) > 0 {
+		lines = append(lines, fmt.Sprintf("Not found in Slack: %s", strings.Join(plan.NotFound, ", ")))
+	}
+	return Success(strings.Join(lines, "\n"))
+}
+
+// Add a member unless someone with the same ID is already there
+func mergeNewMember(members []store.Member, member store.Member) []store.Member {
+	for _, existing := range members {
+		if existing.MemberID == member.MemberID {
+			return members
+		}
+	}
+	return append(members, member)
+}
+
+// Get a file ID from a file ID, a file link, or a link the way Slack
+// escapes them, e.g. <https://example.slack.com/files/U1/F1/roster.csv>
+func parseFileArg(arg string) string {
+	if strings.HasPrefix(arg, "<") && strings.HasSuffix(arg, ">") {
+		arg, _, _ = strings.Cut(arg[1:len(arg)-1], "|")
+	}
+	if fileIDPattern.MatchString(arg) {
+		return arg
+	}
+
+	link, err := url.Parse(arg)
+	if err != nil || link.Host == "" {
+		return ""
+	}
+	for _, part := range strings.Split(link.Path, "/") {
+		if fileIDPattern.MatchString(part) {
+			return part
+		}
+	}
+	return ""
+}
+
+// Download a file shared in Slack and parse it as CSV
+func (s *Service) downloadCSV(ctx context.Context, fileID string) ([][]string, Response, bool) {
+	file, _, _, err := s.Slack.GetFileInfoContext(ctx, fileID, 0, 0)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting file info", "file_id", fileID, "error", err)
+		return nil, Failure(fmt.Sprintf("Error getting the file: %v. Make sure it's shared in a channel the bot is in.", err)), false
+	}
+
+	downloadURL := file.URLPrivateDownload
+	if downloadURL == "" {
+		downloadURL = file.URLPrivate
+	}
+
+	var buf bytes.Buffer
+	if err := s.Slack.GetFileContext(ctx, downloadURL, &buf); err != nil {
+		slog.ErrorContext(ctx, "Error downloading file", "file_id", fileID, "error", err)
+		return nil, Failure(fmt.Sprintf("Error downloading the file: %v", err)), false
+	}
+
+	r := csv.NewReader(&buf)
+	// Rosters come from all sorts of spreadsheets, so don't be strict
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, Failure(fmt.Sprintf("Error reading the file as CSV: %v", err)), false
+	}
+	return rows, Response{}, true
+}
+
+// Work out who to add and remove so a team matches the people in a CSV.
+// Each row is matched on the first cell that looks like an email or a
+// member ID, so a header row or extra columns don't matter.
+// Lookups that fail for any reason other than the person not being in
+// Slack stop the import: treating them as not found would remove members
+// just because Slack was slow or rate limiting us.
+func (s *Service) planImport(ctx context.Context, team store.Team, rows [][]string) (importPlan, error) {
+	var plan importPlan
+	wanted := make(map[string]bool)
+	inTeam := make(map[string]bool)
+	for _, member := range team.Members {
+		inTeam[member.MemberID] = true
+	}
+
+	for _, row := range rows {
+		for _, cell := range row {
+			cell = strings.TrimSpace(cell)
+			var user *slack.User
+			var err error
+			switch {
+			case strings.Contains(cell, "@"):
+				user, err = s.Slack.GetUserByEmailContext(ctx, cell)
+			case slackapi.IsUserID(cell):
+				user, err = s.Slack.GetUserInfoContext(ctx, cell)
+			default:
+				continue
+			}
+
+			if err != nil && !lookupNotFound[slackapi.ErrorCode(err)] {
+				slog.ErrorContext(ctx, "Error looking up import entry", "error", err)
+				return importPlan{}, fail(fmt.Sprintf("Error looking up %s in Slack, so nothing was changed. Please try again.", cell))
+			}
+			if err != nil || user.IsBot {
+				slog.DebugContext(ctx, "Import entry not found", "error", err)
+				plan.NotFound = append(plan.NotFound, cell)
+			} else if !wanted[user.ID] {
+				wanted[user.ID] = true
+				plan.Found++
+				if !inTeam[user.ID] {
+					plan.Add = append(plan.Add, store.Member{
+						MemberID: user.ID,
+						Name:     slackapi.DisplayName(user),
+						Channels: make(map[string]string),
+					})
+				}
+			}
+			break
+		}
+	}
+
+	for _, member := range team.Members {
+		if !wanted[member.MemberID] {
+			plan.Remove = append(plan.Remove, member)
+		}
+	}
+	return plan, nil
+}
+
+// Format the changes an import would make as report lines
+func formatImportPlan(plan importPlan) []string {
+	var lines []string
+	if len(plan.Add) == 0 && len(plan.Remove) == 0 {
+		lines = append(lines, "No changes, the team already matches the file.")
+	}
+	if len(plan.Add) > 0 {
+		lines = append(lines, fmt.Sprintf("Add (%d):", len(plan.Add)))
+		for _, member := range plan.Add {
+			lines = append(lines, fmt.Sprintf("  - %s (%s)", member.Name, member.MemberID))
+		}
+	}
+	if len(plan.Remove) > 0 {
+		lines = append(lines, fmt.Sprintf("Remove (%d):", len(plan.Remove)))
+		for _, member := range plan.Remove {
+			lines = append(lines, fmt.Sprintf("  - %s (%s)", member.Name, member.MemberID))
+		}
+	}
+	if len(plan.NotFound) > 0 {
+		lines = append(lines, fmt.Sprintf("Not found in Slack (%d):", len(plan.NotFound)))
+		for _, entry := range plan.NotFound {
+			lines = append(lines, "  - "+entry)
+		}
+	}
+	return lines
+}
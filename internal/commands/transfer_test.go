@@ -0,0 +1,20 @@
+package commands
+
+import "testing"
+
+func TestParseFileArg(t *testing.T) {
+	tests := map[string]string{
+		"F0123ABCD": "F0123ABCD",
+		"https://example.slack.com/files/U0123ABCD/F0123ABCD/roster.csv":              "F0123ABCD",
+		"<https://example.slack.com/files/U0123ABCD/F0123ABCD/roster.csv>":            "F0123ABCD",
+		"<https://example.slack.com/files/U0123ABCD/F0123ABCD/roster.csv|roster.csv>": "F0123ABCD",
+		"roster.csv":                "",
+		"https://example.com/a.csv": "",
+		"f0123abcd":                 "",
+	}
+	for arg, want := range tests {
+		if got := parseFileArg(arg); got != want {
+			t.Errorf("parseFileArg(%q) = %q, want %q", arg, got, want)
+		}
+	}
+}
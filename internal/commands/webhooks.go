@@ -0,0 +1,285 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+func (s *Service) registerWebhookCommands(r *Router) {
+	r.Register(Command{
+		Name: "webhooks",
+		Usage: []string{
+			"webhooks [list]",
+			"webhooks add <url> [--events <event,...>]",
+			"webhooks remove <id>",
+			"webhooks test <id>",
+		},
+		Summary: "Manage the endpoints that are told about team, member and channel changes. " +
+			"Events: " + strings.Join(webhooks.Events, ", ") + ".",
+		Flags: []Flag{
+			{Name: "events", Usage: "Comma separated events to send to the endpoint. All of them if left out"},
+		},
+		Examples: []string{
+			"webhooks add https://tickets.example.com/hooks/connect",
+			"webhooks add https://crm.example.com/connect --events member.added,member.removed",
+			"webhooks test wh_3f9a1c2e5b7d4e60",
+		},
+		Run: s.webhooks,
+	})
+}
+
+// Create an event caused by the user running a command
+func newEvent(eventType string, req Request) webhooks.Event {
+	event := webhooks.NewEvent(eventType)
+	event.By = req.UserID
+	return event
+}
+
+// Record events in the audit log and send them to the webhooks. Must not
+// be called from inside Store.Update.
+func (s *Service) emit(ctx context.Context, events ...webhooks.Event) {
+	webhooks.RecordAudit(ctx, s.Store, events...)
+	s.Webhooks.Emit(ctx, events...)
+}
+
+func (s *Service) webhooks(ctx context.Context, req Request) Response {
+	sub := "list"
+	if len(req.Args) > 0 {
+		sub = req.Args[0]
+	}
+
+	switch sub {
+	case "list":
+		return s.listWebhooks()
+	case "add":
+		if len(req.Args) < 2 {
+			return Failure("Please provide the URL to send events to.")
+		}
+		if resp, ok := s.requireAdmin(ctx, req, "add webhooks"); !ok {
+			return resp
+		}
+		return s.addWebhook(req, req.Args[1])
+	case "remove":
+		if len(req.Args) < 2 {
+			return Failure("Please provide the ID of the webhook to remove.")
+		}
+		if resp, ok := s.requireAdmin(ctx, req, "remove webhooks"); !ok {
+			return resp
+		}
+		return s.removeWebhook(req.Args[1])
+	case "test":
+		if len(req.Args) < 2 {
+			return Failure("Please provide the ID of the webhook to test.")
+		}
+		return s.testWebhook(ctx, req, req.Args[1])
+	}
+	return Failure(fmt.Sprintf("Unknown webhooks command '%s'. Use list, add, remove or test.", sub))
+}
+
+func (s *Service) listWebhooks() Response {
+	hooks, err := s.Store.ReadWebhooks()
+	if err != nil {
+		return Failure("Error reading webhooks.")
+	}
+	if len(hooks) == 0 {
+		return Success("No webhooks are set up. Add one with /connect webhooks add <url>.")
+	}
+	queue, err := s.Store.ReadWebhookQueue()
+	if err != nil {
+		return Failure("Error reading the webhook queue.")
+	}
+
+	pending := make(map[string]int)
+	for _, delivery := range queue {
+		pending[delivery.WebhookID]++
+	}
+
+	ids := make([]string, 0, len(hooks))
+	for id := range hooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines := []string{"Webhooks:"}
+	for _, id := range ids {
+		hook := hooks[id]
+		events := "all events"
+		if len(hook.Events) > 0 {
+			events = strings.Join(hook.Events, ", ")
+		}
+		line := fmt.Sprintf("- %s %s (%s)", id, hook.URL, events)
+		if n := pending[id]; n > 0 {
+			line += fmt.Sprintf(", %d pending", n)
+		}
+		if hook.LastError != "" {
+			line += fmt.Sprintf(", last error: %s", hook.LastError)
+		}
+		lines = append(lines, line)
+	}
+	return Success(strings.Join(lines, "\n"))
+}
+
+func (s *Service) addWebhook(req Request, rawURL string) Response {
+	// Slack wraps links in <...>
+	if strings.HasPrefix(rawURL, "<") && strings.HasSuffix(rawURL, ">") {
+		rawURL, _, _ = strings.Cut(rawURL[1:len(rawURL)-1], "|")
+	}
+	link, err := url.Parse(rawURL)
+	if err != nil || (link.Scheme != "https" && link.Scheme != "http") || link.Host == "" {
+		return Failure(fmt.Sprintf("'%s' isn't an http or https URL.", rawURL))
+	}
+	// Names are checked again once they're resolved, on every delivery
+	ip := net.ParseIP(link.Hostname())
+	if (ip != nil && !webhooks.PublicIP(ip)) || strings.EqualFold(link.Hostname(), "localhost") {
+		return Failure(fmt.Sprintf("Webhooks can't send events to %s, only to public addresses.", link.Hostname()))
+	}
+
+	var events []string
+	if v := req.Flag("events"); v != "" {
+		for _, event := range strings.Split(v, ",") {
+			event = strings.TrimSpace(event)
+			if !containsString(webhooks.Events, event) {
+				return Failure(fmt.Sprintf("Unknown event '%s'. The events are: %s.", event, strings.Join(webhooks.Events, ", ")))
+			}
+			if !containsString(events, event) {
+				events = append(events, event)
+			}
+		}
+	}
+
+	secret, err := webhooks.NewSecret()
+	if err != nil {
+		return Failure("Error generating a signing secret.")
+	}
+	hook := store.Webhook{
+		ID:        webhooks.NewWebhookID(),
+		URL:       rawURL,
+		Secret:    secret,
+		Events:    events,
+		CreatedBy: req.UserID,
+		CreatedAt: time.Now(),
+	}
+
+	resp, ok := s.update(func() error {
+		hooks, err := s.Store.ReadWebhooks()
+		if err != nil {
+			return fail("Error reading webhooks.")
+		}
+		for id, existing := range hooks {
+			if existing.URL == hook.URL {
+				return fail(fmt.Sprintf("Webhook %s already sends events to %s.", id, hook.URL))
+			}
+		}
+
+		hooks[hook.ID] = hook
+		if err := s.Store.WriteWebhooks(hooks); err != nil {
+			return fail("Error writing webhooks.")
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	return Success(fmt.Sprintf("Webhook %s added. Its signing secret is %s\n"+
+		"Keep it safe, it won't be shown again. Each request is signed in the %s header the same way Slack signs its requests.",
+		hook.ID, secret, webhooks.HeaderSignature))
+}
+
+func (s *Service) removeWebhook(id string) Response {
+	dropped := 0
+	resp, ok := s.update(func() error {
+		hooks, err := s.Store.ReadWebhooks()
+		if err != nil {
+			return fail("Error reading webhooks.")
+		}
+		if _, exists := hooks[id]; !exists {
+			return fail(fmt.Sprintf("Webhook %s does not exist.", id))
+		}
+		delete(hooks, id)
+		if err := s.Store.WriteWebhooks(hooks); err != nil {
+			return fail("Error writing webhooks.")
+		}
+
+		// Drop anything still waiting to be sent to it
+		queue, err := s.Store.ReadWebhookQueue()
+		if err != nil {
+			return nil
+		}
+		var kept []store.Delivery
+		for _, delivery := range queue {
+			if delivery.WebhookID == id {
+				dropped++
+			} else {
+				kept = append(kept, delivery)
+			}
+		}
+		if dropped > 0 {
+			return s.Store.WriteWebhookQueue(kept)
+		}
+		return nil
+	})
+	if !ok {
+		return resp
+	}
+
+	if dropped > 0 {
+		return Success(fmt.Sprintf("Webhook %s has been removed, with %d pending event(s).", id, dropped))
+	}
+	return Success(fmt.Sprintf("Webhook %s has been removed.", id))
+}
+
+func (s *Service) testWebhook(ctx context.Context, req Request, id string) Response {
+	if s.Webhooks == nil {
+		return Failure("Webhooks aren't delivered from here.")
+	}
+	hooks, err := s.Store.ReadWebhooks()
+	if err != nil {
+		return Failure("Error reading webhooks.")
+	}
+	if _, exists := hooks[id]; !exists {
+		return Failure(fmt.Sprintf("Webhook %s does not exist.", id))
+	}
+
+	if err := s.Webhooks.Test(ctx, id, req.UserID); err != nil {
+		return Failure("Error queueing the test event.")
+	}
+	return Success(fmt.Sprintf("A %s event is on its way to webhook %s. Run /connect webhooks list to see if it failed.", webhooks.Ping, id))
+}
+
+// Check that whoever runs a command is a workspace admin or owner, since
+// webhooks receive every change, names included. Commands run from the
+// command line have no user and are let through: whoever runs them already
+// has the data directory.
+func (s *Service) requireAdmin(ctx context.Context, req Request, action string) (Response, bool) {
+	if req.UserID == "" {
+		return Response{}, true
+	}
+	user, err := s.Slack.GetUserInfoContext(ctx, req.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error looking up user", "user_id", req.UserID, "error", err)
+		return Failure("Error checking whether you're a workspace admin."), false
+	}
+	if !user.IsAdmin && !user.IsOwner {
+		return Failure(fmt.Sprintf("Only workspace admins can %s.", action)), false
+	}
+	return Response{}, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,445 @@
+// Package config loads the server settings.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"slack-connect-manager/internal/secrets"
+)
+
+// Config holds all the server settings.
+// Values are applied in this order, each one overriding the last:
+// defaults, the optional YAML config file, environment variables, flags.
+type Config struct {
+	// Address the HTTP server listens on, e.g. ":3000"
+	Addr string `yaml:"addr"`
+	// Directory holding the data files
+	DataDir string `yaml:"data_dir"`
+	// Where the data is kept: json files or a sqlite database in the data directory
+	Storage string `yaml:"storage"`
+	// How often a tracked channel is synced while its members are changing
+	SyncInterval time.Duration `yaml:"sync_interval"`
+	// How long a channel whose members aren't changing may go between syncs.
+	// Quiet channels back off from SyncInterval up to this.
+	SyncMaxInterval time.Duration `yaml:"sync_max_interval"`
+	// How many channels sync at once
+	SyncConcurrency int `yaml:"sync_concurrency"`
+	// How long the sync loop may go without progress before /readyz reports it as stuck
+	SyncStallTimeout time.Duration `yaml:"sync_stall_timeout"`
+	// Track every Slack Connect channel the bot can see, without adding them one by one
+	AutoDiscover bool `yaml:"auto_discover"`
+	// How often auto discovery lists every channel the bot can see
+	DiscoverInterval time.Duration `yaml:"discover_interval"`
+	// How long to wait for in-flight requests and syncs when shutting down
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// One of debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+	// text or json
+	LogFormat string `yaml:"log_format"`
+	// The Slack bot token (xoxb-...). Optional when the app is installed with OAuth.
+	SlackBotToken string `yaml:"slack_bot_token"`
+	// The app's OAuth credentials, for installing it in more workspaces
+	SlackClientID     string `yaml:"slack_client_id"`
+	SlackClientSecret string `yaml:"slack_client_secret"`
+	// Where Slack sends people back to after an install, e.g.
+	// "https://connect.example.com/slack/oauth/callback". Optional if the
+	// app has only one redirect URL.
+	SlackRedirectURL string `yaml:"slack_redirect_url"`
+	// Used to verify that requests really come from Slack
+	SlackSigningSecret string `yaml:"slack_signing_secret"`
+	// Base URL of the Slack API, only changed to point at a fake Slack server
+	SlackAPIURL string `yaml:"slack_api_url"`
+	// Bearer tokens accepted by the REST API. The API is off if there are none.
+	APITokens []string `yaml:"api_tokens"`
+	// The master key for encrypting secrets, as base64, or a file holding it.
+	// Bot tokens and webhook secrets are stored in plaintext without one.
+	SecretsKey     string `yaml:"secrets_key"`
+	SecretsKeyFile string `yaml:"secrets_key_file"`
+
+	// Built from the secrets key
+	keyring *secrets.Keyring
+}
+
+// The environment variables each setting can be read from
+const (
+	EnvConfigFile   = "CONNECT_CONFIG"
+	EnvAddr         = "CONNECT_ADDR"
+	EnvDataDir      = "CONNECT_DATA_DIR"
+	EnvStorage      = "CONNECT_STORAGE"
+	EnvSyncInterval = "CONNECT_SYNC_INTERVAL"
+	EnvSyncMax      = "CONNECT_SYNC_MAX_INTERVAL"
+	EnvSyncWorkers  = "CONNECT_SYNC_CONCURRENCY"
+	EnvSyncStall    = "CONNECT_SYNC_STALL_TIMEOUT"
+	EnvAutoDiscover = "CONNECT_AUTO_DISCOVER"
+	EnvDiscover     = "CONNECT_DISCOVER_INTERVAL"
+	EnvShutdown     = "CONNECT_SHUTDOWN_TIMEOUT"
+	EnvLogLevel     = "CONNECT_LOG_LEVEL"
+	EnvLogFormat    = "CONNECT_LOG_FORMAT"
+	EnvSlackToken   = "SLACK_BOT_TOKEN"
+	EnvSlackSecret  = "SLACK_SIGNING_SECRET"
+	EnvSlackAPIURL  = "SLACK_API_URL"
+	EnvClientID     = "SLACK_CLIENT_ID"
+	EnvClientSecret = "SLACK_CLIENT_SECRET"
+	EnvRedirectURL  = "SLACK_REDIRECT_URL"
+	// Comma separated
+	EnvAPITokens      = "CONNECT_API_TOKENS"
+	EnvSecretsKey     = "CONNECT_SECRETS_KEY"
+	EnvSecretsKeyFile = "CONNECT_SECRETS_KEY_FILE"
+)
+
+// API tokens shorter than this are too easy to guess
+const minAPITokenLength = 16
+
+var (
+	logLevels  = []string{"debug", "info", "warn", "error"}
+	logFormats = []string{"text", "json"}
+	storages   = []string{"json", "sqlite"}
+)
+
+// Default returns the settings used when nothing else is configured
+func Default() Config {
+	return Config{
+		Addr:             ":3000",
+		DataDir:          ".",
+		Storage:          "json",
+		SyncInterval:     10 * time.Second,
+		SyncMaxInterval:  5 * time.Minute,
+		SyncConcurrency:  4,
+		SyncStallTimeout: 5 * time.Minute,
+		DiscoverInterval: time.Hour,
+		ShutdownTimeout:  30 * time.Second,
+		LogLevel:         "info",
+		LogFormat:        "text",
+	}
+}
+
+// Load reads the config from the config file, the environment and the command line flags
+func Load(args []string) (Config, error) {
+	cfg, _, err := Parse("slack-connect-manager", args)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// Parse reads the config like Load, but stops at the first argument that
+// isn't a flag and returns the arguments from there on. The config isn't
+// validated, so tools that don't need everything can check what they use.
+// Tools can add flags of their own with extra.
+func Parse(name string, args []string, extra ...func(fs *flag.FlagSet)) (Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(EnvConfigFile), "path to an optional YAML config file")
+	addr := fs.String("addr", "", "address to listen on (default \":3000\")")
+	dataDir := fs.String("data-dir", "", "directory holding the data files (default \".\")")
+	storage := fs.String("storage", "", "where to keep the data: json or sqlite (default \"json\")")
+	syncInterval := fs.Duration("sync-interval", 0, "time between syncs of a channel whose members are changing (default 10s)")
+	syncMaxInterval := fs.Duration("sync-max-interval", 0, "longest time between syncs of a quiet channel (default 5m)")
+	syncConcurrency := fs.Int("sync-concurrency", 0, "how many channels sync at once (default 4)")
+	syncStallTimeout := fs.Duration("sync-stall-timeout", 0, "how long the sync may make no progress before /readyz fails (default 5m)")
+	autoDiscover := fs.Bool("auto-discover", false, "track every Slack Connect channel the bot can see")
+	discoverInterval := fs.Duration("discover-interval", 0, "time between auto discovery runs (default 1h)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "how long to wait for in-flight work on shutdown (default 30s)")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error (default \"info\")")
+	logFormat := fs.String("log-format", "", "log format: text or json (default \"text\")")
+	secretsKeyFile := fs.String("secrets-key-file", "", "file holding the key that encrypts stored secrets")
+	for _, add := range extra {
+		add(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, nil, fmt.Errorf("parsing config file %s: %w", *configFile, err)
+		}
+	}
+
+	if v := os.Getenv(EnvAddr); v != "" {
+		cfg.Addr = v
+	}
+	if v := os.Getenv(EnvDataDir); v != "" {
+		cfg.DataDir = v
+	}
+	if v := os.Getenv(EnvStorage); v != "" {
+		cfg.Storage = v
+	}
+	if v := os.Getenv(EnvSyncInterval); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvSyncInterval, err)
+		}
+		cfg.SyncInterval = d
+	}
+	if v := os.Getenv(EnvSyncMax); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvSyncMax, err)
+		}
+		cfg.SyncMaxInterval = d
+	}
+	if v := os.Getenv(EnvSyncWorkers); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvSyncWorkers, err)
+		}
+		cfg.SyncConcurrency = n
+	}
+	if v := os.Getenv(EnvSyncStall); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvSyncStall, err)
+		}
+		cfg.SyncStallTimeout = d
+	}
+	if v := os.Getenv(EnvAutoDiscover); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvAutoDiscover, err)
+		}
+		cfg.AutoDiscover = b
+	}
+	if v := os.Getenv(EnvDiscover); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvDiscover, err)
+		}
+		cfg.DiscoverInterval = d
+	}
+	if v := os.Getenv(EnvShutdown); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid %s: %w", EnvShutdown, err)
+		}
+		cfg.ShutdownTimeout = d
+	}
+	if v := os.Getenv(EnvLogLevel); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv(EnvLogFormat); v != "" {
+		cfg.LogFormat = v
+	}
+	if v := os.Getenv(EnvSlackToken); v != "" {
+		cfg.SlackBotToken = v
+	}
+	if v := os.Getenv(EnvSlackSecret); v != "" {
+		cfg.SlackSigningSecret = v
+	}
+	if v := os.Getenv(EnvSlackAPIURL); v != "" {
+		cfg.SlackAPIURL = v
+	}
+	if v := os.Getenv(EnvClientID); v != "" {
+		cfg.SlackClientID = v
+	}
+	if v := os.Getenv(EnvClientSecret); v != "" {
+		cfg.SlackClientSecret = v
+	}
+	if v := os.Getenv(EnvRedirectURL); v != "" {
+		cfg.SlackRedirectURL = v
+	}
+	if v := os.Getenv(EnvSecretsKey); v != "" {
+		cfg.SecretsKey = v
+	}
+	if v := os.Getenv(EnvSecretsKeyFile); v != "" {
+		cfg.SecretsKeyFile = v
+	}
+	if v := os.Getenv(EnvAPITokens); v != "" {
+		cfg.APITokens = nil
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				cfg.APITokens = append(cfg.APITokens, token)
+			}
+		}
+	}
+
+	// Only flags that were actually passed override the other sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "storage":
+			cfg.Storage = *storage
+		case "sync-interval":
+			cfg.SyncInterval = *syncInterval
+		case "sync-max-interval":
+			cfg.SyncMaxInterval = *syncMaxInterval
+		case "sync-concurrency":
+			cfg.SyncConcurrency = *syncConcurrency
+		case "sync-stall-timeout":
+			cfg.SyncStallTimeout = *syncStallTimeout
+		case "auto-discover":
+			cfg.AutoDiscover = *autoDiscover
+		case "discover-interval":
+			cfg.DiscoverInterval = *discoverInterval
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "log-format":
+			cfg.LogFormat = *logFormat
+		case "secrets-key-file":
+			cfg.SecretsKeyFile = *secretsKeyFile
+		}
+	})
+
+	if err := cfg.loadSecrets(); err != nil {
+		return cfg, nil, err
+	}
+
+	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+	cfg.Storage = strings.ToLower(cfg.Storage)
+	return cfg, fs.Args(), nil
+}
+
+// Keyring returns the keyring for encrypting secrets, or nil if no secrets key is configured
+func (c Config) Keyring() *secrets.Keyring {
+	return c.keyring
+}
+
+// Load the secrets key and decrypt the Slack secrets, which may be given
+// encrypted, e.g. in the .env file
+func (c *Config) loadSecrets() error {
+	if c.SecretsKey != "" && c.SecretsKeyFile != "" {
+		return errors.New("set only one of secrets_key and secrets_key_file")
+	}
+
+	var key []byte
+	var err error
+	switch {
+	case c.SecretsKey != "":
+		key, err = secrets.ParseKey(c.SecretsKey)
+	case c.SecretsKeyFile != "":
+		key, err = secrets.ReadKeyFile(c.SecretsKeyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("loading secrets key: %w", err)
+	}
+	if key != nil {
+		if c.keyring, err = secrets.NewKeyring(key); err != nil {
+			return fmt.Errorf("loading secrets key: %w", err)
+		}
+	}
+
+	for name, value := range map[string]*string{
+		EnvSlackToken:   &c.SlackBotToken,
+		EnvSlackSecret:  &c.SlackSigningSecret,
+		EnvClientSecret: &c.SlackClientSecret,
+	} {
+		plaintext, err := c.keyring.Decrypt(*value)
+		if err != nil {
+			return fmt.Errorf("decrypting %s: %w", name, err)
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+// Validate checks that the config can be used to run the server
+func (c Config) Validate() error {
+	problems := c.problems()
+	if c.SlackBotToken == "" && !c.OAuthEnabled() {
+		problems = append(problems, fmt.Sprintf("a Slack bot token is required (set %s), unless the app is installed with OAuth (set %s and %s)",
+			EnvSlackToken, EnvClientID, EnvClientSecret))
+	}
+	return asError(problems)
+}
+
+// OAuthEnabled reports whether the app can be installed in workspaces with OAuth
+func (c Config) OAuthEnabled() bool {
+	return c.SlackClientID != "" && c.SlackClientSecret != ""
+}
+
+// ValidateOffline checks the config like Validate, except that no Slack
+// bot token is needed. For tools that only sometimes talk to Slack.
+func (c Config) ValidateOffline() error {
+	return asError(c.problems())
+}
+
+func (c Config) problems() []string {
+	var problems []string
+	if c.Addr == "" {
+		problems = append(problems, "addr must not be empty")
+	}
+	if c.DataDir == "" {
+		problems = append(problems, "data_dir must not be empty")
+	}
+	if c.SyncInterval < time.Second {
+		problems = append(problems, "sync_interval must be at least 1s")
+	}
+	if c.SyncMaxInterval < c.SyncInterval {
+		problems = append(problems, "sync_max_interval must be at least sync_interval")
+	}
+	if c.SyncConcurrency < 1 {
+		problems = append(problems, "sync_concurrency must be at least 1")
+	}
+	if c.SyncStallTimeout <= 0 {
+		problems = append(problems, "sync_stall_timeout must be positive")
+	}
+	if c.DiscoverInterval < time.Minute {
+		problems = append(problems, "discover_interval must be at least 1m")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout must be positive")
+	}
+	if !contains(logLevels, c.LogLevel) {
+		problems = append(problems, fmt.Sprintf("log_level must be one of %s", strings.Join(logLevels, ", ")))
+	}
+	if !contains(logFormats, c.LogFormat) {
+		problems = append(problems, fmt.Sprintf("log_format must be one of %s", strings.Join(logFormats, ", ")))
+	}
+	if !contains(storages, c.Storage) {
+		problems = append(problems, fmt.Sprintf("storage must be one of %s", strings.Join(storages, ", ")))
+	}
+
+	if c.SlackAPIURL != "" && !strings.HasSuffix(c.SlackAPIURL, "/") {
+		problems = append(problems, "slack_api_url must end with a /")
+	}
+	if (c.SlackClientID == "") != (c.SlackClientSecret == "") {
+		problems = append(problems, "slack_client_id and slack_client_secret must be set together")
+	}
+	if c.SlackRedirectURL != "" && !strings.HasPrefix(c.SlackRedirectURL, "https://") && !strings.HasPrefix(c.SlackRedirectURL, "http://") {
+		problems = append(problems, "slack_redirect_url must be an http or https URL")
+	}
+	for _, token := range c.APITokens {
+		if len(token) < minAPITokenLength {
+			problems = append(problems, fmt.Sprintf("api_tokens must be at least %d characters long", minAPITokenLength))
+			break
+		}
+	}
+
+	return problems
+}
+
+func asError(problems []string) error {
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
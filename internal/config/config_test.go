@@ -0,0 +1,193 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unset every setting the environment could provide, so the tests only see their own
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{
+		EnvConfigFile, EnvAddr, EnvDataDir, EnvStorage, EnvSyncInterval, EnvSyncMax, EnvSyncWorkers,
+		EnvSyncStall, EnvAutoDiscover, EnvDiscover, EnvShutdown, EnvLogLevel, EnvLogFormat,
+		EnvSlackToken, EnvSlackSecret, EnvSlackAPIURL, EnvClientID, EnvClientSecret, EnvRedirectURL,
+		EnvAPITokens, EnvSecretsKey, EnvSecretsKeyFile,
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+
+		wantAddr         string
+		wantSyncInterval time.Duration
+		wantLogLevel     string
+		wantAPITokens    []string
+	}{
+		{
+			name:             "defaults",
+			wantAddr:         ":3000",
+			wantSyncInterval: 10 * time.Second,
+			wantLogLevel:     "info",
+		},
+		{
+			name:             "file over defaults",
+			file:             "addr: \":4000\"\nsync_interval: 30s\nlog_level: WARN\napi_tokens: [from-the-config-file]\n",
+			wantAddr:         ":4000",
+			wantSyncInterval: 30 * time.Second,
+			wantLogLevel:     "warn",
+			wantAPITokens:    []string{"from-the-config-file"},
+		},
+		{
+			name:             "env over file",
+			file:             "addr: \":4000\"\nsync_interval: 30s\napi_tokens: [from-the-config-file]\n",
+			env:              map[string]string{EnvAddr: ":5000", EnvAPITokens: "first-token, second-token,"},
+			wantAddr:         ":5000",
+			wantSyncInterval: 30 * time.Second,
+			wantLogLevel:     "info",
+			wantAPITokens:    []string{"first-token", "second-token"},
+		},
+		{
+			name:             "flags over env",
+			file:             "addr: \":4000\"\n",
+			env:              map[string]string{EnvAddr: ":5000", EnvSyncInterval: "20s", EnvLogLevel: "debug"},
+			args:             []string{"-addr", ":6000", "-log-level", "error"},
+			wantAddr:         ":6000",
+			wantSyncInterval: 20 * time.Second,
+			wantLogLevel:     "error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(EnvConfigFile, path)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, _, err := Parse("test", tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Addr != tt.wantAddr || cfg.SyncInterval != tt.wantSyncInterval || cfg.LogLevel != tt.wantLogLevel {
+				t.Errorf("addr = %q, sync_interval = %s, log_level = %q, want %q, %s, %q",
+					cfg.Addr, cfg.SyncInterval, cfg.LogLevel, tt.wantAddr, tt.wantSyncInterval, tt.wantLogLevel)
+			}
+			if strings.Join(cfg.APITokens, ",") != strings.Join(tt.wantAPITokens, ",") {
+				t.Errorf("api_tokens = %q, want %q", cfg.APITokens, tt.wantAPITokens)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "bad env duration", env: map[string]string{EnvSyncInterval: "often"}, want: "invalid " + EnvSyncInterval},
+		{name: "bad env number", env: map[string]string{EnvSyncWorkers: "many"}, want: "invalid " + EnvSyncWorkers},
+		{name: "bad env bool", env: map[string]string{EnvAutoDiscover: "sometimes"}, want: "invalid " + EnvAutoDiscover},
+		{name: "bad yaml", file: "addr: [", want: "parsing config file"},
+		{name: "unknown flag", args: []string{"-nope"}, want: "flag provided but not defined"},
+		{name: "two secrets keys", env: map[string]string{EnvSecretsKey: "a", EnvSecretsKeyFile: "b"}, want: "set only one of secrets_key and secrets_key_file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(EnvConfigFile, path)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, _, err := Parse("test", tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProblems(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{name: "empty addr", change: func(c *Config) { c.Addr = "" }, want: "addr must not be empty"},
+		{name: "empty data dir", change: func(c *Config) { c.DataDir = "" }, want: "data_dir must not be empty"},
+		{name: "short sync interval", change: func(c *Config) { c.SyncInterval = time.Millisecond }, want: "sync_interval must be at least 1s"},
+		{name: "max under sync interval", change: func(c *Config) { c.SyncMaxInterval = 5 * time.Second }, want: "sync_max_interval must be at least sync_interval"},
+		{name: "no sync workers", change: func(c *Config) { c.SyncConcurrency = 0 }, want: "sync_concurrency must be at least 1"},
+		{name: "no stall timeout", change: func(c *Config) { c.SyncStallTimeout = 0 }, want: "sync_stall_timeout must be positive"},
+		{name: "short discover interval", change: func(c *Config) { c.DiscoverInterval = time.Second }, want: "discover_interval must be at least 1m"},
+		{name: "no shutdown timeout", change: func(c *Config) { c.ShutdownTimeout = -time.Second }, want: "shutdown_timeout must be positive"},
+		{name: "unknown log level", change: func(c *Config) { c.LogLevel = "loud" }, want: "log_level must be one of debug, info, warn, error"},
+		{name: "unknown log format", change: func(c *Config) { c.LogFormat = "xml" }, want: "log_format must be one of text, json"},
+		{name: "unknown storage", change: func(c *Config) { c.Storage = "postgres" }, want: "storage must be one of json, sqlite"},
+		{name: "api url without slash", change: func(c *Config) { c.SlackAPIURL = "http://localhost:8080/api" }, want: "slack_api_url must end with a /"},
+		{name: "client id without secret", change: func(c *Config) { c.SlackClientID = "client-id" }, want: "slack_client_id and slack_client_secret must be set together"},
+		{name: "redirect url not http", change: func(c *Config) { c.SlackRedirectURL = "connect.example.com/callback" }, want: "slack_redirect_url must be an http or https URL"},
+		{name: "short api token", change: func(c *Config) { c.APITokens = []string{"short"} }, want: "api_tokens must be at least 16 characters long"},
+	}
+
+	if problems := Default().problems(); len(problems) != 0 {
+		t.Fatalf("defaults have problems: %q", problems)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+			problems := cfg.problems()
+			if len(problems) != 1 || problems[0] != tt.want {
+				t.Errorf("problems = %q, want only %q", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	if err := cfg.ValidateOffline(); err != nil {
+		t.Errorf("ValidateOffline() = %v, want no error without a bot token", err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "a Slack bot token is required") {
+		t.Errorf("Validate() = %v, want the missing bot token", err)
+	}
+
+	cfg.SlackClientID, cfg.SlackClientSecret = "client-id", "client-secret"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() with OAuth = %v, want no error", err)
+	}
+	cfg.SlackClientID, cfg.SlackClientSecret = "", ""
+	cfg.SlackBotToken = "xoxb-token"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() with a bot token = %v, want no error", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Package health tracks what the /healthz and /readyz endpoints report.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+)
+
+// How often the sync loop re-checks that the bot token still works
+const authCheckInterval = time.Minute
+
+// State records what /readyz needs to know about the rest of the app. Each
+// workspace's sync loop reports to its own State, made with Workspace, so one
+// workspace failing can't be hidden by another one doing fine.
+type State struct {
+	syncInterval     time.Duration
+	syncStallTimeout time.Duration
+
+	mu            sync.Mutex
+	authOK        bool
+	authError     string
+	authCheckedAt time.Time
+	syncHeartbeat time.Time
+	// By team ID
+	workspaces map[string]*State
+}
+
+// New creates the health state. The sync loop counts as stuck once it has
+// made no progress for syncInterval plus syncStallTimeout.
+func New(syncInterval, syncStallTimeout time.Duration) *State {
+	return &State{
+		syncInterval:     syncInterval,
+		syncStallTimeout: syncStallTimeout,
+	}
+}
+
+// Workspace returns the state of a workspace, creating it if needed.
+// /readyz fails if any workspace's checks fail.
+func (h *State) Workspace(teamID string) *State {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.workspaces == nil {
+		h.workspaces = make(map[string]*State)
+	}
+	ws, ok := h.workspaces[teamID]
+	if !ok {
+		ws = New(h.syncInterval, h.syncStallTimeout)
+		h.workspaces[teamID] = ws
+	}
+	return ws
+}
+
+// Forget drops the state of a workspace, e.g. once the app is uninstalled from it
+func (h *State) Forget(teamID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.workspaces, teamID)
+}
+
+// RecordAuth records the result of an AuthTest call
+func (h *State) RecordAuth(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.authOK = err == nil
+	h.authError = ""
+	if err != nil {
+		h.authError = err.Error()
+	}
+	h.authCheckedAt = time.Now()
+}
+
+// SyncAlive records that the sync loop made progress
+func (h *State) SyncAlive() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.syncHeartbeat = time.Now()
+}
+
+// CheckAuth re-runs AuthTest if the last check is older than authCheckInterval
+func (h *State) CheckAuth(ctx context.Context, client slackapi.Client) {
+	h.mu.Lock()
+	due := time.Since(h.authCheckedAt) >= authCheckInterval
+	h.mu.Unlock()
+	if !due {
+		return
+	}
+
+	_, err := client.AuthTestContext(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	h.RecordAuth(err)
+}
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Healthz reports that the process is up
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the data is readable, the bot token works and the
+// sync loop isn't stuck, in every workspace. The last two are only checked
+// once there is a bot token, so a server waiting for its first install is
+// still ready.
+func (h *State) Readyz(st *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]checkResult{}
+
+		// Each workspace's failures are listed under its team ID
+		storeChecks := []checkResult{checkStore(st)}
+		if wsTeamIDs, err := st.Workspaces(); err != nil {
+			storeChecks = append(storeChecks, checkResult{Error: "listing workspaces: " + err.Error()})
+		} else {
+			for _, teamID := range wsTeamIDs {
+				ws, err := st.Workspace(teamID)
+				if err != nil {
+					storeChecks = append(storeChecks, labelled(teamID, checkResult{Error: err.Error()}))
+					continue
+				}
+				storeChecks = append(storeChecks, labelled(teamID, checkStore(ws)))
+			}
+		}
+		checks["store"] = combine(storeChecks)
+
+		var auth, sync []checkResult
+		h.mu.Lock()
+		teamIDs := make([]string, 0, len(h.workspaces))
+		for teamID := range h.workspaces {
+			teamIDs = append(teamIDs, teamID)
+		}
+		sort.Strings(teamIDs)
+		states := make([]*State, len(teamIDs))
+		for i, teamID := range teamIDs {
+			states[i] = h.workspaces[teamID]
+		}
+		h.mu.Unlock()
+
+		teamIDs = append([]string{""}, teamIDs...)
+		for i, state := range append([]*State{h}, states...) {
+			authCheck, syncCheck := state.checks()
+			if authCheck != nil {
+				auth = append(auth, labelled(teamIDs[i], *authCheck))
+			}
+			if syncCheck != nil {
+				sync = append(sync, labelled(teamIDs[i], *syncCheck))
+			}
+		}
+		if len(auth) > 0 {
+			checks["slack_auth"] = combine(auth)
+		}
+		if len(sync) > 0 {
+			checks["sync"] = combine(sync)
+		}
+
+		status, code := "ok", http.StatusOK
+		for _, check := range checks {
+			if !check.OK {
+				status, code = "unavailable", http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+	}
+}
+
+// Whether the data a workspace needs to run can be read
+func checkStore(st *store.Store) checkResult {
+	if _, err := st.ReadTeams(); err != nil {
+		return checkResult{Error: "reading teams: " + err.Error()}
+	}
+	if _, err := st.ReadUsers(); err != nil {
+		return checkResult{Error: "reading users: " + err.Error()}
+	}
+	if _, err := st.ReadChannels(); err != nil {
+		return checkResult{Error: "reading channels: " + err.Error()}
+	}
+	return checkResult{OK: true}
+}
+
+// The auth and sync checks of one state, or nil for the ones that haven't
+// run yet
+func (h *State) checks() (auth, sync *checkResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.authCheckedAt.IsZero() {
+		auth = &checkResult{OK: h.authOK, Error: h.authError}
+	}
+
+	// A sync pass may take a while, so only call the loop stuck once it has
+	// been quiet for a full interval plus the stall timeout
+	if !h.syncHeartbeat.IsZero() {
+		sync = &checkResult{OK: true}
+		if since := time.Since(h.syncHeartbeat); since > h.syncInterval+h.syncStallTimeout {
+			sync = &checkResult{Error: "no sync progress for " + since.Round(time.Second).String()}
+		}
+	}
+	return auth, sync
+}
+
+// Prefix a failed check's error with the workspace it came from
+func labelled(teamID string, check checkResult) checkResult {
+	if !check.OK && teamID != "" {
+		check.Error = teamID + ": " + check.Error
+	}
+	return check
+}
+
+// A check that passes only if all of the checks pass
+func combine(checks []checkResult) checkResult {
+	var errors []string
+	for _, check := range checks {
+		if !check.OK {
+			errors = append(errors, check.Error)
+		}
+	}
+	if len(errors) > 0 {
+		return checkResult{Error: strings.Join(errors, "; ")}
+	}
+	return checkResult{OK: true}
+}
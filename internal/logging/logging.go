@@ -0,0 +1,152 @@
+// Package logging sets up structured logging with request IDs and redaction.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Attributes with these keys never make it into the logs as is.
+// Slack user IDs are fine to log, names and emails are not.
+var redactedKeys = map[string]bool{
+	"token":          true,
+	"bot_token":      true,
+	"response_url":   true,
+	"signing_secret": true,
+	"secret":         true,
+	"client_secret":  true,
+	"secrets_key":    true,
+	"trigger_id":     true,
+	"email":          true,
+	"name":           true,
+	"display_name":   true,
+	"real_name":      true,
+	"user_name":      true,
+}
+
+// Slack tokens look like xoxb-..., xoxp-..., xapp-... and may turn up inside other values
+var slackTokenPattern = regexp.MustCompile(`\b(xox[abposr]|xapp)-[A-Za-z0-9-]+`)
+
+const redacted = "[REDACTED]"
+
+// Setup makes a logger with the given level and format the default
+func Setup(level, format string) {
+	slog.SetDefault(slog.New(NewHandler(os.Stderr, level, format)))
+}
+
+// NewHandler creates a log handler writing text or JSON to w.
+// It redacts secrets and adds the request ID from the context to every record.
+func NewHandler(w io.Writer, level, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level:       parseLogLevel(level),
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return contextHandler{handler}
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Replace sensitive attributes before they are written
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := a.Value.String(); slackTokenPattern.MatchString(s) {
+			return slog.String(a.Key, slackTokenPattern.ReplaceAllString(s, redacted))
+		}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok && slackTokenPattern.MatchString(err.Error()) {
+			return slog.String(a.Key, slackTokenPattern.ReplaceAllString(err.Error(), redacted))
+		}
+	}
+	return a
+}
+
+// contextHandler adds the request ID from the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the context carrying a request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID gets the request ID from a context, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID generates a new random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Middleware gives every request an ID, reusing the caller's
+// X-Request-Id if there is one, and echoes it back in the response
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = NewRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// Fatal logs an error and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
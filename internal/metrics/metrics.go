@@ -0,0 +1,264 @@
+// Package metrics exposes Prometheus metrics.
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"slack-connect-manager/internal/store"
+)
+
+// This is a tiny Prometheus registry. We only need a handful of counters and
+// histograms, so we write the text exposition format ourselves instead
+// of pulling in the full client library.
+
+// The buckets used for all latency histograms, in seconds
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	CommandsTotal = NewCounterVec("connect_commands_total",
+		"Number of /connect commands received, by action.", "action")
+	SlackRequestsTotal = NewCounterVec("connect_slack_api_requests_total",
+		"Number of Slack API calls, by method.", "method")
+	SlackErrorsTotal = NewCounterVec("connect_slack_api_errors_total",
+		"Number of failed Slack API calls, by method.", "method")
+	SlackLatency = NewHistogramVec("connect_slack_api_duration_seconds",
+		"Latency of Slack API calls, by method.", "method", latencyBuckets)
+	APIRequestsTotal = NewCounterVec("connect_api_requests_total",
+		"Number of REST API requests, by route.", "route")
+	WebhookDeliveriesTotal = NewCounterVec("connect_webhook_deliveries_total",
+		"Number of webhook delivery attempts, by result (success, failure or dropped).", "result")
+	SyncDuration = NewHistogramVec("connect_sync_duration_seconds",
+		"Time taken to sync the members of a tracked channel, by channel.", "channel", latencyBuckets)
+)
+
+// CounterVec is a counter split by the value of a single label
+type CounterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+// Inc adds one to the counter for a label value
+func (c *CounterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, lv := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %g\n", c.name, c.label, escapeLabel(lv), c.values[lv])
+	}
+}
+
+// HistogramVec is a histogram split by the value of a single label
+type HistogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	return &HistogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// Observe records a value for a label value
+func (h *HistogramVec) Observe(labelValue string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := make([]string, 0, len(h.series))
+	for lv := range h.series {
+		labels = append(labels, lv)
+	}
+	sort.Strings(labels)
+
+	for _, lv := range labels {
+		s := h.series[lv]
+		label := fmt.Sprintf("%s=\"%s\"", h.label, escapeLabel(lv))
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", h.name, label, upper, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, label, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+// The gauges counting the stored data, read fresh on every scrape
+var dataGauges = []struct {
+	name, help string
+	count      func(st *store.Store) (int, error)
+}{
+	{"connect_teams", "Number of teams, by workspace.", func(st *store.Store) (int, error) {
+		teams, err := st.ReadTeams()
+		return len(teams.Teams), err
+	}},
+	{"connect_users", "Number of known users, by workspace.", func(st *store.Store) (int, error) {
+		users, err := st.ReadUsers()
+		return len(users), err
+	}},
+	{"connect_channels", "Number of tracked channels, by workspace.", func(st *store.Store) (int, error) {
+		channels, err := st.ReadChannels()
+		return len(channels), err
+	}},
+}
+
+// Write the data gauges for the top-level data, which has no team_id, and
+// for each workspace's data, labelled with its team ID
+func writeDataGauges(w io.Writer, st *store.Store) {
+	teamIDs, err := st.Workspaces()
+	if err != nil {
+		slog.Error("Error listing workspaces for metrics", "error", err)
+	}
+	stores := []*store.Store{st}
+	labels := []string{""}
+	for _, teamID := range teamIDs {
+		ws, err := st.Workspace(teamID)
+		if err != nil {
+			continue
+		}
+		stores = append(stores, ws)
+		labels = append(labels, fmt.Sprintf("{team_id=\"%s\"}", escapeLabel(teamID)))
+	}
+
+	for _, g := range dataGauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for i, s := range stores {
+			if n, err := g.count(s); err == nil {
+				fmt.Fprintf(w, "%s%s %d\n", g.name, labels[i], n)
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// Handler serves all metrics in the Prometheus text format
+func Handler(st *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+
+		CommandsTotal.write(&buf)
+		SlackRequestsTotal.write(&buf)
+		SlackErrorsTotal.write(&buf)
+		SlackLatency.write(&buf)
+		SyncDuration.write(&buf)
+		APIRequestsTotal.write(&buf)
+		WebhookDeliveriesTotal.write(&buf)
+
+		writeDataGauges(&buf, st)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	}
+}
+
+// Transport wraps the HTTP transport used by the Slack client to
+// record the latency and errors of every Slack API call by method
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := path.Base(req.URL.Path)
+	if !strings.Contains(req.URL.Path, "/api/") {
+		// File uploads and downloads have a different URL for every file
+		method = "files"
+	}
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+
+	elapsed := time.Since(start)
+
+	SlackRequestsTotal.Inc(method)
+	SlackLatency.Observe(method, elapsed.Seconds())
+	slog.DebugContext(req.Context(), "Slack API call", "method", method, "duration", elapsed)
+
+	if err != nil {
+		SlackErrorsTotal.Inc(method)
+		return resp, err
+	}
+	if resp.StatusCode >= 400 {
+		SlackErrorsTotal.Inc(method)
+		return resp, nil
+	}
+
+	// Slack reports most errors as {"ok": false} with a 200 status,
+	// so peek at the body and hand an identical copy back to the client
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		SlackErrorsTotal.Inc(method)
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var result struct {
+		OK *bool `json:"ok"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.OK != nil && !*result.OK {
+		SlackErrorsTotal.Inc(method)
+	}
+	return resp, nil
+}
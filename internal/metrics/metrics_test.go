@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"slack-connect-manager/internal/store"
+)
+
+func TestCounterFormat(t *testing.T) {
+	c := NewCounterVec("test_total", "Things counted, by kind.", "kind")
+	c.Inc("b")
+	c.Inc("a")
+	c.Inc("a")
+	c.Inc("say \"hi\"\n\\")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP test_total Things counted, by kind.
+# TYPE test_total counter
+test_total{kind="a"} 2
+test_total{kind="b"} 1
+test_total{kind="say \"hi\"\n\\"} 1
+`
+	if buf.String() != want {
+		t.Errorf("counter output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramFormat(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "Time taken, by step.", "step", []float64{0.1, 1})
+	h.Observe("load", 0.05)
+	h.Observe("load", 0.5)
+	h.Observe("load", 2)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP test_seconds Time taken, by step.
+# TYPE test_seconds histogram
+test_seconds_bucket{step="load",le="0.1"} 1
+test_seconds_bucket{step="load",le="1"} 2
+test_seconds_bucket{step="load",le="+Inf"} 3
+test_seconds_sum{step="load"} 2.55
+test_seconds_count{step="load"} 3
+`
+	if buf.String() != want {
+		t.Errorf("histogram output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	st := store.New(t.TempDir())
+	if err := st.EnsureFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WriteTeams(store.Teams{Teams: map[string]store.Team{"acme": {}, "globex": {}}}); err != nil {
+		t.Fatal(err)
+	}
+	ws, err := st.Workspace("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteTeams(store.Teams{Teams: map[string]store.Team{"initech": {}}}); err != nil {
+		t.Fatal(err)
+	}
+	CommandsTotal.Inc("help")
+
+	rec := httptest.NewRecorder()
+	Handler(st)(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE connect_commands_total counter\n",
+		`connect_commands_total{action="help"} `,
+		"# TYPE connect_slack_api_duration_seconds histogram\n",
+		"# TYPE connect_teams gauge\nconnect_teams 2\nconnect_teams{team_id=\"T1\"} 1\n",
+		"connect_users 0\n",
+		"connect_channels 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestTransportCountsErrors(t *testing.T) {
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/conversations.info":
+			w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+		case "/api/users.info":
+			w.Write([]byte(`{"ok":true}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer slack.Close()
+	client := &http.Client{Transport: &Transport{Base: http.DefaultTransport}}
+
+	count := func(c *CounterVec, method string) float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.values[method]
+	}
+	tests := []struct {
+		path, method string
+		wantErrors   float64
+	}{
+		{path: "/api/users.info", method: "users.info", wantErrors: 0},
+		{path: "/api/conversations.info", method: "conversations.info", wantErrors: 1},
+		{path: "/api/chat.postMessage", method: "chat.postMessage", wantErrors: 1},
+	}
+	for _, tt := range tests {
+		requests, errors := count(SlackRequestsTotal, tt.method), count(SlackErrorsTotal, tt.method)
+		resp, err := client.Get(slack.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if got := count(SlackRequestsTotal, tt.method) - requests; got != 1 {
+			t.Errorf("%s: counted %g requests, want 1", tt.method, got)
+		}
+		if got := count(SlackErrorsTotal, tt.method) - errors; got != tt.wantErrors {
+			t.Errorf("%s: counted %g errors, want %g", tt.method, got, tt.wantErrors)
+		}
+		// The client still gets the whole body after the transport peeked at it
+		if resp.StatusCode == http.StatusOK && !strings.HasPrefix(string(body), `{"ok":`) {
+			t.Errorf("%s: body = %q", tt.method, body)
+		}
+	}
+}
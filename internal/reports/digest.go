@@ -0,0 +1,247 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+// The time format used in the digest
+const digestTime = "2006-01-02"
+
+// OwnedTeams returns the teams each owner owns, by owner. Owners that
+// aren't user IDs, e.g. names typed without mentioning the user, can't be
+// sent a digest and are left out.
+func OwnedTeams(teams store.Teams) map[string][]string {
+	owned := make(map[string][]string)
+	for name, team := range teams.Teams {
+		for _, owner := range team.Owners {
+			if slackapi.IsUserID(owner) {
+				owned[owner] = append(owned[owner], name)
+			}
+		}
+	}
+	for _, names := range owned {
+		sort.Strings(names)
+	}
+	return owned
+}
+
+// BuildDigest sums up what happened to some teams and the tracked channels
+// in the week before a time: who was added to and removed from each team,
+// who joined and left tracked channels, the members in no tracked channel,
+// and the channels that were renamed or archived. It reports false if
+// nothing happened and no member needs looking at.
+func BuildDigest(st *store.Store, teamNames []string, now time.Time) (string, bool, error) {
+	teams, err := st.ReadTeams()
+	if err != nil {
+		return "", false, err
+	}
+	users, err := st.ReadUsers()
+	if err != nil {
+		return "", false, err
+	}
+	channels, err := st.ReadChannels()
+	if err != nil {
+		return "", false, err
+	}
+	memberships, err := st.ReadMemberships()
+	if err != nil {
+		return "", false, err
+	}
+	audit, err := st.ReadAudit()
+	if err != nil {
+		return "", false, err
+	}
+
+	from := now.Add(-Every)
+	var events []webhooks.Event
+	for _, entry := range audit.Since(from) {
+		var event webhooks.Event
+		if err := json.Unmarshal(entry.Payload, &event); err != nil {
+			slog.Warn("Skipping unreadable audit log entry", "event", entry.Event, "error", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	followRenames(events)
+
+	lines := []string{fmt.Sprintf("*Weekly digest, %s to %s*", from.Format(digestTime), now.Format(digestTime))}
+	anything := false
+	for _, team := range teamNames {
+		section := teamDigest(teams, users, channels, memberships, events, team)
+		lines = append(lines, fmt.Sprintf("*Team %s*", team))
+		if len(section) == 0 {
+			lines = append(lines, "Nothing changed this week.")
+			continue
+		}
+		lines = append(lines, section...)
+		anything = true
+	}
+
+	var channelLines []string
+	for _, event := range events {
+		switch event.Type {
+		case webhooks.ChannelRenamed:
+			channelLines = append(channelLines, fmt.Sprintf("• #%s was renamed to #%s", event.PreviousName, event.Channel.Name))
+		case webhooks.ChannelArchived:
+			channelLines = append(channelLines, fmt.Sprintf("• #%s was archived", event.Channel.Name))
+		}
+	}
+	if len(channelLines) > 0 {
+		lines = append(lines, "*Tracked channels*")
+		lines = append(lines, channelLines...)
+		anything = true
+	}
+	return strings.Join(lines, "\n"), anything, nil
+}
+
+// The lines of the digest about one team, empty if there's nothing to say
+func teamDigest(teams store.Teams, users store.Users, channels store.Channels, memberships store.Memberships, events []webhooks.Event, team string) []string {
+	members := teams.Members(team)
+	inTeam := make(map[string]bool)
+	names := make(map[string]string)
+	for _, member := range members {
+		inTeam[member.MemberID] = true
+		names[member.MemberID] = member.Name
+	}
+	label := func(member *webhooks.Member) string {
+		name := member.Name
+		if name == "" {
+			name = names[member.ID]
+		}
+		if name == "" {
+			name = users[member.ID].Name
+		}
+		if name == "" {
+			return member.ID
+		}
+		return fmt.Sprintf("%s (%s)", name, member.ID)
+	}
+
+	var added, removed, joined, left []string
+	for _, event := range events {
+		switch {
+		case event.Member == nil:
+		case event.Type == webhooks.MemberAdded && event.Team == team:
+			added = append(added, label(event.Member))
+		case event.Type == webhooks.MemberRemoved && event.Team == team:
+			removed = append(removed, label(event.Member))
+		case event.Type == webhooks.ChannelMemberJoined && inTeam[event.Member.ID]:
+			joined = append(joined, fmt.Sprintf("%s in #%s", label(event.Member), event.Channel.Name))
+		case event.Type == webhooks.ChannelMemberLeft && inTeam[event.Member.ID]:
+			left = append(left, fmt.Sprintf("%s in #%s", label(event.Member), event.Channel.Name))
+		}
+	}
+
+	// Members the sync doesn't see in any tracked channel, with when they last were
+	var outside []string
+	for _, member := range members {
+		if inTrackedChannel(member.Channels, channels) || inTrackedChannel(users[member.MemberID].Channels, channels) {
+			continue
+		}
+		var lastSeen time.Time
+		for channelID := range channels {
+			if seen := memberships[channelID][member.MemberID].LastSeen; seen.After(lastSeen) {
+				lastSeen = seen
+			}
+		}
+		text := label(&webhooks.Member{ID: member.MemberID}) + ", never seen"
+		if !lastSeen.IsZero() {
+			text = label(&webhooks.Member{ID: member.MemberID}) + ", last seen " + lastSeen.Format(digestTime)
+		}
+		outside = append(outside, text)
+	}
+
+	var lines []string
+	for _, part := range []struct {
+		heading string
+		items   []string
+	}{
+		{"Added to the team", added},
+		{"Removed from the team", removed},
+		{"Joined tracked channels", joined},
+		{"Left tracked channels", left},
+		{"In no tracked channel", outside},
+	} {
+		if len(part.items) > 0 {
+			lines = append(lines, fmt.Sprintf("• %s: %s", part.heading, strings.Join(part.items, "; ")))
+		}
+	}
+	return lines
+}
+
+// Change the team of each event to the name the team has now, so what
+// happened before a rename still shows up under the renamed team. Going
+// from the newest event back, each rename maps the old name to the new one
+// for the events before it, so a name that's reused later isn't mixed up.
+func followRenames(events []webhooks.Event) {
+	current := make(map[string]string)
+	for i := len(events) - 1; i >= 0; i-- {
+		if name, renamed := current[events[i].Team]; renamed {
+			events[i].Team = name
+		}
+		if events[i].Type == webhooks.TeamRenamed && events[i].PreviousName != "" {
+			current[events[i].PreviousName] = events[i].Team
+		}
+	}
+}
+
+// Send each team owner the digest of the teams they own
+func (r *Reporter) sendDigests(ctx context.Context, now time.Time) {
+	teams, err := r.store.ReadTeams()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading teams", "error", err)
+		return
+	}
+
+	owned := OwnedTeams(teams)
+	owners := make([]string, 0, len(owned))
+	for owner := range owned {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	sent := 0
+	for _, owner := range owners {
+		text, anything, err := BuildDigest(r.store, owned[owner], now)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error building digest", "user_id", owner, "error", err)
+			return
+		}
+		if !anything {
+			continue
+		}
+		dm, _, _, err := r.slack.OpenConversationContext(ctx, &slack.OpenConversationParameters{Users: []string{owner}})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error opening DM", "user_id", owner, "error", err)
+			continue
+		}
+		if _, _, err := r.slack.PostMessageContext(ctx, dm.ID, slack.MsgOptionText(text, false)); err != nil {
+			slog.ErrorContext(ctx, "Error sending digest", "user_id", owner, "error", err)
+			continue
+		}
+		sent++
+	}
+	slog.InfoContext(ctx, "Sent weekly digests", "owners", len(owners), "sent", sent)
+}
+
+// Whether any of a member's channels, as of the last sync, is tracked
+func inTrackedChannel(memberChannels map[string]string, channels store.Channels) bool {
+	for channelID := range memberChannels {
+		if _, tracked := channels[channelID]; tracked {
+			return true
+		}
+	}
+	return false
+}
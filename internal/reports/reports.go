@@ -0,0 +1,185 @@
+// Package reports posts the scheduled reports of a workspace to Slack: the
+// weekly activity report and the team owners' weekly digest. When each
+// report was last sent is kept in the data store, so restarts don't send
+// them again early.
+package reports
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/logging"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+)
+
+// Every is how often each report is sent
+const Every = 7 * 24 * time.Hour
+
+// InactiveAfter is how long a team member can go without posting before
+// the activity report lists them for review
+const InactiveAfter = 30 * 24 * time.Hour
+
+// How often the loop checks whether a report is due
+const checkInterval = time.Hour
+
+// Reporter sends a workspace's reports when they're due
+type Reporter struct {
+	// Cancelled when the server shuts down, which stops the reports
+	ctx   context.Context
+	store *store.Store
+	slack slackapi.Client
+	wg    sync.WaitGroup
+}
+
+// New creates a reporter. Reports are only sent once Start is called.
+func New(ctx context.Context, st *store.Store, client slackapi.Client) *Reporter {
+	return &Reporter{ctx: ctx, store: st, slack: client}
+}
+
+// Start runs the report loop in the background
+func (r *Reporter) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.run()
+	}()
+}
+
+// Wait blocks until the report loop has stopped
+func (r *Reporter) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Reporter) run() {
+	for {
+		r.SendDue(logging.WithRequestID(r.ctx, logging.NewRequestID()), time.Now())
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(checkInterval):
+		}
+	}
+}
+
+// SendDue sends the reports that are due at a time. A report is marked as
+// sent before it's posted, so one that fails isn't retried until the next week.
+func (r *Reporter) SendDue(ctx context.Context, now time.Time) {
+	var channelID string
+	var digest bool
+	err := r.store.Update(func() error {
+		reports, err := r.store.ReadReports()
+		if err != nil {
+			return err
+		}
+		changed := false
+		if reports.ActivityChannel != "" && now.Sub(reports.ActivitySentAt) >= Every {
+			channelID = reports.ActivityChannel
+			reports.ActivitySentAt = now
+			changed = true
+		}
+		if !reports.DigestOff {
+			switch {
+			case reports.DigestSentAt.IsZero():
+				// The first digest goes out a week after the digests start
+				reports.DigestSentAt = now
+				changed = true
+			case now.Sub(reports.DigestSentAt) >= Every:
+				digest = true
+				reports.DigestSentAt = now
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return r.store.WriteReports(reports)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading reports", "error", err)
+		return
+	}
+	if channelID != "" {
+		r.postActivityReport(ctx, channelID, now)
+	}
+	if digest {
+		r.sendDigests(ctx, now)
+	}
+}
+
+// Post the activity report to a channel
+func (r *Reporter) postActivityReport(ctx context.Context, channelID string, now time.Time) {
+	text, err := r.ActivityReport(now)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error building activity report", "error", err)
+		return
+	}
+	if _, _, err := r.slack.PostMessageContext(ctx, channelID, slack.MsgOptionText(text, false)); err != nil {
+		slog.ErrorContext(ctx, "Error posting activity report", "channel_id", channelID, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "Posted activity report", "channel_id", channelID)
+}
+
+// ActivityReport sums up each team's messages in the tracked channels over
+// the week before a time, and lists the members who haven't posted in
+// InactiveAfter
+func (r *Reporter) ActivityReport(now time.Time) (string, error) {
+	teams, err := r.store.ReadTeams()
+	if err != nil {
+		return "", err
+	}
+	channels, err := r.store.ReadChannels()
+	if err != nil {
+		return "", err
+	}
+	activity, err := r.store.ReadActivity()
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(teams.Teams))
+	for name := range teams.Teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"*Weekly activity report*"}
+	for _, team := range names {
+		week := activity.Engagement(teams, team, channels, now.Add(-Every))
+		if len(week) == 0 {
+			continue
+		}
+		messages, active := 0, 0
+		for _, member := range week {
+			messages += member.Messages
+			if member.Messages > 0 {
+				active++
+			}
+		}
+		line := fmt.Sprintf("%s: %d message(s) from %d of %d member(s) this week.", team, messages, active, len(week))
+
+		var inactive []string
+		for _, member := range week {
+			if now.Sub(member.LastActive) >= InactiveAfter {
+				inactive = append(inactive, fmt.Sprintf("%s (%s)", member.Name, member.MemberID))
+			}
+		}
+		if len(inactive) > 0 {
+			sort.Strings(inactive)
+			line += fmt.Sprintf(" Nothing posted in %d days: %s.", InactiveAfter/(24*time.Hour), strings.Join(inactive, ", "))
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 1 {
+		lines = append(lines, "There are no teams with members yet.")
+	}
+	return strings.Join(lines, "\n"), nil
+}
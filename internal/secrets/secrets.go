@@ -0,0 +1,237 @@
+// Package secrets encrypts the secrets the app keeps: bot tokens, signing
+// secrets and webhook secrets. Each secret is encrypted with its own random
+// data key, and the data key is encrypted with the master key, so the
+// master key itself never encrypts much data.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Prefix marks an encrypted value. Anything without it is plaintext.
+const Prefix = "enc:v1:"
+
+// KeySize is the length of a master key in bytes. Keys are written as base64.
+const KeySize = 32
+
+// ErrNoKey is returned when decrypting without a master key
+var ErrNoKey = errors.New("the value is encrypted but no secrets key is configured")
+
+// Keyring encrypts with its primary key and decrypts with any of its keys.
+// A nil Keyring leaves values in plaintext.
+type Keyring struct {
+	primary *masterKey
+	keys    map[string]*masterKey
+}
+
+type masterKey struct {
+	// Short fingerprint of the key, stored with each value so we know which key to use
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyring creates a keyring that encrypts with primary. Values encrypted
+// with any of the older keys can still be decrypted.
+func NewKeyring(primary []byte, older ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*masterKey)}
+	for i, raw := range append([][]byte{primary}, older...) {
+		key, err := newMasterKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.primary = key
+		}
+		k.keys[key.id] = key
+	}
+	return k, nil
+}
+
+// Rotate returns a keyring that encrypts with primary and can still decrypt
+// everything k can, so secrets can be moved to a new key one at a time
+func (k *Keyring) Rotate(primary []byte) (*Keyring, error) {
+	rotated, err := NewKeyring(primary)
+	if err != nil {
+		return nil, err
+	}
+	if k != nil {
+		for id, key := range k.keys {
+			if _, ok := rotated.keys[id]; !ok {
+				rotated.keys[id] = key
+			}
+		}
+	}
+	return rotated, nil
+}
+
+func newMasterKey(raw []byte) (*masterKey, error) {
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("secrets keys must be %d bytes, got %d", KeySize, len(raw))
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// ParseKey decodes a base64 master key, e.g. from GenerateKey
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("secrets key isn't valid base64: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secrets keys must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads a base64 master key from a file
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(data))
+}
+
+// GenerateKey returns a new random master key as base64
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// IsEncrypted reports whether a value was encrypted by a Keyring
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// KeyID returns the fingerprint of the primary key, or "" for a nil Keyring
+func (k *Keyring) KeyID() string {
+	if k == nil {
+		return ""
+	}
+	return k.primary.id
+}
+
+// Encrypt encrypts a value with the primary key. Empty values and a nil
+// Keyring leave the value as it is.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if k == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.primary.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return Prefix + k.primary.id + ":" + encode(wrapped) + ":" + encode(ciphertext), nil
+}
+
+// Decrypt decrypts a value from Encrypt. Plaintext values are returned as
+// they are, so secrets stored before a key was configured keep working.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrNoKey
+	}
+
+	key, wrapped, ciphertext, err := k.parse(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := open(key.aead, wrapped)
+	if err != nil {
+		return "", errors.New("the value can't be decrypted with the secrets key")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext)
+	if err != nil {
+		return "", errors.New("the encrypted value is corrupt")
+	}
+	return string(plaintext), nil
+}
+
+// Split an encrypted value into the key it's under, the wrapped data key and the ciphertext
+func (k *Keyring) parse(value string) (key *masterKey, wrapped, ciphertext []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, Prefix), ":")
+	if len(parts) != 3 {
+		return nil, nil, nil, errors.New("the encrypted value is malformed")
+	}
+	key, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("the value is encrypted with key %s, which isn't configured", parts[0])
+	}
+	if wrapped, err = decode(parts[1]); err != nil {
+		return nil, nil, nil, errors.New("the encrypted value is malformed")
+	}
+	if ciphertext, err = decode(parts[2]); err != nil {
+		return nil, nil, nil, errors.New("the encrypted value is malformed")
+	}
+	return key, wrapped, ciphertext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt with a random nonce, which is kept in front of the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
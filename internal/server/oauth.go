@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+)
+
+// The cookie holding the state of an install in progress. Slack hands the
+// state back to the callback, which proves the install was started here.
+const (
+	stateCookie    = "connect_oauth_state"
+	stateCookieAge = 10 * time.Minute
+)
+
+// Send the user to Slack to install the app in their workspace
+func (s *Server) handleInstall(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		slog.ErrorContext(ctx, "Error generating OAuth state", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    hex.EncodeToString(state),
+		Path:     "/slack/",
+		MaxAge:   int(stateCookieAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(s.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	slog.InfoContext(ctx, "Starting an install")
+	http.Redirect(w, r, slackapi.InstallURL(s.ClientID, s.RedirectURL, hex.EncodeToString(state)), http.StatusFound)
+}
+
+// Finish an install: trade the code for a bot token and start serving the workspace
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	// The user cancelled on Slack's side
+	if reason := query.Get("error"); reason != "" {
+		slog.InfoContext(ctx, "Install was not completed", "reason", reason)
+		installPage(w, http.StatusBadRequest, "The app was not installed: "+reason)
+		return
+	}
+
+	cookie, err := r.Cookie(stateCookie)
+	state := query.Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		slog.WarnContext(ctx, "Rejected install with a missing or wrong state")
+		installPage(w, http.StatusBadRequest, "This install link has expired. Please start again from /slack/install.")
+		return
+	}
+	// The state is only good for one install
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/slack/", MaxAge: -1})
+
+	code := query.Get("code")
+	if code == "" {
+		installPage(w, http.StatusBadRequest, "Slack didn't send an install code.")
+		return
+	}
+
+	resp, err := slackapi.ExchangeOAuthCode(ctx, s.SlackAPIURL, s.ClientID, s.ClientSecret, code, s.RedirectURL)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error exchanging OAuth code", "error", err)
+		installPage(w, http.StatusBadGateway, "Slack didn't accept the install. Please try again.")
+		return
+	}
+	if resp.IsEnterpriseInstall || resp.Team.ID == "" {
+		slog.WarnContext(ctx, "Rejected an org wide install", "enterprise_id", resp.Enterprise.ID)
+		installPage(w, http.StatusBadRequest, "The app can only be installed in a single workspace, not across an organization.")
+		return
+	}
+
+	ws, err := s.Workspaces.Install(store.Installation{
+		TeamID:      resp.Team.ID,
+		TeamName:    resp.Team.Name,
+		BotToken:    resp.AccessToken,
+		BotUserID:   resp.BotUserID,
+		Scope:       resp.Scope,
+		InstalledBy: resp.AuthedUser.ID,
+		InstalledAt: time.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error saving installation", "team_id", resp.Team.ID, "error", err)
+		installPage(w, http.StatusInternalServerError, "Error saving the installation. Please try again.")
+		return
+	}
+
+	installPage(w, http.StatusOK, fmt.Sprintf("Slack Connect Manager is installed in %s. Run /connect help in Slack to get started.", ws.TeamName))
+}
+
+// Tell the person installing the app how it went
+func installPage(w http.ResponseWriter, code int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, text)
+}
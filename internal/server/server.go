@@ -0,0 +1,311 @@
+// Package server serves the Slack endpoints and the monitoring endpoints over HTTP.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+
+	"slack-connect-manager/internal/api"
+	"slack-connect-manager/internal/commands"
+	"slack-connect-manager/internal/health"
+	"slack-connect-manager/internal/logging"
+	"slack-connect-manager/internal/metrics"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/syncer"
+	"slack-connect-manager/internal/workspace"
+)
+
+// Server holds what the HTTP handlers need
+type Server struct {
+	// Runs the commands when there is only one workspace
+	Router *commands.Router
+	// Handles channels being shared and unshared when there is only one workspace
+	Sync *syncer.Worker
+	// Runs the bot in every workspace. When set, commands and events go to the
+	// workspace they come from and Router isn't used.
+	Workspaces *workspace.Manager
+	// The data served by /readyz, /metrics and the REST API, which also reach
+	// the workspaces under it
+	Store  *store.Store
+	Health *health.State
+	// Used to verify requests to /slack/*. Verification is skipped if empty.
+	SigningSecret string
+	// Bearer tokens for the REST API under /api/v1/. The API is off if empty.
+	APITokens []string
+	// The app's OAuth credentials. Installing with /slack/install is off if empty.
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Base URL of the Slack API for the OAuth code exchange, only set for a fake Slack server
+	SlackAPIURL string
+}
+
+// Handler returns the HTTP handler with all routes set up
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack/events", slackapi.VerifySignature(s.SigningSecret, s.handleSlackEvent))
+	mux.HandleFunc("/slack/command", slackapi.VerifySignature(s.SigningSecret, s.handleSlackCommand))
+	if s.Workspaces != nil && s.ClientID != "" {
+		mux.HandleFunc("/slack/install", s.handleInstall)
+		mux.HandleFunc("/slack/oauth/callback", s.handleOAuthCallback)
+	}
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", s.Health.Readyz(s.Store))
+	mux.HandleFunc("/metrics", metrics.Handler(s.Store))
+	if len(s.APITokens) > 0 {
+		mux.Handle(api.Prefix, api.Handler(s.Store, s.APITokens))
+	}
+	return logging.Middleware(mux)
+}
+
+// Handle Slack events. Right now, it handles URL verification, messages,
+// members joining and leaving channels, channels being renamed, archived,
+// shared and unshared and the app being removed from a workspace
+func (s *Server) handleSlackEvent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	slog.InfoContext(ctx, "Received Slack event")
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// slack-go can't parse the Slack Connect sharing events
+	var sharing sharingEvent
+	if json.Unmarshal(body, &sharing) == nil && sharing.Type == slackevents.CallbackEvent &&
+		(sharing.Event.Type == "channel_shared" || sharing.Event.Type == "channel_unshared") {
+		s.handleSharingEvent(r, sharing)
+		return
+	}
+
+	ev, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error parsing Slack event", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if ev.Type == slackevents.URLVerification {
+		var r *slackevents.ChallengeResponse
+		err := json.Unmarshal([]byte(body), &r)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error unmarshalling challenge response", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text")
+		w.Write([]byte(r.Challenge))
+		slog.InfoContext(ctx, "Responded to URL verification challenge")
+		return
+	}
+
+	if ev.Type == slackevents.CallbackEvent {
+		s.handleCallbackEvent(r, ev)
+	}
+}
+
+// Handle an event from one of the workspaces
+func (s *Server) handleCallbackEvent(r *http.Request, ev slackevents.EventsAPIEvent) {
+	ctx := r.Context()
+	slog.DebugContext(ctx, "Received callback event", "team_id", ev.TeamID, "event", ev.InnerEvent.Type)
+
+	worker := s.Sync
+	if s.Workspaces != nil {
+		ws := s.Workspaces.Get(ev.TeamID)
+		if ws == nil {
+			slog.WarnContext(ctx, "Received an event from a workspace the app isn't running in", "team_id", ev.TeamID)
+			return
+		}
+		worker = ws.Sync
+	}
+
+	switch event := ev.InnerEvent.Data.(type) {
+	case *slackevents.MessageEvent:
+		if worker != nil {
+			worker.MessagePosted(ctx, event.Channel, event.User, event.SubType, event.BotID, event.TimeStamp)
+		}
+	case *slackevents.MemberLeftChannelEvent:
+		if worker != nil {
+			worker.MemberLeft(ctx, event.Channel, event.User)
+		}
+	case *slackevents.MemberJoinedChannelEvent:
+		if worker != nil {
+			worker.MemberJoined(ctx, event.Channel)
+		}
+	case *slackevents.ChannelRenameEvent:
+		if worker != nil {
+			worker.ChannelRenamed(ctx, event.Channel.ID, event.Channel.Name)
+		}
+	case *slackevents.GroupRenameEvent:
+		if worker != nil {
+			worker.ChannelRenamed(ctx, event.Channel.ID, event.Channel.Name)
+		}
+	case *slackevents.ChannelArchiveEvent:
+		if worker != nil {
+			worker.ChannelArchived(ctx, event.Channel)
+		}
+	case *slackevents.GroupArchiveEvent:
+		if worker != nil {
+			worker.ChannelArchived(ctx, event.Channel)
+		}
+	case *slackevents.AppUninstalledEvent, *slackevents.TokensRevokedEvent:
+		if s.Workspaces == nil {
+			slog.WarnContext(ctx, "App removed from the workspace, so the bot token no longer works", "event", ev.InnerEvent.Type)
+			return
+		}
+		slog.InfoContext(ctx, "App removed from workspace", "team_id", ev.TeamID, "event", ev.InnerEvent.Type)
+		if err := s.Workspaces.Uninstall(ev.TeamID); err != nil {
+			slog.ErrorContext(ctx, "Error uninstalling workspace", "team_id", ev.TeamID, "error", err)
+		}
+	}
+}
+
+// A channel_shared or channel_unshared event
+type sharingEvent struct {
+	Type   string `json:"type"`
+	TeamID string `json:"team_id"`
+	Event  struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		// The other organization's team, for channel_shared
+		ConnectedTeamID string `json:"connected_team_id"`
+		// The other organization's team, for channel_unshared
+		PreviouslyConnectedTeamID string `json:"previously_connected_team_id"`
+		// Whether the channel is still shared with someone, for channel_unshared
+		IsExtShared bool `json:"is_ext_shared"`
+	} `json:"event"`
+}
+
+// Record which organizations a channel is shared with, and with auto
+// discovery on, start tracking it
+func (s *Server) handleSharingEvent(r *http.Request, ev sharingEvent) {
+	ctx := r.Context()
+	slog.DebugContext(ctx, "Received callback event", "team_id", ev.TeamID, "event", ev.Event.Type)
+
+	// Slack retries events that weren't acknowledged in time. These are
+	// acknowledged straight away, so a retry is almost always for an event
+	// that is already being handled.
+	if retry := r.Header.Get("X-Slack-Retry-Num"); retry != "" {
+		slog.DebugContext(ctx, "Ignoring retried event", "event", ev.Event.Type, "retry", retry)
+		return
+	}
+
+	worker := s.Sync
+	if s.Workspaces != nil {
+		ws := s.Workspaces.Get(ev.TeamID)
+		if ws == nil {
+			slog.WarnContext(ctx, "Received an event from a workspace the app isn't running in", "team_id", ev.TeamID)
+			return
+		}
+		worker = ws.Sync
+	}
+	if worker == nil {
+		return
+	}
+
+	// Handling the event can take longer than Slack waits, so it's handled
+	// after the event is acknowledged
+	worker.InBackground(ctx, func(ctx context.Context) {
+		if ev.Event.Type == "channel_shared" {
+			worker.ChannelShared(ctx, ev.Event.Channel, ev.Event.ConnectedTeamID)
+		} else {
+			worker.ChannelUnshared(ctx, ev.Event.Channel, ev.Event.PreviouslyConnectedTeamID, ev.Event.IsExtShared)
+		}
+	})
+}
+
+// Handle all the Slack commands
+func (s *Server) handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	slog.DebugContext(ctx, "Received a request to /slack/command")
+
+	cmd, err := slack.SlashCommandParse(r)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error parsing slash command", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// We only care about /connect commands
+	if cmd.Command != "/connect" {
+		slog.WarnContext(ctx, "Received unknown command", "command", cmd.Command)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The rest of the text can hold emails, names and URLs, so it's only logged at debug level
+	action := "help"
+	if words := strings.Fields(cmd.Text); len(words) > 0 {
+		action = words[0]
+	}
+	slog.InfoContext(ctx, "Received /connect command",
+		"action", action, "user_id", cmd.UserID, "team_id", cmd.TeamID, "channel_id", cmd.ChannelID)
+	slog.DebugContext(ctx, "Command text", "text", cmd.Text)
+
+	router := s.Router
+	if s.Workspaces != nil {
+		ws := s.Workspaces.Get(cmd.TeamID)
+		if ws == nil {
+			slog.WarnContext(ctx, "Received a command from a workspace the app isn't running in", "team_id", cmd.TeamID)
+			writeResponse(w, r, commands.Failure("Slack Connect Manager isn't installed in this workspace yet. Ask an admin to install it."))
+			return
+		}
+		router = ws.Router
+	}
+
+	req := commands.Request{
+		UserID:      cmd.UserID,
+		TeamID:      cmd.TeamID,
+		ChannelID:   cmd.ChannelID,
+		ChannelName: cmd.ChannelName,
+	}
+	if cmd.ResponseURL != "" {
+		req.Respond = func(ctx context.Context, resp commands.Response) {
+			respondLater(ctx, cmd.ResponseURL, resp)
+		}
+	}
+	resp := router.Dispatch(ctx, cmd.Text, req)
+	writeResponse(w, r, resp)
+}
+
+// Used to post the responses of commands that finish in the background
+var responseClient = &http.Client{Timeout: 10 * time.Second}
+
+// Post the response of a command that finished after its request was
+// answered to the command's response_url
+func respondLater(ctx context.Context, responseURL string, resp commands.Response) {
+	if resp.Error {
+		slog.InfoContext(ctx, "Posting error response", "reason", resp.Text)
+	} else {
+		slog.DebugContext(ctx, "Posting success response")
+	}
+	err := slack.PostWebhookCustomHTTPContext(ctx, responseURL, responseClient, &slack.WebhookMessage{Text: resp.Text})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error posting command response", "error", err)
+	}
+}
+
+// Send a command's response back to Slack. Errors are still sent with a
+// 200 status so Slack shows the message to the user.
+func writeResponse(w http.ResponseWriter, r *http.Request, resp commands.Response) {
+	if resp.Error {
+		slog.InfoContext(r.Context(), "Sending error response", "reason", resp.Text)
+	} else {
+		slog.DebugContext(r.Context(), "Sending success response")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&slack.Msg{Text: resp.Text})
+}
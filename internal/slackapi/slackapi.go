@@ -0,0 +1,210 @@
+// Package slackapi wraps the parts of the Slack Web API the bot uses.
+package slackapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/metrics"
+)
+
+// Client is the subset of *slack.Client the bot calls. Anything that talks
+// to Slack takes this interface so tests can swap in something else.
+type Client interface {
+	AuthTestContext(ctx context.Context) (*slack.AuthTestResponse, error)
+	GetUserInfoContext(ctx context.Context, user string) (*slack.User, error)
+	GetUsersInConversationContext(ctx context.Context, params *slack.GetUsersInConversationParameters) ([]string, string, error)
+	GetConversationInfoContext(ctx context.Context, input *slack.GetConversationInfoInput) (*slack.Channel, error)
+	GetConversationsContext(ctx context.Context, params *slack.GetConversationsParameters) ([]slack.Channel, string, error)
+	GetConversationHistoryContext(ctx context.Context, params *slack.GetConversationHistoryParameters) (*slack.GetConversationHistoryResponse, error)
+	JoinConversationContext(ctx context.Context, channelID string) (*slack.Channel, string, []string, error)
+	InviteUsersToConversationContext(ctx context.Context, channelID string, users ...string) (*slack.Channel, error)
+	PostMessageContext(ctx context.Context, channelID string, options ...slack.MsgOption) (string, string, error)
+	GetUserByEmailContext(ctx context.Context, email string) (*slack.User, error)
+	OpenConversationContext(ctx context.Context, params *slack.OpenConversationParameters) (*slack.Channel, bool, bool, error)
+	UploadFileV2Context(ctx context.Context, params slack.UploadFileV2Parameters) (*slack.FileSummary, error)
+	GetFileInfoContext(ctx context.Context, fileID string, count, page int) (*slack.File, []slack.Comment, *slack.Paging, error)
+	GetFileContext(ctx context.Context, downloadURL string, writer io.Writer) error
+}
+
+// AuthorizeURL is where people are sent to install the app in their workspace
+const AuthorizeURL = "https://slack.com/oauth/v2/authorize"
+
+// BotScopes are the scopes the bot token needs for everything the bot calls
+var BotScopes = []string{
+	"commands",
+	"chat:write",
+	"im:write",
+	"users:read",
+	"users:read.email",
+	"channels:read",
+	"groups:read",
+	"channels:history",
+	"groups:history",
+	"channels:join",
+	"channels:manage",
+	"groups:write",
+	"files:read",
+	"files:write",
+}
+
+// New creates a Slack API client. apiURL is only set when talking to something
+// other than slack.com, like a fake Slack server in tests.
+// Every call goes through metrics.Transport so we can report Slack API latency and errors.
+func New(token, apiURL string) *slack.Client {
+	options := []slack.Option{slack.OptionHTTPClient(newHTTPClient())}
+	if apiURL != "" {
+		options = append(options, slack.OptionAPIURL(apiURL))
+	}
+	return slack.New(token, options...)
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &metrics.Transport{Base: http.DefaultTransport},
+		Timeout:   30 * time.Second,
+	}
+}
+
+// InstallURL returns the URL that starts installing the app in a workspace
+func InstallURL(clientID, redirectURI, state string) string {
+	params := url.Values{
+		"client_id": {clientID},
+		"scope":     {strings.Join(BotScopes, ",")},
+		"state":     {state},
+	}
+	if redirectURI != "" {
+		params.Set("redirect_uri", redirectURI)
+	}
+	return AuthorizeURL + "?" + params.Encode()
+}
+
+// ExchangeOAuthCode trades the code from an OAuth install for the
+// workspace's bot token. slack-go always sends this to slack.com, so we make
+// the call ourselves to also reach a fake Slack server through apiURL.
+func ExchangeOAuthCode(ctx context.Context, apiURL, clientID, clientSecret, code, redirectURI string) (*slack.OAuthV2Response, error) {
+	if apiURL == "" {
+		apiURL = slack.APIURL
+	}
+	form := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"code":          {code},
+	}
+	if redirectURI != "" {
+		form.Set("redirect_uri", redirectURI)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"oauth.v2.access", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := newHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth.v2.access returned %s", resp.Status)
+	}
+
+	var result slack.OAuthV2Response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DisplayName returns the name to show for a user: their display name if they set one
+func DisplayName(user *slack.User) string {
+	if user.Profile.DisplayName != "" {
+		return user.Profile.DisplayName
+	}
+	return user.Name
+}
+
+// ErrorCode returns the error Slack answered a call with, like
+// "users_not_found", or "" if the call failed some other way (a network
+// error, a timeout, a rate limit)
+func ErrorCode(err error) string {
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) {
+		return slackErr.Err
+	}
+	return ""
+}
+
+// IsUserID reports whether s looks like a Slack user ID, e.g. U0123ABCD or W0123ABCD
+func IsUserID(s string) bool {
+	return isID(s, "UW")
+}
+
+// IsChannelID reports whether s looks like a Slack channel ID, e.g.
+// C0123ABCD, or G0123ABCD for older private channels. Channel names can't
+// have capital letters, so a name never looks like one.
+func IsChannelID(s string) bool {
+	return isID(s, "CG")
+}
+
+// Whether s is one of the prefixes followed by capital letters and digits
+func isID(s, prefixes string) bool {
+	if len(s) < 2 || !strings.ContainsRune(prefixes, rune(s[0])) {
+		return false
+	}
+	for _, r := range s[1:] {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifySignature checks the X-Slack-Signature of a request against the signing secret.
+// Requests are let through unchecked if no signing secret is configured.
+func VerifySignature(secret string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			next(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading request body", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		verifier, err := slack.NewSecretsVerifier(r.Header, secret)
+		if err == nil {
+			verifier.Write(body)
+			err = verifier.Ensure()
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Rejected request with an invalid Slack signature", "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
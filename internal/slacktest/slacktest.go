@@ -0,0 +1,545 @@
+// Package slacktest provides an in-process fake of the Slack Web API for tests.
+package slacktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// FakeSlack is an in-process stand-in for the Slack Web API. It implements
+// just the methods the bot uses and records every call it receives.
+type FakeSlack struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// Users known to users.info, by ID
+	users map[string]User
+	// Members returned by conversations.members, by channel ID
+	members map[string][]string
+	// Channels known to conversations.info and conversations.list, by ID
+	channels map[string]Channel
+	// Messages returned by conversations.history, by channel ID
+	messages map[string][]Message
+	// Files known to files.info, by ID
+	files map[string]File
+	// Files uploaded with files.uploadV2, in order
+	uploads []Upload
+	// Installs oauth.v2.access hands out, by code
+	codes map[string]Install
+	// Installs by bot token, for answering as the right workspace
+	tokens map[string]Install
+	// Methods made to fail, by name
+	failures map[string]failure
+	// Every call, in order
+	calls []Call
+}
+
+// A method that answers with an error once it has been called enough times
+type failure struct {
+	after int
+	code  string
+}
+
+// User is a user known to the fake users.info
+type User struct {
+	ID          string
+	Name        string
+	DisplayName string
+	Email       string
+	IsBot       bool
+	// Workspace admins and owners
+	IsAdmin bool
+	IsOwner bool
+}
+
+// Channel is a channel known to conversations.info and conversations.list.
+// Its members are set with SetMembers.
+type Channel struct {
+	ID        string
+	Name      string
+	IsPrivate bool
+	// Shared with another organization with Slack Connect
+	IsShared bool
+	// The teams of the other organizations, if it's shared
+	SharedWith []string
+	IsArchived bool
+}
+
+// Message is a message in a channel's history
+type Message struct {
+	User string
+	// The message's timestamp, e.g. "1714564800.000100"
+	TS      string
+	SubType string
+	BotID   string
+}
+
+// File is a file shared in Slack that the bot can download
+type File struct {
+	ID      string
+	Name    string
+	Content string
+}
+
+// Upload is a file uploaded with files.uploadV2
+type Upload struct {
+	FileID   string
+	Filename string
+	Title    string
+	// The channel it was shared to
+	Channel string
+	Content string
+}
+
+// Install is a workspace the app gets installed in with OAuth. Calls made
+// with its bot token are answered as that workspace.
+type Install struct {
+	TeamID    string
+	TeamName  string
+	BotToken  string
+	BotUserID string
+}
+
+// Call is a recorded API call
+type Call struct {
+	Method string
+	Params map[string]string
+	// The token the call was made with
+	Token string
+}
+
+// New starts a fake Slack server that is closed when the test ends
+func New(t *testing.T) *FakeSlack {
+	f := &FakeSlack{
+		users:    make(map[string]User),
+		members:  make(map[string][]string),
+		channels: make(map[string]Channel),
+		messages: make(map[string][]Message),
+		files:    make(map[string]File),
+		codes:    make(map[string]Install),
+		tokens:   make(map[string]Install),
+		failures: make(map[string]failure),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// APIURL is the URL to pass to slack.OptionAPIURL
+func (f *FakeSlack) APIURL() string {
+	return f.server.URL + "/api/"
+}
+
+// AddUser makes a user known to users.info
+func (f *FakeSlack) AddUser(u User) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[u.ID] = u
+}
+
+// SetMembers sets the members conversations.members returns for a channel
+func (f *FakeSlack) SetMembers(channelID string, memberIDs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members[channelID] = memberIDs
+}
+
+// AddChannel makes a channel known to conversations.info and conversations.list
+func (f *FakeSlack) AddChannel(c Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels[c.ID] = c
+	if _, ok := f.members[c.ID]; !ok {
+		f.members[c.ID] = nil
+	}
+}
+
+// AddMessage adds a message to a channel's history
+func (f *FakeSlack) AddMessage(channelID string, m Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages[channelID] = append(f.messages[channelID], m)
+}
+
+// AddFile makes a file known to files.info and downloadable
+func (f *FakeSlack) AddFile(file File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[file.ID] = file
+}
+
+// AddInstall lets oauth.v2.access trade code for the install's bot token, once
+func (f *FakeSlack) AddInstall(code string, install Install) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.codes[code] = install
+	f.tokens[install.BotToken] = install
+}
+
+// Fail makes every call to method after the first `after` answer with the
+// error code, e.g. to have a lookup fail partway through a command
+func (f *FakeSlack) Fail(method string, after int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method] = failure{after: after, code: code}
+}
+
+// Uploads returns the files uploaded so far. Only uploads that were
+// completed with files.completeUploadExternal have a channel.
+func (f *FakeSlack) Uploads() []Upload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Upload(nil), f.uploads...)
+}
+
+// CallsTo returns all recorded calls to a method
+func (f *FakeSlack) CallsTo(method string) []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var calls []Call
+	for _, c := range f.calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func (f *FakeSlack) countCalls(method string) int {
+	n := 0
+	for _, c := range f.calls {
+		if c.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *FakeSlack) handle(w http.ResponseWriter, r *http.Request) {
+	// Files are uploaded and downloaded outside the API
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		f.handleUpload(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, "/files-pri/"):
+		f.handleDownload(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := path.Base(r.URL.Path)
+	params := make(map[string]string)
+	for k := range r.Form {
+		params[k] = r.Form.Get(k)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = params["token"]
+	}
+	f.calls = append(f.calls, Call{Method: method, Params: params, Token: token})
+
+	w.Header().Set("Content-Type", "application/json")
+	if fail, ok := f.failures[method]; ok && f.countCalls(method) > fail.after {
+		json.NewEncoder(w).Encode(slackError(fail.code))
+		return
+	}
+
+	var resp interface{}
+	switch method {
+	case "auth.test":
+		resp = map[string]interface{}{"ok": true, "user_id": "UBOT", "team_id": "T1", "team": "Test", "user": "connect-bot"}
+		if install, ok := f.tokens[token]; ok {
+			resp = map[string]interface{}{"ok": true, "user_id": install.BotUserID, "team_id": install.TeamID, "team": install.TeamName, "user": "connect-bot"}
+		}
+	case "oauth.v2.access":
+		install, ok := f.codes[params["code"]]
+		if !ok || params["client_id"] == "" || params["client_secret"] == "" {
+			resp = slackError("invalid_code")
+			break
+		}
+		// Codes can only be used once
+		delete(f.codes, params["code"])
+		resp = map[string]interface{}{
+			"ok":           true,
+			"access_token": install.BotToken,
+			"token_type":   "bot",
+			"scope":        "commands,chat:write",
+			"bot_user_id":  install.BotUserID,
+			"team":         map[string]string{"id": install.TeamID, "name": install.TeamName},
+			"authed_user":  map[string]string{"id": "UINSTALLER"},
+		}
+	case "users.info":
+		u, ok := f.users[params["user"]]
+		if !ok {
+			resp = slackError("user_not_found")
+			break
+		}
+		resp = map[string]interface{}{"ok": true, "user": userJSON(u)}
+	case "users.lookupByEmail":
+		resp = slackError("users_not_found")
+		for _, u := range f.users {
+			if u.Email != "" && strings.EqualFold(u.Email, params["email"]) {
+				resp = map[string]interface{}{"ok": true, "user": userJSON(u)}
+				break
+			}
+		}
+	case "conversations.open":
+		resp = map[string]interface{}{"ok": true, "channel": map[string]interface{}{"id": "D" + params["users"]}}
+	case "files.info":
+		file, ok := f.files[params["file"]]
+		if !ok {
+			resp = slackError("file_not_found")
+			break
+		}
+		resp = map[string]interface{}{"ok": true, "file": map[string]interface{}{
+			"id":                   file.ID,
+			"name":                 file.Name,
+			"url_private_download": f.server.URL + "/files-pri/" + file.ID + "/" + file.Name,
+		}}
+	case "files.getUploadURLExternal":
+		fileID := fmt.Sprintf("FUP%d", len(f.uploads)+1)
+		f.uploads = append(f.uploads, Upload{FileID: fileID, Filename: params["filename"]})
+		resp = map[string]interface{}{"ok": true, "file_id": fileID, "upload_url": f.server.URL + "/upload/" + fileID}
+	case "files.completeUploadExternal":
+		var summaries []map[string]string
+		if err := json.Unmarshal([]byte(params["files"]), &summaries); err != nil || len(summaries) != 1 {
+			resp = slackError("invalid_arguments")
+			break
+		}
+		resp = slackError("file_not_found")
+		for i, upload := range f.uploads {
+			if upload.FileID == summaries[0]["id"] {
+				f.uploads[i].Title = summaries[0]["title"]
+				f.uploads[i].Channel = params["channel_id"]
+				resp = map[string]interface{}{"ok": true, "files": summaries}
+			}
+		}
+	case "conversations.members":
+		members, ok := f.members[params["channel"]]
+		if !ok {
+			resp = slackError("channel_not_found")
+			break
+		}
+		resp = map[string]interface{}{"ok": true, "members": members, "response_metadata": map[string]string{"next_cursor": ""}}
+	case "conversations.info":
+		channelID := params["channel"]
+		if _, ok := f.members[channelID]; !ok {
+			resp = slackError("channel_not_found")
+			break
+		}
+		// Private channels are invisible to bots that aren't in them
+		if f.channels[channelID].IsPrivate && !f.isMember(channelID, f.botUserID(token)) {
+			resp = slackError("channel_not_found")
+			break
+		}
+		resp = map[string]interface{}{"ok": true, "channel": f.channelJSON(channelID, token)}
+	case "conversations.list":
+		types := strings.Split(params["types"], ",")
+		var list []map[string]interface{}
+		for _, id := range sortedKeys(f.channels) {
+			channel := f.channels[id]
+			kind := "public_channel"
+			if channel.IsPrivate {
+				kind = "private_channel"
+			}
+			if !contains(types, kind) || (channel.IsArchived && params["exclude_archived"] == "true") ||
+				(channel.IsPrivate && !f.isMember(id, f.botUserID(token))) {
+				continue
+			}
+			list = append(list, f.channelJSON(id, token))
+		}
+		resp = map[string]interface{}{"ok": true, "channels": list, "response_metadata": map[string]string{"next_cursor": ""}}
+	case "conversations.history":
+		channelID := params["channel"]
+		if _, ok := f.members[channelID]; !ok {
+			resp = slackError("channel_not_found")
+			break
+		}
+		if !f.isMember(channelID, f.botUserID(token)) {
+			resp = slackError("not_in_channel")
+			break
+		}
+		// Newest first, between oldest and latest, all on one page
+		oldest, _ := strconv.ParseFloat(params["oldest"], 64)
+		latest, err := strconv.ParseFloat(params["latest"], 64)
+		if err != nil {
+			latest = math.MaxFloat64
+		}
+		var list []map[string]interface{}
+		for i := len(f.messages[channelID]) - 1; i >= 0; i-- {
+			m := f.messages[channelID][i]
+			ts, _ := strconv.ParseFloat(m.TS, 64)
+			if ts < oldest || ts > latest {
+				continue
+			}
+			list = append(list, map[string]interface{}{"type": "message", "user": m.User, "ts": m.TS, "subtype": m.SubType, "bot_id": m.BotID})
+		}
+		resp = map[string]interface{}{"ok": true, "messages": list, "has_more": false}
+	case "conversations.join":
+		channelID := params["channel"]
+		if _, ok := f.members[channelID]; !ok {
+			resp = slackError("channel_not_found")
+			break
+		}
+		if f.channels[channelID].IsPrivate {
+			resp = slackError("method_not_supported_for_channel_type")
+			break
+		}
+		if bot := f.botUserID(token); !f.isMember(channelID, bot) {
+			f.members[channelID] = append(f.members[channelID], bot)
+		}
+		resp = map[string]interface{}{"ok": true, "channel": map[string]interface{}{"id": channelID}}
+	case "conversations.invite":
+		channelID := params["channel"]
+		if _, ok := f.members[channelID]; !ok {
+			resp = slackError("channel_not_found")
+			break
+		}
+		f.members[channelID] = append(f.members[channelID], strings.Split(params["users"], ",")...)
+		resp = map[string]interface{}{"ok": true, "channel": map[string]interface{}{"id": channelID}}
+	case "chat.postMessage":
+		resp = map[string]interface{}{"ok": true, "channel": params["channel"], "ts": "1700000000.000100"}
+	default:
+		resp = slackError("unknown_method")
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Store the content of a file sent to an upload URL
+func (f *FakeSlack) handleUpload(w http.ResponseWriter, r *http.Request) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fileID := path.Base(r.URL.Path)
+	for i, upload := range f.uploads {
+		if upload.FileID == fileID {
+			f.uploads[i].Content = string(content)
+			fmt.Fprintf(w, "OK - %d", len(content))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// Serve the content of a file from its private download URL
+func (f *FakeSlack) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fileID := strings.Split(strings.TrimPrefix(r.URL.Path, "/files-pri/"), "/")[0]
+	file, ok := f.files[fileID]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	io.WriteString(w, file.Content)
+}
+
+// The bot user the token belongs to
+func (f *FakeSlack) botUserID(token string) string {
+	if install, ok := f.tokens[token]; ok {
+		return install.BotUserID
+	}
+	return "UBOT"
+}
+
+func (f *FakeSlack) isMember(channelID, userID string) bool {
+	return contains(f.members[channelID], userID)
+}
+
+func (f *FakeSlack) channelJSON(channelID, token string) map[string]interface{} {
+	channel := f.channels[channelID]
+	fields := map[string]interface{}{
+		"id":            channelID,
+		"name":          channel.Name,
+		"is_channel":    !channel.IsPrivate,
+		"is_group":      channel.IsPrivate,
+		"is_private":    channel.IsPrivate,
+		"is_shared":     channel.IsShared,
+		"is_ext_shared": channel.IsShared,
+		"is_archived":   channel.IsArchived,
+		"is_member":     f.isMember(channelID, f.botUserID(token)),
+	}
+	// Slack lists the bot's own team too
+	if channel.IsShared {
+		fields["shared_team_ids"] = append([]string{f.teamID(token)}, channel.SharedWith...)
+	}
+	return fields
+}
+
+// The team the token belongs to
+func (f *FakeSlack) teamID(token string) string {
+	if install, ok := f.tokens[token]; ok {
+		return install.TeamID
+	}
+	return "T1"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]Channel) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func userJSON(u User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       u.ID,
+		"name":     u.Name,
+		"is_bot":   u.IsBot,
+		"is_admin": u.IsAdmin,
+		"is_owner": u.IsOwner,
+		"profile": map[string]interface{}{
+			"display_name": u.DisplayName,
+			"email":        u.Email,
+		},
+	}
+}
+
+func slackError(code string) map[string]interface{} {
+	return map[string]interface{}{"ok": false, "error": code}
+}
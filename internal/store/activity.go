@@ -0,0 +1,191 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// ActivityRetention is how long message counts are kept
+const ActivityRetention = 90 * 24 * time.Hour
+
+// ActivityBackfill is how far back a channel's history is read when its
+// messages start being counted
+const ActivityBackfill = 30 * 24 * time.Hour
+
+// A history that couldn't be read is tried again after BackfillRetryDelay,
+// doubling each time up to MaxBackfillRetryDelay
+const (
+	BackfillRetryDelay    = time.Hour
+	MaxBackfillRetryDelay = 24 * time.Hour
+)
+
+// The format of the days messages are counted by
+const activityDay = "2006-01-02"
+
+// How long the times of a user's messages are kept to recognize them when
+// they're seen again, e.g. Slack retrying an event
+const activityDedupeWindow = time.Hour
+
+// Record counts a message a user posted in a channel. Messages from before
+// the channel's Since are left to the backfill, and a message that was
+// already counted isn't counted again. It reports whether the message was
+// counted.
+func (a Activity) Record(channelID, userID string, at time.Time) bool {
+	channel, ok := a[channelID]
+	if !ok {
+		channel = ChannelActivity{Since: at}
+	}
+	if at.Before(channel.Since) || channel.Members[userID].counted(at) {
+		return false
+	}
+	channel.add(userID, at)
+	a[channelID] = channel
+	return true
+}
+
+// Backfill counts the messages read from a channel's history, by user, that
+// were posted before the channel's Since. Messages are counted from upTo on
+// if nothing has been counted in the channel yet.
+func (a Activity) Backfill(channelID string, upTo time.Time, posts map[string][]time.Time) {
+	channel, ok := a[channelID]
+	if !ok {
+		channel = ChannelActivity{Since: upTo}
+	}
+	for userID, times := range posts {
+		// A page read twice mustn't count its messages twice
+		seen := make(map[time.Time]bool)
+		for _, at := range times {
+			if at.Before(channel.Since) && !seen[at] {
+				seen[at] = true
+				channel.add(userID, at)
+			}
+		}
+	}
+	channel.Backfilled = true
+	channel.BackfillAttempts = 0
+	channel.NextBackfill = time.Time{}
+	a[channelID] = channel
+}
+
+// BackfillDue reports whether a channel's history still has to be read,
+// and isn't waiting to be tried again after failing
+func (a Activity) BackfillDue(channelID string, now time.Time) bool {
+	channel := a[channelID]
+	return !channel.Backfilled && !now.Before(channel.NextBackfill)
+}
+
+// BackfillFailed records that a channel's history couldn't be read, and
+// returns when it should be tried again
+func (a Activity) BackfillFailed(channelID string, now time.Time) time.Time {
+	channel, ok := a[channelID]
+	if !ok {
+		channel = ChannelActivity{Since: now}
+	}
+	delay := BackfillRetryDelay
+	for i := 0; i < channel.BackfillAttempts && delay < MaxBackfillRetryDelay; i++ {
+		delay *= 2
+	}
+	channel.BackfillAttempts++
+	channel.NextBackfill = now.Add(min(delay, MaxBackfillRetryDelay))
+	a[channelID] = channel
+	return channel.NextBackfill
+}
+
+// Count adds up the messages a user posted in the given channels from a
+// time on, and finds when they last posted in any of them, even before that.
+func (a Activity) Count(channels Channels, userID string, since time.Time) (messages int, lastActive time.Time) {
+	from := since.UTC().Format(activityDay)
+	for channelID := range channels {
+		member := a[channelID].Members[userID]
+		for day, n := range member.Days {
+			if day >= from {
+				messages += n
+			}
+		}
+		if member.LastActive.After(lastActive) {
+			lastActive = member.LastActive
+		}
+	}
+	return messages, lastActive
+}
+
+// Engagement is how much a team member posted in the tracked channels
+type Engagement struct {
+	Member
+	Messages   int
+	LastActive time.Time
+}
+
+// Engagement counts the messages each member of a team, and of its
+// subteams, posted in the tracked channels from a time on. The most active
+// come first, then by name.
+func (a Activity) Engagement(teams Teams, team string, channels Channels, since time.Time) []Engagement {
+	var engagement []Engagement
+	for _, member := range teams.Members(team) {
+		messages, lastActive := a.Count(channels, member.MemberID, since)
+		engagement = append(engagement, Engagement{Member: member, Messages: messages, LastActive: lastActive})
+	}
+	sort.Slice(engagement, func(i, j int) bool {
+		if engagement[i].Messages != engagement[j].Messages {
+			return engagement[i].Messages > engagement[j].Messages
+		}
+		return strings.ToLower(engagement[i].Name) < strings.ToLower(engagement[j].Name)
+	})
+	return engagement
+}
+
+// CountedFrom returns the time a channel's messages are counted from, or
+// false if none have been counted yet
+func (a Activity) CountedFrom(channelID string) (time.Time, bool) {
+	channel, ok := a[channelID]
+	if !ok {
+		return time.Time{}, false
+	}
+	if channel.Backfilled {
+		return channel.Since.Add(-ActivityBackfill), true
+	}
+	return channel.Since, true
+}
+
+// Whether a message posted at a time was already counted
+func (member MemberActivity) counted(at time.Time) bool {
+	if member.LastActive.Equal(at) {
+		return true
+	}
+	for _, t := range member.Recent {
+		if t.Equal(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count a message and drop the days that are no longer kept
+func (channel *ChannelActivity) add(userID string, at time.Time) {
+	if channel.Members == nil {
+		channel.Members = make(map[string]MemberActivity)
+	}
+	member := channel.Members[userID]
+	if member.Days == nil {
+		member.Days = make(map[string]int)
+	}
+	member.Days[at.UTC().Format(activityDay)]++
+	if at.After(member.LastActive) {
+		member.LastActive = at
+	}
+	var recent []time.Time
+	for _, t := range append(member.Recent, at) {
+		if !t.Before(member.LastActive.Add(-activityDedupeWindow)) {
+			recent = append(recent, t)
+		}
+	}
+	member.Recent = recent
+	oldest := member.LastActive.Add(-ActivityRetention).UTC().Format(activityDay)
+	for day := range member.Days {
+		if day < oldest {
+			delete(member.Days, day)
+		}
+	}
+	channel.Members[userID] = member
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActivityCounts(t *testing.T) {
+	a := make(Activity)
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 12, 0, 0, 0, time.UTC) }
+
+	// Counting starts with the first message, and the history fills in before it
+	if !a.Record("C1", "U1", day(10)) {
+		t.Error("first message wasn't counted")
+	}
+	if a.Record("C1", "U1", day(10)) {
+		t.Error("a retried event was counted again")
+	}
+	if a.Record("C1", "U1", day(9)) {
+		t.Error("a message before counting started was counted by the event")
+	}
+	a.Backfill("C1", day(11), map[string][]time.Time{"U1": {day(1), day(9), day(10)}, "U2": {day(8)}})
+	a.Record("C1", "U1", day(11))
+	// Messages to untracked channels don't count
+	a.Record("C9", "U1", day(11))
+
+	channels := Channels{"C1": {ID: "C1", Name: "proj-x"}}
+	if messages, last := a.Count(channels, "U1", day(1)); messages != 4 || !last.Equal(day(11)) {
+		t.Errorf("U1 since day 1: %d messages, last active %v", messages, last)
+	}
+	if messages, _ := a.Count(channels, "U1", day(10)); messages != 2 {
+		t.Errorf("U1 since day 10: %d messages, want 2", messages)
+	}
+	if messages, last := a.Count(channels, "U2", day(9)); messages != 0 || !last.Equal(day(8)) {
+		t.Errorf("U2 since day 9: %d messages, last active %v", messages, last)
+	}
+	if from, ok := a.CountedFrom("C1"); !ok || !from.Equal(day(10).Add(-ActivityBackfill)) {
+		t.Errorf("C1 counted from %v, %v", from, ok)
+	}
+
+	// Old days are dropped
+	a.Record("C1", "U1", day(11).Add(ActivityRetention+48*time.Hour))
+	if _, kept := a["C1"].Members["U1"].Days["2024-05-01"]; kept {
+		t.Error("a day older than the retention was kept")
+	}
+}
+
+func TestActivityDedupe(t *testing.T) {
+	a := make(Activity)
+	at := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	a.Record("C1", "U1", at)
+	a.Record("C1", "U1", at.Add(time.Minute))
+	// Slack retrying the event of a message that's no longer the latest
+	if a.Record("C1", "U1", at) {
+		t.Error("a retried event for an earlier message was counted again")
+	}
+	// History pages that overlap
+	a.Backfill("C1", at, map[string][]time.Time{"U1": {at.Add(-time.Hour), at.Add(-time.Hour)}})
+	if messages, _ := a.Count(Channels{"C1": {ID: "C1"}}, "U1", at.Add(-24*time.Hour)); messages != 3 {
+		t.Errorf("counted %d messages, want 3", messages)
+	}
+	// Only the times near the latest message are kept
+	a.Record("C1", "U1", at.Add(3*time.Hour))
+	if recent := a["C1"].Members["U1"].Recent; len(recent) != 1 {
+		t.Errorf("kept %d recent times, want 1", len(recent))
+	}
+}
+
+func TestActivityBackfillRetries(t *testing.T) {
+	a := make(Activity)
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	if !a.BackfillDue("C1", now) {
+		t.Fatal("a new channel's backfill isn't due")
+	}
+
+	var delays []time.Duration
+	for i := 0; i < 7; i++ {
+		next := a.BackfillFailed("C1", now)
+		delays = append(delays, next.Sub(now))
+		if a.BackfillDue("C1", now) || !a.BackfillDue("C1", next) {
+			t.Errorf("attempt %d: due before %v", i+1, next)
+		}
+	}
+	want := []time.Duration{1, 2, 4, 8, 16, 24, 24}
+	for i := range want {
+		if delays[i] != want[i]*time.Hour {
+			t.Errorf("retry delays = %v, want %v hours", delays, want)
+			break
+		}
+	}
+
+	a.Backfill("C1", now, nil)
+	if a.BackfillDue("C1", now.Add(48*time.Hour)) || a["C1"].BackfillAttempts != 0 {
+		t.Errorf("backfill still due after it succeeded: %+v", a["C1"])
+	}
+}
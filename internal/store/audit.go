@@ -0,0 +1,34 @@
+package store
+
+import "time"
+
+// AuditRetention is how long the audit log keeps events
+const AuditRetention = 90 * 24 * time.Hour
+
+// Append adds entries to the log, and drops the ones that are more than
+// AuditRetention older than the last entry
+func (audit AuditLog) Append(entries ...AuditEntry) AuditLog {
+	audit = append(audit, entries...)
+	if len(audit) == 0 {
+		return audit
+	}
+	oldest := audit[len(audit)-1].Time.Add(-AuditRetention)
+	kept := audit[:0]
+	for _, entry := range audit {
+		if !entry.Time.Before(oldest) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// Since returns the entries from a time on
+func (audit AuditLog) Since(from time.Time) AuditLog {
+	var entries AuditLog
+	for _, entry := range audit {
+		if !entry.Time.Before(from) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
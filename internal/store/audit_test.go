@@ -0,0 +1,20 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditLogRetention(t *testing.T) {
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	var audit AuditLog
+	audit = audit.Append(AuditEntry{Event: "member.added", Time: now.Add(-AuditRetention - time.Hour)})
+	audit = audit.Append(AuditEntry{Event: "member.removed", Time: now.Add(-2 * time.Hour)}, AuditEntry{Event: "team.created", Time: now})
+
+	if len(audit) != 2 || audit[0].Event != "member.removed" {
+		t.Fatalf("audit log = %+v, want the old entry dropped", audit)
+	}
+	if since := audit.Since(now.Add(-time.Hour)); len(since) != 1 || since[0].Event != "team.created" {
+		t.Errorf("entries in the last hour = %+v", since)
+	}
+}
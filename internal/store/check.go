@@ -0,0 +1,276 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Copy copies all the data from one store into another, e.g. to move from
+// the JSON files to SQLite. Anything already in dst is replaced.
+// The data of every workspace is copied too.
+func Copy(dst, src *Store) error {
+	if err := copyData(dst, src); err != nil {
+		return err
+	}
+
+	installations, err := src.ReadInstallations()
+	if err != nil {
+		return fmt.Errorf("reading installations: %w", err)
+	}
+	if len(installations) > 0 {
+		if err := dst.WriteInstallations(installations); err != nil {
+			return fmt.Errorf("writing installations: %w", err)
+		}
+	}
+	teamIDs, err := src.Workspaces()
+	if err != nil {
+		return fmt.Errorf("listing workspaces: %w", err)
+	}
+	for _, teamID := range teamIDs {
+		srcWorkspace, err := src.Workspace(teamID)
+		if err != nil {
+			return err
+		}
+		dstWorkspace, err := dst.Workspace(teamID)
+		if err != nil {
+			return err
+		}
+		if err := copyData(dstWorkspace, srcWorkspace); err != nil {
+			return fmt.Errorf("workspace %s: %w", teamID, err)
+		}
+	}
+	return nil
+}
+
+// Copy the data of a single workspace
+func copyData(dst, src *Store) error {
+	teams, err := src.ReadTeams()
+	if err != nil {
+		return fmt.Errorf("reading teams: %w", err)
+	}
+	users, err := src.ReadUsers()
+	if err != nil {
+		return fmt.Errorf("reading users: %w", err)
+	}
+	channels, err := src.ReadChannels()
+	if err != nil {
+		return fmt.Errorf("reading channels: %w", err)
+	}
+	webhooks, err := src.ReadWebhooks()
+	if err != nil {
+		return fmt.Errorf("reading webhooks: %w", err)
+	}
+	queue, err := src.ReadWebhookQueue()
+	if err != nil {
+		return fmt.Errorf("reading webhook queue: %w", err)
+	}
+	memberships, err := src.ReadMemberships()
+	if err != nil {
+		return fmt.Errorf("reading memberships: %w", err)
+	}
+	activity, err := src.ReadActivity()
+	if err != nil {
+		return fmt.Errorf("reading activity: %w", err)
+	}
+	reports, err := src.ReadReports()
+	if err != nil {
+		return fmt.Errorf("reading reports: %w", err)
+	}
+	audit, err := src.ReadAudit()
+	if err != nil {
+		return fmt.Errorf("reading audit log: %w", err)
+	}
+
+	return dst.Update(func() error {
+		if err := dst.WriteTeams(teams); err != nil {
+			return fmt.Errorf("writing teams: %w", err)
+		}
+		if err := dst.WriteUsers(users); err != nil {
+			return fmt.Errorf("writing users: %w", err)
+		}
+		if err := dst.WriteChannels(channels); err != nil {
+			return fmt.Errorf("writing channels: %w", err)
+		}
+		if err := dst.WriteWebhooks(webhooks); err != nil {
+			return fmt.Errorf("writing webhooks: %w", err)
+		}
+		if err := dst.WriteWebhookQueue(queue); err != nil {
+			return fmt.Errorf("writing webhook queue: %w", err)
+		}
+		if err := dst.WriteMemberships(memberships); err != nil {
+			return fmt.Errorf("writing memberships: %w", err)
+		}
+		if err := dst.WriteActivity(activity); err != nil {
+			return fmt.Errorf("writing activity: %w", err)
+		}
+		if err := dst.WriteReports(reports); err != nil {
+			return fmt.Errorf("writing reports: %w", err)
+		}
+		if err := dst.WriteAudit(audit); err != nil {
+			return fmt.Errorf("writing audit log: %w", err)
+		}
+		return nil
+	})
+}
+
+// Check looks for problems in the stored data that the commands would
+// never create but hand edits can, like duplicate members or subteams that
+// don't exist. It returns a description of each problem.
+func (s *Store) Check() ([]string, error) {
+	teams, users, channels, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	return checkData(teams, users, channels, false), nil
+}
+
+// Repair fixes the problems Check finds and returns what it changed
+func (s *Store) Repair() ([]string, error) {
+	var fixes []string
+	err := s.Update(func() error {
+		teams, users, channels, err := s.readAll()
+		if err != nil {
+			return err
+		}
+
+		fixes = checkData(teams, users, channels, true)
+		if len(fixes) == 0 {
+			return nil
+		}
+
+		if err := s.WriteTeams(teams); err != nil {
+			return err
+		}
+		if err := s.WriteUsers(users); err != nil {
+			return err
+		}
+		return s.WriteChannels(channels)
+	})
+	return fixes, err
+}
+
+func (s *Store) readAll() (Teams, Users, Channels, error) {
+	teams, err := s.ReadTeams()
+	if err != nil {
+		return teams, nil, nil, fmt.Errorf("reading %s: %w", TeamsFile, err)
+	}
+	users, err := s.ReadUsers()
+	if err != nil {
+		return teams, users, nil, fmt.Errorf("reading %s: %w", UsersFile, err)
+	}
+	channels, err := s.ReadChannels()
+	if err != nil {
+		return teams, users, channels, fmt.Errorf("reading %s: %w", ChannelsFile, err)
+	}
+	return teams, users, channels, nil
+}
+
+// Find problems in the data, fixing them in place if fix is set
+func checkData(teams Teams, users Users, channels Channels, fix bool) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for id, channel := range channels {
+		if channel.ID != id {
+			report("channel %s is stored with ID %q", id, channel.ID)
+			if fix {
+				channel.ID = id
+				channels[id] = channel
+			}
+		}
+	}
+
+	for id, user := range users {
+		if user.MemberID != id {
+			report("user %s is stored with member ID %q", id, user.MemberID)
+			if fix {
+				user.MemberID = id
+				users[id] = user
+			}
+		}
+	}
+
+	names := make([]string, 0, len(teams.Teams))
+	for name := range teams.Teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	aliasOwner := make(map[string]string)
+	for _, name := range names {
+		team := teams.Teams[name]
+
+		var members []Member
+		seen := make(map[string]bool)
+		for _, member := range team.Members {
+			switch {
+			case member.MemberID == "":
+				report("team %s has a member without an ID", name)
+			case seen[member.MemberID]:
+				report("team %s has member %s more than once", name, member.MemberID)
+			default:
+				seen[member.MemberID] = true
+				members = append(members, member)
+			}
+		}
+		if members == nil {
+			members = []Member{}
+		}
+
+		var subteams []string
+		for _, subteam := range team.Subteams {
+			if _, exists := teams.Teams[subteam]; !exists {
+				report("team %s includes team %s, which doesn't exist", name, subteam)
+				continue
+			}
+			subteams = append(subteams, subteam)
+		}
+
+		var aliases []string
+		for _, alias := range team.Aliases {
+			if _, isTeam := teams.Teams[alias]; isTeam {
+				report("alias %s of team %s is also the name of a team", alias, name)
+				continue
+			}
+			if owner, taken := aliasOwner[alias]; taken {
+				report("alias %s of team %s is also an alias of team %s", alias, name, owner)
+				continue
+			}
+			aliasOwner[alias] = name
+			aliases = append(aliases, alias)
+		}
+
+		defaultChannel := team.DefaultChannel
+		if defaultChannel != "" {
+			if _, tracked := channels[defaultChannel]; !tracked {
+				report("default channel %s of team %s isn't tracked", defaultChannel, name)
+				defaultChannel = ""
+			}
+		}
+
+		if fix {
+			team.Members = members
+			team.Subteams = subteams
+			team.Aliases = aliases
+			team.DefaultChannel = defaultChannel
+			teams.Teams[name] = team
+		}
+	}
+
+	// Break any loops by dropping the subteam that closes them. Each team on
+	// a loop is reported when not fixing.
+	for _, name := range names {
+		for _, subteam := range teams.Teams[name].Subteams {
+			if teams.Contains(subteam, name) {
+				report("team %s includes itself through team %s", name, subteam)
+				if fix {
+					teams.RemoveSubteam(name, subteam)
+				}
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateLocksAcrossStores(t *testing.T) {
+	// Two stores on the same directory stand in for the server and connect-admin
+	dir := t.TempDir()
+	server, admin := New(dir), New(dir)
+
+	done := make(chan struct{})
+	err := server.Update(func() error {
+		go func() {
+			admin.Update(func() error { return nil })
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Error("the second store got the lock while the first held it")
+		case <-time.After(100 * time.Millisecond):
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second store never got the lock")
+	}
+}
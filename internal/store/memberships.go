@@ -0,0 +1,37 @@
+package store
+
+import "time"
+
+// Seen records a user being in a channel at a time. It reports whether they
+// joined, i.e. weren't in the channel before.
+func (m Memberships) Seen(channelID, userID string, at time.Time) (joined bool) {
+	if m[channelID] == nil {
+		m[channelID] = make(map[string]Membership)
+	}
+	membership, known := m[channelID][userID]
+	switch {
+	case !known:
+		membership = Membership{FirstSeen: at, JoinedAt: at}
+		joined = true
+	case membership.LeftAt != nil:
+		// Back after leaving
+		membership.JoinedAt = at
+		membership.LeftAt = nil
+		joined = true
+	}
+	membership.LastSeen = at
+	m[channelID][userID] = membership
+	return joined
+}
+
+// Left records a user leaving a channel at a time. It reports whether they
+// were in the channel.
+func (m Memberships) Left(channelID, userID string, at time.Time) bool {
+	membership, known := m[channelID][userID]
+	if !known || membership.LeftAt != nil {
+		return false
+	}
+	membership.LeftAt = &at
+	m[channelID][userID] = membership
+	return true
+}
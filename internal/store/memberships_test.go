@@ -0,0 +1,38 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMembershipHistory(t *testing.T) {
+	m := make(Memberships)
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 12, 0, 0, 0, time.UTC) }
+
+	if !m.Seen("C1", "U1", day(1)) {
+		t.Error("first sighting isn't a join")
+	}
+	if m.Seen("C1", "U1", day(2)) {
+		t.Error("second sighting is a join")
+	}
+	if !m.Left("C1", "U1", day(3)) || m.Left("C1", "U1", day(4)) {
+		t.Error("only the first leave should count")
+	}
+	if m.Left("C1", "U2", day(3)) {
+		t.Error("a user never seen left")
+	}
+
+	got := m["C1"]["U1"]
+	if !got.FirstSeen.Equal(day(1)) || !got.LastSeen.Equal(day(2)) || got.LeftAt == nil || !got.LeftAt.Equal(day(3)) {
+		t.Errorf("membership = %+v", got)
+	}
+
+	// Coming back keeps the first sighting and starts a new stay
+	if !m.Seen("C1", "U1", day(5)) {
+		t.Error("coming back isn't a join")
+	}
+	got = m["C1"]["U1"]
+	if !got.FirstSeen.Equal(day(1)) || !got.JoinedAt.Equal(day(5)) || got.LeftAt != nil {
+		t.Errorf("membership after coming back = %+v", got)
+	}
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// These structs define the data models
+type Teams struct {
+	Teams map[string]Team `json:"teams"`
+}
+
+type Team struct {
+	Members []Member `json:"members"`
+	// Names of teams whose members are also members of this team
+	Subteams []string `json:"subteams,omitempty"`
+
+	Description string `json:"description,omitempty"`
+	// User IDs of the people responsible for the team
+	Owners []string `json:"owners,omitempty"`
+	// Other names the team can be referred to by in commands
+	Aliases []string `json:"aliases,omitempty"`
+	// ID of the channel ping uses when no channel is given
+	DefaultChannel string `json:"default_channel,omitempty"`
+	// Free-form labels, e.g. partner=acme or project=apollo
+	Tags      map[string]string `json:"tags,omitempty"`
+	CreatedBy string            `json:"created_by,omitempty"`
+	// Zero for teams created before this was recorded
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Member struct {
+	MemberID string            `json:"member_id"`
+	Name     string            `json:"name"`
+	Channels map[string]string `json:"channels"`
+}
+
+type Users map[string]User
+
+type User struct {
+	MemberID  string            `json:"member_id"`
+	Name      string            `json:"name"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Channels  map[string]string `json:"channels"`
+}
+
+// Memberships records when users were in the tracked channels, by channel
+// ID and then user ID. Unlike User.Channels, it keeps the people who left.
+type Memberships map[string]map[string]Membership
+
+// Membership is one user's time in one channel
+type Membership struct {
+	// When the user was first seen in the channel
+	FirstSeen time.Time `json:"first_seen"`
+	// When the user last joined. Later than FirstSeen if they left and came back.
+	JoinedAt time.Time `json:"joined_at"`
+	// When the user was last seen in the channel
+	LastSeen time.Time `json:"last_seen"`
+	// When the user left, or nil while they're in the channel
+	LeftAt *time.Time `json:"left_at,omitempty"`
+}
+
+// Activity records how much users post in the tracked channels, by channel ID
+type Activity map[string]ChannelActivity
+
+// ChannelActivity is who posted in one channel
+type ChannelActivity struct {
+	// Messages are counted as they're posted from this time on
+	Since time.Time `json:"since"`
+	// Whether the messages of the ActivityBackfill before Since were counted
+	// from the channel's history
+	Backfilled bool `json:"backfilled,omitempty"`
+	// Failed attempts at reading the history, and when to try again
+	BackfillAttempts int       `json:"backfill_attempts,omitempty"`
+	NextBackfill     time.Time `json:"next_backfill"`
+	// By user ID
+	Members map[string]MemberActivity `json:"members"`
+}
+
+// MemberActivity is how much one user posted in one channel
+type MemberActivity struct {
+	// Messages by UTC day, as 2006-01-02. Days before the ActivityRetention are dropped.
+	Days map[string]int `json:"days"`
+	// When the user last posted
+	LastActive time.Time `json:"last_active"`
+	// When the messages of the activityDedupeWindow before LastActive were
+	// posted, so a message that's seen again isn't counted twice
+	Recent []time.Time `json:"recent,omitempty"`
+}
+
+// Reports holds where the scheduled reports go and when they were last sent
+type Reports struct {
+	// The channel the weekly activity report is posted to. Empty if it's off.
+	ActivityChannel string    `json:"activity_channel,omitempty"`
+	ActivitySentAt  time.Time `json:"activity_sent_at"`
+	// Set when the team owners' weekly digest was turned off
+	DigestOff    bool      `json:"digest_off,omitempty"`
+	DigestSentAt time.Time `json:"digest_sent_at"`
+}
+
+// AuditLog is every change event, oldest first. Entries older than
+// AuditRetention are dropped.
+type AuditLog []AuditEntry
+
+// AuditEntry is one change event, with the payload webhooks are sent
+type AuditEntry struct {
+	Event   string          `json:"event"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type Channels map[string]Channel
+
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Set once the channel's members have been synced, so later syncs
+	// know the joins and leaves they see are real
+	Synced bool `json:"synced,omitempty"`
+	// Teams of the other organizations the channel is shared with over Slack Connect
+	SharedWith []string `json:"shared_with,omitempty"`
+	// Set when discovery started tracking the channel rather than a person
+	Discovered bool `json:"discovered,omitempty"`
+}
+
+type Webhooks map[string]Webhook
+
+// Webhook is an endpoint that gets told about changes
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Used to sign the payloads
+	Secret string `json:"secret"`
+	// The event types to send. Empty means all of them.
+	Events    []string  `json:"events,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// The outcome of the last delivery attempt
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// Delivery is a webhook payload waiting to be sent
+type Delivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	// Not sent before this time, to back off after failures
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Installations are the workspaces the app was installed in with OAuth, by team ID
+type Installations map[string]Installation
+
+// Installation is a workspace the app was installed in, with the bot token to use there
+type Installation struct {
+	TeamID   string `json:"team_id"`
+	TeamName string `json:"team_name"`
+	BotToken string `json:"bot_token"`
+	// The bot's user ID in the workspace
+	BotUserID   string    `json:"bot_user_id"`
+	Scope       string    `json:"scope,omitempty"`
+	InstalledBy string    `json:"installed_by,omitempty"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// ByName indexes the tracked channels by name. Shared channels from
+// different organizations can have the same name, so a name can have several
+// IDs, which are sorted.
+func (channels Channels) ByName() map[string][]string {
+	index := make(map[string][]string)
+	for id, channel := range channels {
+		name := strings.ToLower(channel.Name)
+		index[name] = append(index[name], id)
+	}
+	for _, ids := range index {
+		sort.Strings(ids)
+	}
+	return index
+}
+
+// FindIDs finds the IDs of the tracked channels with a name, ignoring case
+func (channels Channels) FindIDs(channelName string) []string {
+	return channels.ByName()[strings.ToLower(channelName)]
+}
+
+// InChannel returns the users the sync has seen in a channel, sorted by name
+func (users Users) InChannel(channelID string) []User {
+	var in []User
+	for _, user := range users {
+		if _, ok := user.Channels[channelID]; ok {
+			in = append(in, user)
+		}
+	}
+	sort.Slice(in, func(i, j int) bool {
+		if a, b := strings.ToLower(in[i].Name), strings.ToLower(in[j].Name); a != b {
+			return a < b
+		}
+		return in[i].MemberID < in[j].MemberID
+	})
+	return in
+}
+
+// CountByChannel counts the users the sync has seen in each channel
+func (users Users) CountByChannel() map[string]int {
+	counts := make(map[string]int)
+	for _, user := range users {
+		for channelID := range user.Channels {
+			counts[channelID]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+
+	"slack-connect-manager/internal/secrets"
+)
+
+// One file of secrets: either a workspace's installations or its webhooks
+type storedSecrets struct {
+	store         *Store
+	installations Installations
+	webhooks      Webhooks
+}
+
+// RotateKey re-encrypts every stored secret, in the store and all its
+// workspaces, with the primary key of keyring. The secrets are read with
+// keyring too, so it should still hold the store's current key, e.g. from
+// Keyring.Rotate. Then a rotation that failed partway can simply be run
+// again. The store uses keyring from then on. Returns how many secrets were
+// re-encrypted.
+//
+// If a write fails, the files already written are put back under the old
+// keyring, so the old key still reads everything.
+func (s *Store) RotateKey(keyring *secrets.Keyring) (int, error) {
+	teamIDs, err := s.Workspaces()
+	if err != nil {
+		return 0, fmt.Errorf("listing workspaces: %w", err)
+	}
+	stores := []*Store{s}
+	for _, teamID := range teamIDs {
+		ws, err := s.Workspace(teamID)
+		if err != nil {
+			return 0, err
+		}
+		stores = append(stores, ws)
+	}
+
+	// Nothing else may change the secrets while they're rewritten
+	count := 0
+	err = updateAll(stores, func() error {
+		old := s.keyring
+		s.SetKeyring(keyring)
+		all, err := readSecrets(stores)
+		if err != nil {
+			s.SetKeyring(old)
+			return err
+		}
+
+		for i, stored := range all {
+			if err := stored.write(); err != nil {
+				s.SetKeyring(old)
+				for _, written := range all[:i] {
+					if rollbackErr := written.write(); rollbackErr != nil {
+						return fmt.Errorf("%w, and putting back the secrets already re-encrypted failed too, so some are under the new key: %v. "+
+							"Run the rotation again with the same keys to finish it", err, rollbackErr)
+					}
+				}
+				count = 0
+				return fmt.Errorf("%w. The secrets already re-encrypted were put back under the old key", err)
+			}
+			count += len(stored.installations) + len(stored.webhooks)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Run fn while holding the write locks of all the stores
+func updateAll(stores []*Store, fn func() error) error {
+	if len(stores) == 0 {
+		return fn()
+	}
+	return stores[0].Update(func() error {
+		return updateAll(stores[1:], fn)
+	})
+}
+
+// Read the secrets of the stores, the first of which is the top level one.
+// Everything is read before anything is written, so a secret that can't be
+// decrypted stops the rotation before it starts.
+func readSecrets(stores []*Store) ([]storedSecrets, error) {
+	var all []storedSecrets
+	installations, err := stores[0].ReadInstallations()
+	if err != nil {
+		return nil, fmt.Errorf("reading installations: %w", err)
+	}
+	if len(installations) > 0 {
+		all = append(all, storedSecrets{store: stores[0], installations: installations})
+	}
+
+	for _, st := range stores {
+		webhooks, err := st.ReadWebhooks()
+		if err != nil {
+			return nil, fmt.Errorf("reading webhooks in %s: %w", st.Location(), err)
+		}
+		if len(webhooks) > 0 {
+			all = append(all, storedSecrets{store: st, webhooks: webhooks})
+		}
+	}
+	return all, nil
+}
+
+// Write the secrets back with the store's keyring
+func (stored storedSecrets) write() error {
+	if stored.installations != nil {
+		if err := stored.store.WriteInstallations(stored.installations); err != nil {
+			return fmt.Errorf("writing installations: %w", err)
+		}
+		return nil
+	}
+	if err := stored.store.WriteWebhooks(stored.webhooks); err != nil {
+		return fmt.Errorf("writing webhooks in %s: %w", stored.store.Location(), err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	// Pure Go SQLite driver, so the binary still builds without cgo
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteFile is the name of the SQLite database in the data directory
+const SQLiteFile = "connect.db"
+
+// sqliteDB keeps each document as a row in a SQLite database. Every write
+// is a transaction, and the whole data set is one file to back up.
+type sqliteDB struct {
+	path string
+	db   *sql.DB
+}
+
+func openSQLite(path string) (*sqliteDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, and Store already serializes writes
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS documents (
+		name TEXT PRIMARY KEY,
+		data TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteDB{path: path, db: db}, nil
+}
+
+func (s *sqliteDB) read(name string) ([]byte, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM documents WHERE name = ?`, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (s *sqliteDB) write(name string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO documents (name, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		name, string(data), time.Now().UTC())
+	return err
+}
+
+func (s *sqliteDB) exists(name string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM documents WHERE name = ?`, name).Scan(&count)
+	return count > 0, err
+}
+
+func (s *sqliteDB) names() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM documents ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *sqliteDB) location() string {
+	return s.path
+}
+
+func (s *sqliteDB) close() error {
+	return s.db.Close()
+}
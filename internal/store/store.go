@@ -0,0 +1,621 @@
+// Package store keeps teams, users and tracked channels, either in JSON
+// files or in a SQLite database.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"slack-connect-manager/internal/secrets"
+)
+
+// These constants define the "database" file names
+// We use JSON files as a simple data store, kept in the data directory.
+// The SQLite backend uses the same names for its documents.
+const (
+	TeamsFile    = "teams.json"
+	UsersFile    = "users.json"
+	ChannelsFile = "channels.json"
+	// Optional files, only created once they're needed
+	WebhooksFile     = "webhooks.json"
+	WebhookQueueFile = "webhook_queue.json"
+	MembershipsFile  = "memberships.json"
+	ActivityFile     = "activity.json"
+	ReportsFile      = "reports.json"
+	AuditFile        = "audit.json"
+	// Only kept in the top level store
+	InstallationsFile = "installations.json"
+)
+
+// WorkspacesDir holds the data of each installed workspace, in a
+// subdirectory named after its team ID
+const WorkspacesDir = "workspaces"
+
+// LockFile is locked by Update, so the server and connect-admin running at
+// the same time don't overwrite each other's changes. Each JSON data
+// directory has its own; SQLite workspaces add their team ID to the name.
+const LockFile = ".lock"
+
+// The storage backends
+const (
+	BackendJSON   = "json"
+	BackendSQLite = "sqlite"
+)
+
+// Backends lists the storage backends that can be used with Open
+var Backends = []string{BackendJSON, BackendSQLite}
+
+// A backend stores each data file as a whole document
+type backend interface {
+	// Read a document. Returns nil if it doesn't exist yet.
+	read(name string) ([]byte, error)
+	write(name string, data []byte) error
+	exists(name string) (bool, error)
+	// The names of all the documents, e.g. to find the workspaces
+	names() ([]string, error)
+	// Where the data lives, for messages
+	location() string
+	close() error
+}
+
+// Store reads and writes the data files in a directory
+type Store struct {
+	dir     string
+	kind    string
+	backend backend
+	// Encrypts the bot tokens and webhook secrets. They're kept in plaintext if nil.
+	keyring *secrets.Keyring
+
+	// Held for read-modify-write cycles so they don't overwrite each other.
+	// lockPath does the same between processes.
+	mu       sync.Mutex
+	lockPath string
+
+	// The stores of the installed workspaces, by team ID
+	workspacesMu sync.Mutex
+	workspaces   map[string]*Store
+}
+
+// New creates a store for the JSON data files in dir
+func New(dir string) *Store {
+	return &Store{dir: dir, kind: BackendJSON, backend: jsonFiles{dir: dir}, lockPath: filepath.Join(dir, LockFile)}
+}
+
+// Open opens a store using one of the Backends. The SQLite database is
+// kept in the data directory as connect.db.
+func Open(kind, dir string) (*Store, error) {
+	switch kind {
+	case BackendJSON:
+		return New(dir), nil
+	case BackendSQLite:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		db, err := openSQLite(filepath.Join(dir, SQLiteFile))
+		if err != nil {
+			return nil, err
+		}
+		return &Store{dir: dir, kind: kind, backend: db, lockPath: filepath.Join(dir, LockFile)}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// Close releases the store's resources
+func (s *Store) Close() error {
+	return s.backend.close()
+}
+
+// Workspace returns the store holding the data of one workspace. The JSON
+// files are kept in a subdirectory of the data directory, and SQLite keeps
+// the documents in the same database under their own names. Asking twice for
+// the same workspace returns the same store, so they share a write lock.
+func (s *Store) Workspace(teamID string) (*Store, error) {
+	if !validTeamID(teamID) {
+		return nil, fmt.Errorf("invalid team ID %q", teamID)
+	}
+
+	s.workspacesMu.Lock()
+	defer s.workspacesMu.Unlock()
+	if ws, ok := s.workspaces[teamID]; ok {
+		return ws, nil
+	}
+
+	ws := &Store{dir: s.dir, kind: s.kind, keyring: s.keyring}
+	if _, ok := s.backend.(jsonFiles); ok {
+		ws.dir = filepath.Join(s.dir, WorkspacesDir, teamID)
+		ws.backend = jsonFiles{dir: ws.dir}
+		ws.lockPath = filepath.Join(ws.dir, LockFile)
+	} else {
+		ws.backend = prefixed{backend: s.backend, prefix: WorkspacesDir + "/" + teamID + "/"}
+		ws.lockPath = filepath.Join(s.dir, LockFile+"-"+teamID)
+	}
+	if s.workspaces == nil {
+		s.workspaces = make(map[string]*Store)
+	}
+	s.workspaces[teamID] = ws
+	return ws, nil
+}
+
+// Workspaces lists the team IDs of the workspaces that have data in the
+// store, installed or not
+func (s *Store) Workspaces() ([]string, error) {
+	names, err := s.backend.names()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var teamIDs []string
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) == 3 && parts[0] == WorkspacesDir && validTeamID(parts[1]) && !seen[parts[1]] {
+			seen[parts[1]] = true
+			teamIDs = append(teamIDs, parts[1])
+		}
+	}
+	sort.Strings(teamIDs)
+	return teamIDs, nil
+}
+
+// SetKeyring sets the keyring used to encrypt secrets, for the store and
+// all its workspaces. Secrets already stored in plaintext are encrypted the
+// next time they are written.
+func (s *Store) SetKeyring(keyring *secrets.Keyring) {
+	s.workspacesMu.Lock()
+	defer s.workspacesMu.Unlock()
+	s.keyring = keyring
+	for _, ws := range s.workspaces {
+		ws.keyring = keyring
+	}
+}
+
+// Team IDs end up in paths, so only letters and digits are allowed
+func validTeamID(teamID string) bool {
+	if teamID == "" {
+		return false
+	}
+	for _, r := range teamID {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Dir returns the data directory
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Backend returns which backend the store uses
+func (s *Store) Backend() string {
+	return s.kind
+}
+
+// Location returns where the data is kept, e.g. the data directory or the database file
+func (s *Store) Location() string {
+	return s.backend.location()
+}
+
+// Update runs fn while holding the store's write lock. Anything that reads
+// data, changes it and writes it back should do so inside Update. The lock
+// is also taken on LockFile, so other processes using the same data, like
+// connect-admin, wait for it too.
+func (s *Store) Update(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockFile(s.lockPath)
+	if err != nil {
+		return fmt.Errorf("locking %s: %w", s.lockPath, err)
+	}
+	defer unlock()
+	return fn()
+}
+
+// HasData reports whether any of the data files exist yet
+func (s *Store) HasData() (bool, error) {
+	for _, filename := range []string{TeamsFile, UsersFile, ChannelsFile} {
+		exists, err := s.backend.exists(filename)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// EnsureFiles creates the data directory and any missing data files
+func (s *Store) EnsureFiles() error {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range []string{TeamsFile, UsersFile, ChannelsFile} {
+		exists, err := s.backend.exists(filename)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		slog.Info("Creating data file", "file", filename, "location", s.Location())
+
+		// Initialize with empty data
+		switch filename {
+		case TeamsFile:
+			err = s.WriteTeams(Teams{Teams: make(map[string]Team)})
+		case UsersFile:
+			err = s.WriteUsers(make(Users))
+		case ChannelsFile:
+			err = s.WriteChannels(make(Channels))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTeams reads teams from the data store
+func (s *Store) ReadTeams() (Teams, error) {
+	slog.Debug("Reading teams")
+	teams := Teams{Teams: make(map[string]Team)}
+	err := s.readJSON(TeamsFile, &teams)
+	if teams.Teams == nil {
+		teams.Teams = make(map[string]Team)
+	}
+	return teams, err
+}
+
+// WriteTeams writes teams to the data store
+func (s *Store) WriteTeams(teams Teams) error {
+	slog.Debug("Writing teams")
+	return s.writeJSON(TeamsFile, teams)
+}
+
+// ReadUsers reads users from the data store
+func (s *Store) ReadUsers() (Users, error) {
+	slog.Debug("Reading users")
+	users := make(Users)
+	err := s.readJSON(UsersFile, &users)
+	return users, err
+}
+
+// WriteUsers writes users to the data store
+func (s *Store) WriteUsers(users Users) error {
+	slog.Debug("Writing users")
+	return s.writeJSON(UsersFile, users)
+}
+
+// ReadChannels reads channels from the data store
+func (s *Store) ReadChannels() (Channels, error) {
+	slog.Debug("Reading channels")
+	channels := make(Channels)
+	err := s.readJSON(ChannelsFile, &channels)
+	return channels, err
+}
+
+// WriteChannels writes channels to the data store
+func (s *Store) WriteChannels(channels Channels) error {
+	slog.Debug("Writing channels")
+	return s.writeJSON(ChannelsFile, channels)
+}
+
+// RenameChannel records the new name of a tracked channel, e.g. after Slack
+// tells us it was renamed. Returns the old name, or tracked false if the
+// channel isn't tracked.
+func (s *Store) RenameChannel(channelID, name string) (oldName string, tracked bool, err error) {
+	err = s.Update(func() error {
+		channels, err := s.ReadChannels()
+		if err != nil {
+			return err
+		}
+		channel, ok := channels[channelID]
+		if !ok || channel.Name == name {
+			oldName, tracked = channel.Name, ok
+			return nil
+		}
+		oldName, tracked = channel.Name, true
+		channel.Name = name
+		channels[channelID] = channel
+		return s.WriteChannels(channels)
+	})
+	return oldName, tracked, err
+}
+
+// ReadMemberships reads the history of who was in the tracked channels
+func (s *Store) ReadMemberships() (Memberships, error) {
+	slog.Debug("Reading memberships")
+	memberships := make(Memberships)
+	err := s.readJSON(MembershipsFile, &memberships)
+	return memberships, err
+}
+
+// WriteMemberships writes the membership history to the data store
+func (s *Store) WriteMemberships(memberships Memberships) error {
+	slog.Debug("Writing memberships")
+	return s.writeJSON(MembershipsFile, memberships)
+}
+
+// ReadActivity reads who posted in the tracked channels
+func (s *Store) ReadActivity() (Activity, error) {
+	slog.Debug("Reading activity")
+	activity := make(Activity)
+	err := s.readJSON(ActivityFile, &activity)
+	return activity, err
+}
+
+// WriteActivity writes who posted in the tracked channels to the data store
+func (s *Store) WriteActivity(activity Activity) error {
+	slog.Debug("Writing activity")
+	return s.writeJSON(ActivityFile, activity)
+}
+
+// ReadReports reads the settings and state of the scheduled reports
+func (s *Store) ReadReports() (Reports, error) {
+	slog.Debug("Reading reports")
+	var reports Reports
+	err := s.readJSON(ReportsFile, &reports)
+	return reports, err
+}
+
+// WriteReports writes the settings and state of the scheduled reports to the data store
+func (s *Store) WriteReports(reports Reports) error {
+	slog.Debug("Writing reports")
+	return s.writeJSON(ReportsFile, reports)
+}
+
+// ReadAudit reads the audit log
+func (s *Store) ReadAudit() (AuditLog, error) {
+	slog.Debug("Reading audit log")
+	var audit AuditLog
+	err := s.readJSON(AuditFile, &audit)
+	return audit, err
+}
+
+// WriteAudit writes the audit log to the data store
+func (s *Store) WriteAudit(audit AuditLog) error {
+	slog.Debug("Writing audit log")
+	return s.writeJSON(AuditFile, audit)
+}
+
+// ReadWebhooks reads the webhook endpoints from the data store
+func (s *Store) ReadWebhooks() (Webhooks, error) {
+	slog.Debug("Reading webhooks")
+	webhooks := make(Webhooks)
+	if err := s.readJSON(WebhooksFile, &webhooks); err != nil {
+		return webhooks, err
+	}
+	for id, hook := range webhooks {
+		secret, err := s.keyring.Decrypt(hook.Secret)
+		if err != nil {
+			return webhooks, fmt.Errorf("secret of webhook %s: %w", id, err)
+		}
+		hook.Secret = secret
+		webhooks[id] = hook
+	}
+	return webhooks, nil
+}
+
+// WriteWebhooks writes the webhook endpoints to the data store
+func (s *Store) WriteWebhooks(webhooks Webhooks) error {
+	slog.Debug("Writing webhooks")
+	encrypted := make(Webhooks, len(webhooks))
+	for id, hook := range webhooks {
+		secret, err := s.keyring.Encrypt(hook.Secret)
+		if err != nil {
+			return err
+		}
+		hook.Secret = secret
+		encrypted[id] = hook
+	}
+	return s.writeJSON(WebhooksFile, encrypted)
+}
+
+// ReadWebhookQueue reads the webhook deliveries that haven't been made yet
+func (s *Store) ReadWebhookQueue() ([]Delivery, error) {
+	slog.Debug("Reading webhook queue")
+	var queue []Delivery
+	err := s.readJSON(WebhookQueueFile, &queue)
+	return queue, err
+}
+
+// WriteWebhookQueue writes the pending webhook deliveries to the data store
+func (s *Store) WriteWebhookQueue(queue []Delivery) error {
+	slog.Debug("Writing webhook queue", "count", len(queue))
+	if queue == nil {
+		queue = []Delivery{}
+	}
+	return s.writeJSON(WebhookQueueFile, queue)
+}
+
+// ReadInstallations reads the workspaces the app was installed in
+func (s *Store) ReadInstallations() (Installations, error) {
+	slog.Debug("Reading installations")
+	installations := make(Installations)
+	if err := s.readJSON(InstallationsFile, &installations); err != nil {
+		return installations, err
+	}
+	for teamID, inst := range installations {
+		token, err := s.keyring.Decrypt(inst.BotToken)
+		if err != nil {
+			return installations, fmt.Errorf("bot token of workspace %s: %w", teamID, err)
+		}
+		inst.BotToken = token
+		installations[teamID] = inst
+	}
+	return installations, nil
+}
+
+// WriteInstallations writes the workspaces the app was installed in
+func (s *Store) WriteInstallations(installations Installations) error {
+	slog.Debug("Writing installations")
+	encrypted := make(Installations, len(installations))
+	for teamID, inst := range installations {
+		token, err := s.keyring.Encrypt(inst.BotToken)
+		if err != nil {
+			return err
+		}
+		inst.BotToken = token
+		encrypted[teamID] = inst
+	}
+	return s.writeJSON(InstallationsFile, encrypted)
+}
+
+// Read a data file into v. A missing file leaves v as it is.
+func (s *Store) readJSON(filename string, v interface{}) error {
+	data, err := s.backend.read(filename)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		slog.Debug("Data file does not exist, starting empty", "file", filename)
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *Store) writeJSON(filename string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.backend.write(filename, data)
+}
+
+// jsonFiles keeps each document in its own file in the data directory
+type jsonFiles struct {
+	dir string
+}
+
+func (j jsonFiles) read(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (j jsonFiles) write(name string, data []byte) error {
+	// Workspace directories are only created once something is written to them
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(j.dir, name), data)
+}
+
+func (j jsonFiles) exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(j.dir, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (j jsonFiles) names() ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(j.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		rel, err := filepath.Rel(j.dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
+
+func (j jsonFiles) location() string {
+	return j.dir
+}
+
+func (j jsonFiles) close() error {
+	return nil
+}
+
+// prefixed keeps the documents of a workspace in a shared backend by
+// putting the workspace in front of their names. The backend is closed
+// with the store that owns it.
+type prefixed struct {
+	backend
+	prefix string
+}
+
+func (p prefixed) read(name string) ([]byte, error) {
+	return p.backend.read(p.prefix + name)
+}
+
+func (p prefixed) write(name string, data []byte) error {
+	return p.backend.write(p.prefix+name, data)
+}
+
+func (p prefixed) exists(name string) (bool, error) {
+	return p.backend.exists(p.prefix + name)
+}
+
+func (p prefixed) names() ([]string, error) {
+	all, err := p.backend.names()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, p.prefix) {
+			names = append(names, strings.TrimPrefix(name, p.prefix))
+		}
+	}
+	return names, nil
+}
+
+func (p prefixed) location() string {
+	return p.backend.location() + " (" + p.prefix + ")"
+}
+
+func (p prefixed) close() error {
+	return nil
+}
+
+// Write a data file by writing a temporary file and renaming it over the old one,
+// so a crash or shutdown mid-write never leaves a half written file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"slack-connect-manager/internal/secrets"
+)
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	st, err := Open(BackendSQLite, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if exists, err := st.HasData(); err != nil || exists {
+		t.Fatalf("HasData() = %v, %v on a new database", exists, err)
+	}
+	if err := st.EnsureFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if teams, err := st.ReadTeams(); err != nil || len(teams.Teams) != 0 {
+		t.Fatalf("ReadTeams() = %v, %v on a new database", teams, err)
+	}
+
+	teams := Teams{Teams: map[string]Team{"acme": {
+		Members:   []Member{{MemberID: "U1", Name: "Alice", Channels: map[string]string{"C1": "proj-x"}}},
+		Tags:      map[string]string{"partner": "acme"},
+		CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}}}
+	if err := st.WriteTeams(teams); err != nil {
+		t.Fatal(err)
+	}
+	// Writing again replaces the document
+	teams.Teams["acme"] = Team{Members: []Member{}, Description: "Acme partners"}
+	if err := st.WriteTeams(teams); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := st.ReadTeams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, teams) {
+		t.Errorf("ReadTeams() = %+v, want %+v", got, teams)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := New(dir)
+	if err := src.WriteTeams(testTeams()); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.WriteUsers(Users{"U1": {MemberID: "U1", Name: "Alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.WriteChannels(Channels{"C1": {ID: "C1", Name: "proj-x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(BackendSQLite, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	teams, _ := dst.ReadTeams()
+	if !reflect.DeepEqual(teams, testTeams()) {
+		t.Errorf("copied teams = %+v", teams)
+	}
+	users, _ := dst.ReadUsers()
+	channels, _ := dst.ReadChannels()
+	if users["U1"].Name != "Alice" || channels["C1"].Name != "proj-x" {
+		t.Errorf("copied users = %+v, channels = %+v", users, channels)
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	for _, kind := range Backends {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			root, err := Open(kind, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+
+			if _, err := root.Workspace("../T2"); err == nil {
+				t.Error("Workspace() accepted a team ID with a path in it")
+			}
+			ws, err := root.Workspace("T2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := root.Workspace("T2"); again != ws {
+				t.Error("Workspace() returned a second store for the same team")
+			}
+			if err := ws.WriteTeams(testTeams()); err != nil {
+				t.Fatal(err)
+			}
+
+			if teams, _ := root.ReadTeams(); len(teams.Teams) != 0 {
+				t.Errorf("top level teams = %v, want none", teams.Teams)
+			}
+			if teams, _ := ws.ReadTeams(); !reflect.DeepEqual(teams, testTeams()) {
+				t.Errorf("workspace teams = %+v", teams)
+			}
+		})
+	}
+}
+
+func TestCopyWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	src := New(dir)
+	if err := src.WriteInstallations(Installations{"T2": {TeamID: "T2", BotToken: "xoxb-globex"}}); err != nil {
+		t.Fatal(err)
+	}
+	ws, _ := src.Workspace("T2")
+	if err := ws.WriteTeams(testTeams()); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(BackendSQLite, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	installations, _ := dst.ReadInstallations()
+	copied, _ := dst.Workspace("T2")
+	teams, _ := copied.ReadTeams()
+	if installations["T2"].BotToken != "xoxb-globex" || !reflect.DeepEqual(teams, testTeams()) {
+		t.Errorf("copied installations = %+v, workspace teams = %+v", installations, teams)
+	}
+}
+
+func TestEncryptedSecrets(t *testing.T) {
+	dir := t.TempDir()
+	st := New(dir)
+	// Written before there was a key
+	if err := st.WriteWebhooks(Webhooks{"wh_1": {ID: "wh_1", Secret: "plain-secret"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := secrets.NewKeyring(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetKeyring(first)
+	ws, _ := st.Workspace("T2")
+	if err := st.WriteInstallations(Installations{"T2": {TeamID: "T2", BotToken: "xoxb-globex"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteWebhooks(Webhooks{"wh_2": {ID: "wh_2", Secret: "workspace-secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	if hooks, err := st.ReadWebhooks(); err != nil || hooks["wh_1"].Secret != "plain-secret" {
+		t.Errorf("plaintext secret read back as %+v, %v", hooks, err)
+	}
+
+	second, err := first.Rotate(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := st.RotateKey(second)
+	if err != nil || count != 3 {
+		t.Fatalf("RotateKey() = %d, %v", count, err)
+	}
+
+	for _, name := range []string{InstallationsFile, WebhooksFile, filepath.Join(WorkspacesDir, "T2", WebhooksFile)} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "xoxb-globex") || strings.Contains(string(data), "plain-secret") ||
+			!strings.Contains(string(data), secrets.Prefix+second.KeyID()) {
+			t.Errorf("%s isn't encrypted with the new key:\n%s", name, data)
+		}
+	}
+
+	installations, err := st.ReadInstallations()
+	if err != nil || installations["T2"].BotToken != "xoxb-globex" {
+		t.Errorf("ReadInstallations() = %+v, %v", installations, err)
+	}
+	if hooks, err := ws.ReadWebhooks(); err != nil || hooks["wh_2"].Secret != "workspace-secret" {
+		t.Errorf("workspace webhooks = %+v, %v", hooks, err)
+	}
+
+	// The old key can't read them any more
+	st.SetKeyring(first)
+	if _, err := st.ReadInstallations(); err == nil {
+		t.Error("ReadInstallations() worked with the old key")
+	}
+}
+
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	encoded, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := secrets.ParseKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// A backend whose writes fail
+type failingWrites struct {
+	backend
+}
+
+func (f failingWrites) write(name string, data []byte) error {
+	return errors.New("disk full")
+}
+
+func TestRotateKeyRollsBack(t *testing.T) {
+	st := New(t.TempDir())
+	first, _ := secrets.NewKeyring(newTestKey(t))
+	st.SetKeyring(first)
+	ws, _ := st.Workspace("T2")
+	if err := st.WriteInstallations(Installations{"T2": {TeamID: "T2", BotToken: "xoxb-globex"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WriteWebhooks(Webhooks{"wh_1": {ID: "wh_1", Secret: "top-secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteWebhooks(Webhooks{"wh_2": {ID: "wh_2", Secret: "workspace-secret"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The workspace's webhooks are written last, after the others were re-encrypted
+	working := ws.backend
+	ws.backend = failingWrites{working}
+	second, _ := first.Rotate(newTestKey(t))
+	if _, err := st.RotateKey(second); err == nil || !strings.Contains(err.Error(), "put back under the old key") {
+		t.Fatalf("RotateKey() error = %v, want the rotation rolled back", err)
+	}
+
+	// The old key alone still reads everything
+	installations, err := st.ReadInstallations()
+	hooks, hooksErr := st.ReadWebhooks()
+	if err != nil || hooksErr != nil || installations["T2"].BotToken != "xoxb-globex" || hooks["wh_1"].Secret != "top-secret" {
+		t.Errorf("after the failed rotation: installations = %+v, %v, webhooks = %+v, %v", installations, err, hooks, hooksErr)
+	}
+
+	// And the rotation can be run again
+	ws.backend = working
+	if count, err := st.RotateKey(second); err != nil || count != 3 {
+		t.Errorf("RotateKey() again = %d, %v", count, err)
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	st := New(t.TempDir())
+	if err := st.WriteTeams(Teams{Teams: map[string]Team{
+		"acme": {
+			Members:        []Member{{MemberID: "U1"}, {MemberID: ""}, {MemberID: "U1"}},
+			Subteams:       []string{"infra", "ghost"},
+			Aliases:        []string{"infra", "partners"},
+			DefaultChannel: "C9",
+		},
+		"infra": {Members: []Member{{MemberID: "U2"}}, Subteams: []string{"acme"}, Aliases: []string{"partners"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WriteUsers(Users{"U1": {MemberID: "U2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WriteChannels(Channels{"C1": {ID: "", Name: "proj-x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := st.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`channel C1 is stored with ID ""`,
+		`user U1 is stored with member ID "U2"`,
+		"team acme has a member without an ID",
+		"team acme has member U1 more than once",
+		"team acme includes team ghost, which doesn't exist",
+		"alias infra of team acme is also the name of a team",
+		"default channel C9 of team acme isn't tracked",
+		"alias partners of team infra is also an alias of team acme",
+		"team acme includes itself through team infra",
+		"team infra includes itself through team acme",
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("Check() =\n%q\nwant\n%q", problems, want)
+	}
+
+	fixes, err := st.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dropping one side of the loop fixes the other
+	if len(fixes) != len(want)-1 {
+		t.Errorf("Repair() = %q", fixes)
+	}
+	if problems, _ := st.Check(); len(problems) != 0 {
+		t.Errorf("Check() after Repair() = %q", problems)
+	}
+
+	teams, _ := st.ReadTeams()
+	acme := teams.Teams["acme"]
+	if got := memberIDs(acme.Members); !reflect.DeepEqual(got, []string{"U1"}) {
+		t.Errorf("acme members = %v, want [U1]", got)
+	}
+	if !reflect.DeepEqual(acme.Aliases, []string{"partners"}) || acme.DefaultChannel != "" || len(acme.Subteams) != 0 {
+		t.Errorf("acme = %+v", acme)
+	}
+}
@@ -0,0 +1,221 @@
+package store
+
+import "sort"
+
+// Members returns everyone in a team, including the members of its subteams
+// and theirs, without duplicates. The team's own members come first.
+func (teams Teams) Members(name string) []Member {
+	var members []Member
+	seenMembers := make(map[string]bool)
+	seenTeams := make(map[string]bool)
+
+	var walk func(name string)
+	walk = func(name string) {
+		// Cycles can't be created with the commands, but don't loop forever
+		// if someone edits the file by hand
+		if seenTeams[name] {
+			return
+		}
+		seenTeams[name] = true
+
+		team := teams.Teams[name]
+		for _, member := range team.Members {
+			if !seenMembers[member.MemberID] {
+				seenMembers[member.MemberID] = true
+				members = append(members, member)
+			}
+		}
+		for _, subteam := range team.Subteams {
+			walk(subteam)
+		}
+	}
+	walk(name)
+	return members
+}
+
+// Contains reports whether a team includes another, directly or through
+// its subteams. A team counts as containing itself.
+func (teams Teams) Contains(name, other string) bool {
+	seen := make(map[string]bool)
+	var walk func(name string) bool
+	walk = func(name string) bool {
+		if name == other {
+			return true
+		}
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		for _, subteam := range teams.Teams[name].Subteams {
+			if walk(subteam) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(name)
+}
+
+// Parents returns the teams that include a team, directly or through other
+// subteams, sorted by name
+func (teams Teams) Parents(name string) []string {
+	var parents []string
+	for parent := range teams.Teams {
+		if parent != name && teams.Contains(parent, name) {
+			parents = append(parents, parent)
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// RemoveSubteam removes a subteam from a team's list of subteams. Returns
+// false if it wasn't there.
+func (teams Teams) RemoveSubteam(name, subteam string) bool {
+	team, exists := teams.Teams[name]
+	if !exists {
+		return false
+	}
+	for i, existing := range team.Subteams {
+		if existing == subteam {
+			team.Subteams = append(team.Subteams[:i:i], team.Subteams[i+1:]...)
+			teams.Teams[name] = team
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve finds the name of a team from its name or one of its aliases
+func (teams Teams) Resolve(nameOrAlias string) (string, bool) {
+	if _, exists := teams.Teams[nameOrAlias]; exists {
+		return nameOrAlias, true
+	}
+	for name, team := range teams.Teams {
+		for _, alias := range team.Aliases {
+			if alias == nameOrAlias {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Rename renames a team and updates the teams that include it. The new name
+// must not be in use by another team. If it was one of the team's aliases,
+// it stops being an alias.
+func (teams Teams) Rename(oldName, newName string) {
+	team := teams.Teams[oldName]
+	team.Aliases = remove(team.Aliases, newName)
+	teams.Teams[newName] = team
+	delete(teams.Teams, oldName)
+	teams.replaceSubteam(oldName, newName)
+}
+
+// Merge moves everything in the source team into the target team and
+// removes the source. Members in both teams are kept once, with the
+// channels seen for either. The target keeps its own details where both
+// teams have them, and the teams that included the source include the
+// target instead.
+func (teams Teams) Merge(source, target string) {
+	from, into := teams.Teams[source], teams.Teams[target]
+
+	for _, member := range from.Members {
+		into.Members = mergeMember(into.Members, member)
+	}
+
+	for _, subteam := range from.Subteams {
+		if subteam != target && !contains(into.Subteams, subteam) {
+			into.Subteams = append(into.Subteams, subteam)
+		}
+	}
+	into.Subteams = remove(into.Subteams, source)
+
+	if into.Description == "" {
+		into.Description = from.Description
+	}
+	if into.DefaultChannel == "" {
+		into.DefaultChannel = from.DefaultChannel
+	}
+	for _, owner := range from.Owners {
+		if !contains(into.Owners, owner) {
+			into.Owners = append(into.Owners, owner)
+		}
+	}
+	for _, alias := range from.Aliases {
+		if alias != target && !contains(into.Aliases, alias) {
+			into.Aliases = append(into.Aliases, alias)
+		}
+	}
+	for key, value := range from.Tags {
+		if _, exists := into.Tags[key]; exists {
+			continue
+		}
+		if into.Tags == nil {
+			into.Tags = make(map[string]string)
+		}
+		into.Tags[key] = value
+	}
+
+	teams.Teams[target] = into
+	delete(teams.Teams, source)
+	teams.replaceSubteam(source, target)
+}
+
+// Point every team that includes a team at another one instead
+func (teams Teams) replaceSubteam(oldName, newName string) {
+	for name, team := range teams.Teams {
+		if !contains(team.Subteams, oldName) {
+			continue
+		}
+		team.Subteams = remove(team.Subteams, oldName)
+		if name != newName && !contains(team.Subteams, newName) {
+			team.Subteams = append(team.Subteams, newName)
+		}
+		teams.Teams[name] = team
+	}
+}
+
+// Add a member to a list, or if they're already in it, add the channels
+// they were seen in to the existing entry
+func mergeMember(members []Member, member Member) []Member {
+	for i, existing := range members {
+		if existing.MemberID != member.MemberID {
+			continue
+		}
+		if existing.Name == "" {
+			existing.Name = member.Name
+		}
+		for channelID, memberID := range member.Channels {
+			if existing.Channels == nil {
+				existing.Channels = make(map[string]string)
+			}
+			if _, ok := existing.Channels[channelID]; !ok {
+				existing.Channels[channelID] = memberID
+			}
+		}
+		members[i] = existing
+		return members
+	}
+	return append(members, member)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A copy of a list without s
+func remove(list []string, s string) []string {
+	var kept []string
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
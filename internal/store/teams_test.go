@@ -0,0 +1,147 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testTeams() Teams {
+	return Teams{Teams: map[string]Team{
+		"acme":     {Members: []Member{{MemberID: "U1"}}, Subteams: []string{"acme-eng", "acme-pm"}},
+		"acme-eng": {Members: []Member{{MemberID: "U2"}, {MemberID: "U3"}}, Subteams: []string{"infra"}},
+		"acme-pm":  {Members: []Member{{MemberID: "U3"}, {MemberID: "U4"}}},
+		"infra":    {Members: []Member{{MemberID: "U1"}, {MemberID: "U5"}}},
+		"other":    {Members: []Member{{MemberID: "U6"}}},
+	}}
+}
+
+func memberIDs(members []Member) []string {
+	var ids []string
+	for _, m := range members {
+		ids = append(ids, m.MemberID)
+	}
+	return ids
+}
+
+func TestMembersExpandsSubteams(t *testing.T) {
+	teams := testTeams()
+
+	got := memberIDs(teams.Members("acme"))
+	want := []string{"U1", "U2", "U3", "U5", "U4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Members(acme) = %v, want %v", got, want)
+	}
+
+	if got := memberIDs(teams.Members("other")); !reflect.DeepEqual(got, []string{"U6"}) {
+		t.Errorf("Members(other) = %v, want [U6]", got)
+	}
+}
+
+func TestMembersSurvivesCycles(t *testing.T) {
+	teams := testTeams()
+	infra := teams.Teams["infra"]
+	infra.Subteams = []string{"acme"}
+	teams.Teams["infra"] = infra
+
+	got := memberIDs(teams.Members("infra"))
+	want := []string{"U1", "U5", "U2", "U3", "U4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Members(infra) = %v, want %v", got, want)
+	}
+}
+
+func TestContainsAndParents(t *testing.T) {
+	teams := testTeams()
+
+	if !teams.Contains("acme", "infra") {
+		t.Error("acme should contain infra through acme-eng")
+	}
+	if teams.Contains("infra", "acme") {
+		t.Error("infra should not contain acme")
+	}
+	if !teams.Contains("other", "other") {
+		t.Error("a team should contain itself")
+	}
+
+	if got := teams.Parents("infra"); !reflect.DeepEqual(got, []string{"acme", "acme-eng"}) {
+		t.Errorf("Parents(infra) = %v, want [acme acme-eng]", got)
+	}
+	if got := teams.Parents("acme"); len(got) != 0 {
+		t.Errorf("Parents(acme) = %v, want none", got)
+	}
+}
+
+func TestRemoveSubteam(t *testing.T) {
+	teams := testTeams()
+
+	if !teams.RemoveSubteam("acme", "acme-eng") {
+		t.Fatal("RemoveSubteam(acme, acme-eng) = false")
+	}
+	if got := teams.Teams["acme"].Subteams; !reflect.DeepEqual(got, []string{"acme-pm"}) {
+		t.Errorf("acme subteams = %v, want [acme-pm]", got)
+	}
+	if teams.RemoveSubteam("acme", "acme-eng") {
+		t.Error("removing a subteam twice should return false")
+	}
+}
+
+func TestRenameUpdatesParents(t *testing.T) {
+	teams := testTeams()
+	eng := teams.Teams["acme-eng"]
+	eng.Aliases = []string{"eng", "engineering"}
+	teams.Teams["acme-eng"] = eng
+
+	teams.Rename("acme-eng", "engineering")
+
+	if _, exists := teams.Teams["acme-eng"]; exists {
+		t.Error("old name still exists")
+	}
+	renamed := teams.Teams["engineering"]
+	if len(renamed.Members) != 2 || !reflect.DeepEqual(renamed.Aliases, []string{"eng"}) {
+		t.Errorf("renamed team = %+v", renamed)
+	}
+	if got := teams.Teams["acme"].Subteams; !reflect.DeepEqual(got, []string{"acme-pm", "engineering"}) {
+		t.Errorf("acme subteams = %v, want [acme-pm engineering]", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	teams := testTeams()
+	teams.Teams["acme-pm"] = Team{
+		Members: []Member{
+			{MemberID: "U3", Name: "Carol", Channels: map[string]string{"C2": "U3"}},
+			{MemberID: "U4"},
+		},
+		Owners:  []string{"U4"},
+		Aliases: []string{"pm"},
+		Tags:    map[string]string{"project": "apollo"},
+	}
+	teams.Teams["acme-eng"] = Team{
+		Members:  []Member{{MemberID: "U2"}, {MemberID: "U3", Channels: map[string]string{"C1": "U3"}}},
+		Subteams: []string{"infra"},
+		Tags:     map[string]string{"project": "gemini"},
+	}
+
+	teams.Merge("acme-pm", "acme-eng")
+
+	if _, exists := teams.Teams["acme-pm"]; exists {
+		t.Error("source team still exists")
+	}
+	merged := teams.Teams["acme-eng"]
+	if got := memberIDs(merged.Members); !reflect.DeepEqual(got, []string{"U2", "U3", "U4"}) {
+		t.Errorf("members = %v, want [U2 U3 U4]", got)
+	}
+	carol := merged.Members[1]
+	if carol.Name != "Carol" || !reflect.DeepEqual(carol.Channels, map[string]string{"C1": "U3", "C2": "U3"}) {
+		t.Errorf("Carol = %+v, want her name and both channels", carol)
+	}
+	if !reflect.DeepEqual(merged.Owners, []string{"U4"}) || !reflect.DeepEqual(merged.Aliases, []string{"pm"}) {
+		t.Errorf("owners = %v, aliases = %v", merged.Owners, merged.Aliases)
+	}
+	if merged.Tags["project"] != "gemini" {
+		t.Errorf("project tag = %q, want the target's", merged.Tags["project"])
+	}
+	if got := teams.Teams["acme"].Subteams; !reflect.DeepEqual(got, []string{"acme-eng"}) {
+		t.Errorf("acme subteams = %v, want [acme-eng]", got)
+	}
+}
@@ -0,0 +1,159 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+)
+
+// The message subtypes that are someone posting, rather than e.g. joining
+// the channel or editing a message
+var postSubtypes = map[string]bool{"": true, "thread_broadcast": true, "file_share": true, "me_message": true}
+
+// MessagePosted counts a message in a tracked channel towards its author's
+// activity. Bot messages and the ones that aren't someone posting are skipped.
+func (w *Worker) MessagePosted(ctx context.Context, channelID, userID, subType, botID, ts string) {
+	at, ok := postTime(userID, subType, botID, ts)
+	if !ok {
+		return
+	}
+	err := w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		if _, tracked := channels[channelID]; !tracked {
+			return nil
+		}
+		activity, err := w.store.ReadActivity()
+		if err != nil {
+			return err
+		}
+		if !activity.Record(channelID, userID, at) {
+			return nil
+		}
+		return w.store.WriteActivity(activity)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording message", "channel_id", channelID, "user_id", userID, "error", err)
+	}
+}
+
+// Count the messages of the last store.ActivityBackfill from a tracked
+// channel's history, the first time it's synced. If the history can't be
+// read, it's tried again with backoff rather than on every sync.
+func (w *Worker) backfillActivity(ctx context.Context, channelID string) {
+	activity, err := w.store.ReadActivity()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading activity", "error", err)
+		return
+	}
+	if !activity.BackfillDue(channelID, time.Now()) {
+		return
+	}
+
+	upTo := time.Now()
+	posts := make(map[string][]time.Time)
+	params := &slack.GetConversationHistoryParameters{
+		ChannelID: channelID,
+		Oldest:    slackTimestamp(upTo.Add(-store.ActivityBackfill)),
+		Latest:    slackTimestamp(upTo),
+		Limit:     200,
+	}
+	for {
+		history, err := w.slack.GetConversationHistoryContext(ctx, params)
+		if err != nil {
+			next := w.backfillFailed(ctx, channelID)
+			// Tokens from before the history scopes were asked for
+			if slackapi.ErrorCode(err) == "missing_scope" {
+				slog.DebugContext(ctx, "Can't read channel history without the channels:history and groups:history scopes",
+					"channel_id", channelID, "next_attempt", next)
+				return
+			}
+			slog.ErrorContext(ctx, "Error reading channel history", "channel_id", channelID, "next_attempt", next, "error", err)
+			return
+		}
+		for _, message := range history.Messages {
+			if at, ok := postTime(message.User, message.SubType, message.BotID, message.Timestamp); ok {
+				posts[message.User] = append(posts[message.User], at)
+			}
+		}
+		if !history.HasMore || history.ResponseMetaData.NextCursor == "" {
+			break
+		}
+		params.Cursor = history.ResponseMetaData.NextCursor
+	}
+
+	err = w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		if _, tracked := channels[channelID]; !tracked {
+			return nil
+		}
+		activity, err := w.store.ReadActivity()
+		if err != nil {
+			return err
+		}
+		activity.Backfill(channelID, upTo, posts)
+		return w.store.WriteActivity(activity)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing activity", "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "Counted messages from channel history", "channel_id", channelID, "posters", len(posts))
+}
+
+// Record a failed attempt at reading a channel's history, and return when
+// it will be tried again
+func (w *Worker) backfillFailed(ctx context.Context, channelID string) time.Time {
+	var next time.Time
+	err := w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		if _, tracked := channels[channelID]; !tracked {
+			return nil
+		}
+		activity, err := w.store.ReadActivity()
+		if err != nil {
+			return err
+		}
+		next = activity.BackfillFailed(channelID, time.Now())
+		return w.store.WriteActivity(activity)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing activity", "error", err)
+	}
+	return next
+}
+
+// When a message was posted, if it's a person posting
+func postTime(userID, subType, botID, ts string) (time.Time, bool) {
+	if userID == "" || botID != "" || !postSubtypes[subType] {
+		return time.Time{}, false
+	}
+	seconds, micros, _ := strings.Cut(ts, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	usec, _ := strconv.ParseInt(micros, 10, 64)
+	return time.Unix(sec, usec*1000), true
+}
+
+// A time as a Slack message timestamp, e.g. for the bounds of conversations.history
+func slackTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
@@ -0,0 +1,42 @@
+package syncer
+
+import (
+	"context"
+	"log/slog"
+
+	"slack-connect-manager/internal/webhooks"
+)
+
+// ChannelRenamed keeps the name of a tracked channel current, so commands
+// can find it by its new name
+func (w *Worker) ChannelRenamed(ctx context.Context, channelID, name string) {
+	oldName, tracked, err := w.store.RenameChannel(channelID, name)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error renaming channel", "channel_id", channelID, "error", err)
+		return
+	}
+	if !tracked || oldName == name {
+		return
+	}
+	slog.InfoContext(ctx, "Tracked channel renamed", "channel_id", channelID, "old_channel", oldName, "channel", name)
+	event := webhooks.NewEvent(webhooks.ChannelRenamed)
+	event.Channel = &webhooks.Channel{ID: channelID, Name: name}
+	event.PreviousName = oldName
+	w.emit(ctx, event)
+}
+
+// ChannelArchived records that a tracked channel was archived. It stays
+// tracked, with the members it had.
+func (w *Worker) ChannelArchived(ctx context.Context, channelID string) {
+	channels, err := w.store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return
+	}
+	channel, tracked := channels[channelID]
+	if !tracked {
+		return
+	}
+	slog.InfoContext(ctx, "Tracked channel archived", "channel", channel.Name, "channel_id", channelID)
+	w.emit(ctx, trackedEvent(webhooks.ChannelArchived, channel))
+}
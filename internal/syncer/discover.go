@@ -0,0 +1,359 @@
+package syncer
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+// Discovery is what a discovery pass found
+type Discovery struct {
+	// Shared channels the bot can see
+	Shared int
+	// Channels that started being tracked
+	Added []store.Channel
+	// Names of the public shared channels the bot couldn't join
+	Failed []string
+}
+
+// Join errors that won't go away by trying again, like the channel being
+// archived or the bot not being allowed to join it
+var permanentJoinErrors = map[string]bool{
+	"channel_not_found":                     true,
+	"is_archived":                           true,
+	"method_not_supported_for_channel_type": true,
+	"missing_scope":                         true,
+	"not_allowed_token_type":                true,
+	"restricted_action":                     true,
+}
+
+// EnableDiscovery makes the sync loop run Discover every interval
+// (DefaultDiscoverInterval if zero), and ChannelShared track channels as soon
+// as they're shared. Call it before Start.
+func (w *Worker) EnableDiscovery(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultDiscoverInterval
+	}
+	w.discover = true
+	w.discoverInterval = interval
+}
+
+// Discover tracks every Slack Connect channel the bot can see, joining the
+// public ones it isn't in, and records which organizations each tracked
+// channel is shared with. Private channels are only found once the bot has
+// been invited to them. The new channels are synced by the next sync pass.
+func (w *Worker) Discover(ctx context.Context) (Discovery, error) {
+	var result Discovery
+	teamID := w.ownTeamID(ctx)
+
+	// Private channels are only listed if the bot is in them
+	var listed []slack.Channel
+	params := &slack.GetConversationsParameters{
+		Types:           []string{"public_channel", "private_channel"},
+		ExcludeArchived: true,
+		Limit:           200,
+	}
+	for {
+		page, cursor, err := w.slack.GetConversationsContext(ctx, params)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error listing channels", "error", err)
+			return result, err
+		}
+		listed = append(listed, page...)
+		if cursor == "" {
+			break
+		}
+		params.Cursor = cursor
+	}
+
+	channels, err := w.store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return result, err
+	}
+
+	// Join the shared channels we don't track yet before taking the store lock
+	sharedWith := make(map[string][]string)
+	var candidates []store.Channel
+	for _, channel := range listed {
+		sharedWith[channel.ID] = sharedTeams(channel, teamID)
+		if !channel.IsExtShared && !channel.IsShared {
+			continue
+		}
+		result.Shared++
+		if _, tracked := channels[channel.ID]; tracked {
+			continue
+		}
+		if !channel.IsMember && !w.join(ctx, channel.ID) {
+			result.Failed = append(result.Failed, channel.Name)
+			continue
+		}
+		candidates = append(candidates, store.Channel{ID: channel.ID, Name: channel.Name, SharedWith: sharedWith[channel.ID], Discovered: true})
+	}
+
+	err = w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for id, channel := range channels {
+			orgs, listed := sharedWith[id]
+			if listed && !equal(orgs, channel.SharedWith) {
+				channel.SharedWith = orgs
+				channels[id] = channel
+				changed = true
+			}
+		}
+		for _, channel := range candidates {
+			if _, tracked := channels[channel.ID]; tracked {
+				continue
+			}
+			channels[channel.ID] = channel
+			result.Added = append(result.Added, channel)
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return w.store.WriteChannels(channels)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing channels", "error", err)
+		return result, err
+	}
+
+	var events []webhooks.Event
+	for _, channel := range result.Added {
+		slog.InfoContext(ctx, "Discovered shared channel", "channel", channel.Name, "channel_id", channel.ID, "shared_with", channel.SharedWith)
+		events = append(events, trackedEvent(webhooks.ChannelTracked, channel))
+	}
+	w.emit(ctx, events...)
+
+	slog.DebugContext(ctx, "Discovery completed", "shared", result.Shared, "added", len(result.Added), "failed", len(result.Failed))
+	return result, nil
+}
+
+// Join a channel, unless joining it already failed for good. Reports
+// whether the bot is now in the channel.
+func (w *Worker) join(ctx context.Context, channelID string) bool {
+	w.joinMu.Lock()
+	reason, failed := w.unjoinable[channelID]
+	w.joinMu.Unlock()
+	if failed {
+		slog.DebugContext(ctx, "Not trying to join shared channel again", "channel_id", channelID, "reason", reason)
+		return false
+	}
+
+	_, _, _, err := w.slack.JoinConversationContext(ctx, channelID)
+	if err == nil {
+		return true
+	}
+	slog.ErrorContext(ctx, "Error joining shared channel", "channel_id", channelID, "error", err)
+	if code := slackapi.ErrorCode(err); permanentJoinErrors[code] {
+		w.joinMu.Lock()
+		w.unjoinable[channelID] = code
+		w.joinMu.Unlock()
+	}
+	return false
+}
+
+// ChannelShared records that a channel was shared with another
+// organization's team. With discovery on, a channel that isn't tracked yet
+// starts being tracked and is synced.
+func (w *Worker) ChannelShared(ctx context.Context, channelID, teamID string) {
+	var added bool
+	var channel store.Channel
+	err := w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		var tracked bool
+		channel, tracked = channels[channelID]
+		if !tracked {
+			return nil
+		}
+		channel.SharedWith = addTeam(channel.SharedWith, teamID)
+		channels[channelID] = channel
+		return w.store.WriteChannels(channels)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording shared channel", "channel_id", channelID, "error", err)
+		return
+	}
+	if channel.ID != "" {
+		slog.InfoContext(ctx, "Tracked channel shared", "channel", channel.Name, "channel_id", channelID, "team_id", teamID)
+		return
+	}
+	if !w.discover {
+		return
+	}
+
+	info, err := w.slack.GetConversationInfoContext(ctx, &slack.GetConversationInfoInput{ChannelID: channelID})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting shared channel info", "channel_id", channelID, "error", err)
+		return
+	}
+	if !info.IsMember {
+		if info.IsPrivate {
+			slog.InfoContext(ctx, "Not tracking shared private channel the bot isn't in", "channel_id", channelID)
+			return
+		}
+		if _, _, _, err := w.slack.JoinConversationContext(ctx, channelID); err != nil {
+			slog.ErrorContext(ctx, "Error joining shared channel", "channel_id", channelID, "error", err)
+			return
+		}
+	}
+
+	channel = store.Channel{
+		ID:         channelID,
+		Name:       info.Name,
+		SharedWith: addTeam(sharedTeams(*info, w.ownTeamID(ctx)), teamID),
+		Discovered: true,
+	}
+	err = w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		if _, tracked := channels[channelID]; tracked {
+			return nil
+		}
+		channels[channelID] = channel
+		added = true
+		return w.store.WriteChannels(channels)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing channels", "error", err)
+		return
+	}
+	if !added {
+		return
+	}
+
+	slog.InfoContext(ctx, "Discovered shared channel", "channel", channel.Name, "channel_id", channelID, "shared_with", channel.SharedWith)
+	w.emit(ctx, trackedEvent(webhooks.ChannelTracked, channel))
+	w.SyncInBackground(ctx, channelID)
+}
+
+// ChannelUnshared records that a channel is no longer shared with another
+// organization's team. A channel discovery started tracking stops being
+// tracked once it isn't shared with anyone. Channels people added stay.
+func (w *Worker) ChannelUnshared(ctx context.Context, channelID, teamID string, stillShared bool) {
+	var channel store.Channel
+	var untracked bool
+	err := w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		var tracked bool
+		channel, tracked = channels[channelID]
+		if !tracked {
+			return nil
+		}
+		channel.SharedWith = removeTeam(channel.SharedWith, teamID)
+		if !stillShared {
+			channel.SharedWith = nil
+		}
+		if channel.Discovered && !stillShared {
+			delete(channels, channelID)
+			untracked = true
+		} else {
+			channels[channelID] = channel
+		}
+		return w.store.WriteChannels(channels)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording unshared channel", "channel_id", channelID, "error", err)
+		return
+	}
+	if channel.ID == "" {
+		return
+	}
+
+	slog.InfoContext(ctx, "Tracked channel unshared", "channel", channel.Name, "channel_id", channelID, "team_id", teamID)
+	if untracked {
+		slog.InfoContext(ctx, "Stopped tracking discovered channel that is no longer shared", "channel", channel.Name, "channel_id", channelID)
+		w.emit(ctx, trackedEvent(webhooks.ChannelUntracked, channel))
+	}
+}
+
+// The bot's own team, which Slack lists among the teams of a shared channel.
+// Asked once and remembered.
+func (w *Worker) ownTeamID(ctx context.Context) string {
+	w.teamMu.Lock()
+	defer w.teamMu.Unlock()
+	if w.teamID == "" {
+		authTest, err := w.slack.AuthTestContext(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting the bot's team", "error", err)
+			return ""
+		}
+		w.teamID = authTest.TeamID
+	}
+	return w.teamID
+}
+
+// The other organizations' teams a channel is shared with, sorted
+func sharedTeams(channel slack.Channel, ownTeamID string) []string {
+	var teams []string
+	for _, id := range append(channel.SharedTeamIDs, channel.ConnectedTeamIDs...) {
+		if id != ownTeamID {
+			teams = addTeam(teams, id)
+		}
+	}
+	return teams
+}
+
+func addTeam(teams []string, teamID string) []string {
+	if teamID == "" {
+		return teams
+	}
+	for _, id := range teams {
+		if id == teamID {
+			return teams
+		}
+	}
+	teams = append(teams, teamID)
+	sort.Strings(teams)
+	return teams
+}
+
+func removeTeam(teams []string, teamID string) []string {
+	var kept []string
+	for _, id := range teams {
+		if id != teamID {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// An event for a channel starting or stopping being tracked without anyone running a command
+func trackedEvent(eventType string, channel store.Channel) webhooks.Event {
+	event := webhooks.NewEvent(eventType)
+	event.Channel = &webhooks.Channel{ID: channel.ID, Name: channel.Name}
+	return event
+}
@@ -0,0 +1,268 @@
+package syncer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"slack-connect-manager/internal/logging"
+)
+
+// The defaults for SetLimits
+const (
+	DefaultConcurrency = 4
+	DefaultMaxInterval = 5 * time.Minute
+)
+
+// How often auto discovery lists every channel, unless EnableDiscovery is
+// given an interval
+const DefaultDiscoverInterval = time.Hour
+
+// How long work handed to InBackground may take
+const backgroundTimeout = 5 * time.Minute
+
+// When a channel is next synced. Channels whose members change are synced
+// every interval. Each sync that finds no change doubles the time to the
+// next one, up to maxInterval.
+type schedule struct {
+	next     time.Time
+	interval time.Duration
+	// Set while the channel is syncing, so it's never synced twice at once
+	running bool
+	// Set when a sync was asked for while the channel was syncing. The
+	// channel is synced again as soon as the running sync finishes, since
+	// that one may have missed what the new sync was asked for.
+	again bool
+}
+
+// SetLimits sets how many channels sync at once and how long a channel
+// whose members aren't changing may go between syncs. Call it before Start.
+func (w *Worker) SetLimits(concurrency int, maxInterval time.Duration) {
+	w.slots = make(chan struct{}, max(concurrency, 1))
+	w.maxInterval = max(w.interval, maxInterval)
+}
+
+// SyncInBackground syncs a single channel now without blocking the caller.
+// If the channel is already syncing, it's synced again right after.
+// The sync keeps the request ID for logging but isn't cancelled with the request.
+func (w *Worker) SyncInBackground(ctx context.Context, channelID string) {
+	syncCtx := logging.WithRequestID(w.ctx, logging.RequestID(ctx))
+	if !w.claim(channelID) {
+		slog.DebugContext(syncCtx, "Channel is already syncing, syncing it again after", "channel_id", channelID)
+		w.scheduleMu.Lock()
+		if sched, ok := w.schedules[channelID]; ok && sched.running {
+			sched.again = true
+		}
+		w.scheduleMu.Unlock()
+		return
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.syncClaimed(syncCtx, channelID)
+	}()
+}
+
+// InBackground runs fn without blocking the caller, e.g. so a Slack event
+// that needs calls to Slack is acknowledged within Slack's 3 seconds. Like
+// SyncInBackground, fn keeps the request ID for logging but isn't cancelled
+// with the request, and Wait waits for it.
+func (w *Worker) InBackground(ctx context.Context, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), backgroundTimeout)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// SyncAll syncs every tracked channel now, a few at a time, and waits for
+// them. Channels that are already syncing are skipped.
+func (w *Worker) SyncAll(ctx context.Context) error {
+	channels, err := w.store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for channelID := range channels {
+		if !w.claim(channelID) {
+			continue
+		}
+		wg.Add(1)
+		go func(channelID string) {
+			defer wg.Done()
+			w.syncClaimed(ctx, channelID)
+		}(channelID)
+	}
+	wg.Wait()
+	slog.DebugContext(ctx, "User info update completed")
+	return ctx.Err()
+}
+
+// Sync the channels as they fall due until the context is cancelled
+func (w *Worker) run() {
+	slog.Info("Starting user info update routine")
+	var lastCheck, lastDiscover time.Time
+	for {
+		// Each round gets its own ID so its log lines can be grouped together
+		roundCtx := logging.WithRequestID(w.ctx, logging.NewRequestID())
+		// While channels are syncing, each one that finishes counts as
+		// progress, so a stuck sync shows up in /readyz
+		if w.idle() {
+			w.health.SyncAlive()
+		}
+		if time.Since(lastCheck) >= w.interval {
+			lastCheck = time.Now()
+			w.health.CheckAuth(roundCtx, w.slack)
+		}
+		// Listing every channel is expensive, so it's done much less often
+		if w.discover && time.Since(lastDiscover) >= w.discoverInterval {
+			lastDiscover = time.Now()
+			w.Discover(roundCtx)
+		}
+
+		due, err := w.claimDue(time.Now())
+		if err != nil {
+			slog.ErrorContext(roundCtx, "Error reading channels", "error", err)
+		}
+		if len(due) > 0 {
+			slog.DebugContext(roundCtx, "Updating user info", "channels", len(due))
+		}
+		for _, channelID := range due {
+			w.wg.Add(1)
+			go func(channelID string) {
+				defer w.wg.Done()
+				w.syncClaimed(logging.WithRequestID(w.ctx, logging.NewRequestID()), channelID)
+			}(channelID)
+		}
+
+		select {
+		case <-w.ctx.Done():
+			slog.Info("Stopping user info update routine")
+			return
+		case <-time.After(w.untilNextDue(time.Now())):
+		}
+	}
+}
+
+// Sync a channel claimed with claim once a slot is free, then schedule its
+// next sync by whether its members changed. The first sync of a channel also
+// counts the messages in its recent history.
+func (w *Worker) syncClaimed(ctx context.Context, channelID string) {
+	for {
+		select {
+		case w.slots <- struct{}{}:
+		case <-ctx.Done():
+			w.release(channelID, false)
+			return
+		}
+		changed := w.SyncChannel(ctx, channelID)
+		w.backfillActivity(ctx, channelID)
+		<-w.slots
+		w.health.SyncAlive()
+
+		if !w.release(channelID, changed) {
+			return
+		}
+	}
+}
+
+// Mark a channel as syncing. Returns false if it already is.
+func (w *Worker) claim(channelID string) bool {
+	w.scheduleMu.Lock()
+	defer w.scheduleMu.Unlock()
+	sched, ok := w.schedules[channelID]
+	if !ok {
+		sched = &schedule{interval: w.interval}
+		w.schedules[channelID] = sched
+	}
+	if sched.running {
+		return false
+	}
+	sched.running = true
+	return true
+}
+
+// Claim every tracked channel that is due. Channels that are new to the
+// worker are due at once, and channels no longer tracked are forgotten.
+func (w *Worker) claimDue(now time.Time) ([]string, error) {
+	channels, err := w.store.ReadChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	w.scheduleMu.Lock()
+	defer w.scheduleMu.Unlock()
+	for channelID, sched := range w.schedules {
+		if _, tracked := channels[channelID]; !tracked && !sched.running {
+			delete(w.schedules, channelID)
+		}
+	}
+	var due []string
+	for channelID := range channels {
+		sched, ok := w.schedules[channelID]
+		if !ok {
+			sched = &schedule{interval: w.interval}
+			w.schedules[channelID] = sched
+		}
+		if !sched.running && !sched.next.After(now) {
+			sched.running = true
+			due = append(due, channelID)
+		}
+	}
+	return due, nil
+}
+
+// Finish a sync and schedule the channel's next one. Reports true, with
+// the channel still claimed, if it has to be synced again right away.
+func (w *Worker) release(channelID string, changed bool) (again bool) {
+	w.scheduleMu.Lock()
+	defer w.scheduleMu.Unlock()
+	sched, ok := w.schedules[channelID]
+	if !ok {
+		return false
+	}
+	if changed {
+		sched.interval = w.interval
+	} else {
+		sched.interval = min(2*sched.interval, w.maxInterval)
+	}
+	sched.next = time.Now().Add(sched.interval)
+	if sched.again && w.ctx.Err() == nil {
+		sched.again = false
+		return true
+	}
+	sched.running = false
+	return false
+}
+
+// Whether no channel is syncing
+func (w *Worker) idle() bool {
+	w.scheduleMu.Lock()
+	defer w.scheduleMu.Unlock()
+	for _, sched := range w.schedules {
+		if sched.running {
+			return false
+		}
+	}
+	return true
+}
+
+// How long the loop can sleep before a channel is due. It wakes at least
+// once an interval to pick up new channels and check the Slack token, and
+// channels that finish syncing are never due sooner than that.
+func (w *Worker) untilNextDue(now time.Time) time.Duration {
+	w.scheduleMu.Lock()
+	defer w.scheduleMu.Unlock()
+	wait := w.interval
+	for _, sched := range w.schedules {
+		if !sched.running {
+			wait = min(wait, sched.next.Sub(now))
+		}
+	}
+	return max(wait, 0)
+}
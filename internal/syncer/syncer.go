@@ -0,0 +1,363 @@
+// Package syncer keeps the stored users and team members in step with the
+// members of the tracked channels.
+package syncer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/health"
+	"slack-connect-manager/internal/metrics"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/webhooks"
+)
+
+// Worker runs the periodic sync loop and one-off channel syncs
+type Worker struct {
+	// Cancelled when the server shuts down, which stops all syncing
+	ctx    context.Context
+	store  *store.Store
+	slack  slackapi.Client
+	health *health.State
+	// How often each channel is synced while its members are changing
+	interval time.Duration
+	// How often each channel is synced once its members have stopped changing
+	maxInterval time.Duration
+	// Told about members joining and leaving tracked channels. May be nil.
+	webhooks *webhooks.Dispatcher
+	// Whether shared channels are tracked without anyone adding them, and
+	// how often the sync loop looks for them
+	discover         bool
+	discoverInterval time.Duration
+	// Channels the bot can't join and why, so discovery stops trying
+	joinMu     sync.Mutex
+	unjoinable map[string]string
+
+	// The bot's own team, once we've asked Slack
+	teamMu sync.Mutex
+	teamID string
+
+	// Limits how many channels sync at once
+	slots chan struct{}
+	// When each tracked channel is next due, by channel ID
+	scheduleMu sync.Mutex
+	schedules  map[string]*schedule
+
+	// Tracks the sync loop and any one-off channel syncs so shutdown can wait for them
+	wg sync.WaitGroup
+}
+
+// New creates a sync worker. All syncs stop when ctx is cancelled.
+func New(ctx context.Context, st *store.Store, client slackapi.Client, h *health.State, interval time.Duration, hooks *webhooks.Dispatcher) *Worker {
+	return &Worker{
+		ctx:         ctx,
+		store:       st,
+		slack:       client,
+		health:      h,
+		interval:    interval,
+		maxInterval: max(interval, DefaultMaxInterval),
+		webhooks:    hooks,
+		slots:       make(chan struct{}, DefaultConcurrency),
+		schedules:   make(map[string]*schedule),
+		unjoinable:  make(map[string]string),
+	}
+}
+
+// Start runs the sync loop in the background
+func (w *Worker) Start() {
+	w.health.SyncAlive()
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run()
+	}()
+}
+
+// Wait blocks until the sync loop and all background syncs have stopped
+func (w *Worker) Wait() {
+	w.wg.Wait()
+}
+
+// SyncChannel updates user info for a specific channel, and reports whether
+// anyone joined or left since the last sync.
+// If the context is cancelled part way through, nothing is written.
+func (w *Worker) SyncChannel(ctx context.Context, channelID string) (changed bool) {
+	slog.DebugContext(ctx, "Updating users for channel", "channel_id", channelID)
+	start := time.Now()
+	defer func() { metrics.SyncDuration.Observe(channelID, time.Since(start).Seconds()) }()
+
+	// Get every page, since anyone missing would look like they left
+	var members []string
+	params := &slack.GetUsersInConversationParameters{ChannelID: channelID}
+	for {
+		page, cursor, err := w.slack.GetUsersInConversationContext(ctx, params)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting users in channel", "channel_id", channelID, "error", err)
+			return false
+		}
+		members = append(members, page...)
+		if cursor == "" {
+			break
+		}
+		params.Cursor = cursor
+	}
+
+	slog.DebugContext(ctx, "Found members in channel", "channel_id", channelID, "count", len(members))
+
+	// Look everyone up before touching the store, so the slow part doesn't
+	// hold the store lock
+	displayNames := make(map[string]string)
+	for _, memberID := range members {
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "Sync of channel cancelled", "channel_id", channelID)
+			return false
+		}
+
+		userInfo, err := w.slack.GetUserInfoContext(ctx, memberID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting user info", "user_id", memberID, "error", err)
+			continue
+		}
+
+		if userInfo.IsBot {
+			slog.DebugContext(ctx, "Skipping bot user", "user_id", memberID)
+			continue
+		}
+
+		displayNames[memberID] = slackapi.DisplayName(userInfo)
+	}
+
+	inChannel := make(map[string]bool)
+	for _, memberID := range members {
+		inChannel[memberID] = true
+	}
+
+	var events []webhooks.Event
+	err := w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading channels", "error", err)
+			return err
+		}
+		// Syncs of channels that aren't tracked, e.g. untracked while we were
+		// asking Slack, still update the users but send no events
+		channel, tracked := channels[channelID]
+		if !tracked {
+			channel = store.Channel{ID: channelID}
+		}
+
+		users, err := w.store.ReadUsers()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading users", "error", err)
+			return err
+		}
+
+		teams, err := w.store.ReadTeams()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading teams", "error", err)
+			return err
+		}
+
+		// History is only kept for tracked channels
+		memberships, err := w.store.ReadMemberships()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading memberships", "error", err)
+			return err
+		}
+		now := time.Now()
+
+		for memberID, displayName := range displayNames {
+			slog.DebugContext(ctx, "Updating info for user", "user_id", memberID, "display_name", displayName)
+
+			user, exists := users[memberID]
+			if !exists {
+				user = store.User{MemberID: memberID}
+			}
+			if user.Channels == nil {
+				user.Channels = make(map[string]string)
+			}
+			if _, wasIn := user.Channels[channelID]; !wasIn {
+				changed = true
+				if channel.Synced {
+					events = append(events, channelEvent(webhooks.ChannelMemberJoined, channel, memberID, displayName))
+				}
+			}
+			user.Name = displayName
+			user.UpdatedAt = now
+			user.Channels[channelID] = memberID
+			users[memberID] = user
+			if tracked {
+				memberships.Seen(channelID, memberID, now)
+			}
+
+			// Update team members
+			for teamName, team := range teams.Teams {
+				for i, member := range team.Members {
+					if member.MemberID == memberID {
+						updatedMember := member
+						updatedMember.Name = displayName
+						if updatedMember.Channels == nil {
+							updatedMember.Channels = make(map[string]string)
+						}
+						updatedMember.Channels[channelID] = memberID
+						teams.Teams[teamName].Members[i] = updatedMember
+						slog.DebugContext(ctx, "Updated team member", "user_id", memberID, "team", teamName)
+					}
+				}
+			}
+		}
+
+		// Anyone we saw in the channel before who isn't there now has left
+		for memberID, user := range users {
+			if _, wasIn := user.Channels[channelID]; !wasIn || inChannel[memberID] {
+				continue
+			}
+			slog.DebugContext(ctx, "User left channel", "user_id", memberID, "channel_id", channelID)
+			changed = true
+			removeFromChannel(users, teams, channelID, memberID)
+			if channel.Synced {
+				events = append(events, channelEvent(webhooks.ChannelMemberLeft, channel, memberID, user.Name))
+			}
+		}
+		if tracked {
+			// Including anyone whose users entry was lost, e.g. by a repair
+			for memberID := range memberships[channelID] {
+				if !inChannel[memberID] {
+					memberships.Left(channelID, memberID, now)
+				}
+			}
+			if err := w.store.WriteMemberships(memberships); err != nil {
+				slog.ErrorContext(ctx, "Error writing memberships", "error", err)
+			}
+		}
+
+		err = w.store.WriteUsers(users)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error writing users", "error", err)
+		}
+
+		err = w.store.WriteTeams(teams)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error writing teams", "error", err)
+		}
+
+		// The first sync only records who's there. Joins and leaves count from then on.
+		if tracked && !channel.Synced {
+			channel.Synced = true
+			channels[channelID] = channel
+			if err := w.store.WriteChannels(channels); err != nil {
+				slog.ErrorContext(ctx, "Error writing channels", "error", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	w.emit(ctx, events...)
+
+	slog.DebugContext(ctx, "Finished updating users for channel", "channel_id", channelID, "changed", changed)
+	return changed
+}
+
+// MemberLeft records a user leaving a tracked channel as soon as Slack tells
+// us, rather than at the channel's next sync
+func (w *Worker) MemberLeft(ctx context.Context, channelID, memberID string) {
+	var event *webhooks.Event
+	err := w.store.Update(func() error {
+		channels, err := w.store.ReadChannels()
+		if err != nil {
+			return err
+		}
+		channel, tracked := channels[channelID]
+		if !tracked {
+			return nil
+		}
+
+		users, err := w.store.ReadUsers()
+		if err != nil {
+			return err
+		}
+		teams, err := w.store.ReadTeams()
+		if err != nil {
+			return err
+		}
+		memberships, err := w.store.ReadMemberships()
+		if err != nil {
+			return err
+		}
+
+		_, wasIn := users[memberID].Channels[channelID]
+		if !memberships.Left(channelID, memberID, time.Now()) && !wasIn {
+			return nil
+		}
+		removeFromChannel(users, teams, channelID, memberID)
+		if channel.Synced {
+			e := channelEvent(webhooks.ChannelMemberLeft, channel, memberID, users[memberID].Name)
+			event = &e
+		}
+
+		if err := w.store.WriteUsers(users); err != nil {
+			return err
+		}
+		if err := w.store.WriteTeams(teams); err != nil {
+			return err
+		}
+		return w.store.WriteMemberships(memberships)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording member leaving channel", "channel_id", channelID, "user_id", memberID, "error", err)
+		return
+	}
+	if event != nil {
+		slog.DebugContext(ctx, "User left channel", "user_id", memberID, "channel_id", channelID)
+		w.emit(ctx, *event)
+	}
+}
+
+// MemberJoined syncs a tracked channel when Slack tells us someone joined,
+// which records them with their name
+func (w *Worker) MemberJoined(ctx context.Context, channelID string) {
+	channels, err := w.store.ReadChannels()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading channels", "error", err)
+		return
+	}
+	if _, tracked := channels[channelID]; tracked {
+		w.SyncInBackground(ctx, channelID)
+	}
+}
+
+// Record events in the audit log and send them to the webhooks. Must not
+// be called from inside Store.Update.
+func (w *Worker) emit(ctx context.Context, events ...webhooks.Event) {
+	webhooks.RecordAudit(ctx, w.store, events...)
+	w.webhooks.Emit(ctx, events...)
+}
+
+// Forget that a user is in a channel, in the users and the teams
+func removeFromChannel(users store.Users, teams store.Teams, channelID, memberID string) {
+	if user, ok := users[memberID]; ok {
+		delete(user.Channels, channelID)
+	}
+	for _, team := range teams.Teams {
+		for _, member := range team.Members {
+			if member.MemberID == memberID {
+				delete(member.Channels, channelID)
+			}
+		}
+	}
+}
+
+// An event for a member joining or leaving a channel, as found by the sync
+func channelEvent(eventType string, channel store.Channel, memberID, name string) webhooks.Event {
+	event := webhooks.NewEvent(eventType)
+	event.Channel = &webhooks.Channel{ID: channel.ID, Name: channel.Name}
+	event.Member = &webhooks.Member{ID: memberID, Name: name}
+	return event
+}
@@ -0,0 +1,532 @@
+// Package webhooks tells other systems about changes to teams and tracked
+// channels by POSTing signed JSON payloads to the configured endpoints.
+// Payloads are queued in the data store first, so they survive restarts
+// and failed deliveries are retried with backoff. RecordAudit keeps every
+// event in the audit log, whether or not webhooks are set up.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"slack-connect-manager/internal/logging"
+	"slack-connect-manager/internal/metrics"
+	"slack-connect-manager/internal/store"
+)
+
+// The event types
+const (
+	TeamCreated         = "team.created"
+	TeamRemoved         = "team.removed"
+	TeamRenamed         = "team.renamed"
+	MemberAdded         = "member.added"
+	MemberRemoved       = "member.removed"
+	ChannelTracked      = "channel.tracked"
+	ChannelUntracked    = "channel.untracked"
+	ChannelMemberJoined = "channel.member_joined"
+	ChannelMemberLeft   = "channel.member_left"
+	ChannelRenamed      = "channel.renamed"
+	ChannelArchived     = "channel.archived"
+	// Only sent by /connect webhooks test
+	Ping = "ping"
+)
+
+// Events lists the event types a webhook can subscribe to
+var Events = []string{
+	TeamCreated, TeamRemoved, TeamRenamed,
+	MemberAdded, MemberRemoved,
+	ChannelTracked, ChannelUntracked,
+	ChannelMemberJoined, ChannelMemberLeft,
+	ChannelRenamed, ChannelArchived,
+}
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Connect-Event"
+	HeaderDelivery  = "X-Connect-Delivery"
+	HeaderTimestamp = "X-Connect-Timestamp"
+	HeaderSignature = "X-Connect-Signature"
+)
+
+// Event is the payload sent to the webhooks. Only the fields that make
+// sense for the event type are set.
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	Team    string   `json:"team,omitempty"`
+	Member  *Member  `json:"member,omitempty"`
+	Channel *Channel `json:"channel,omitempty"`
+	// The team's old name for team.renamed, or the channel's for channel.renamed
+	PreviousName string `json:"previous_name,omitempty"`
+	// The team a removed team was merged into, if it was
+	MergedInto string `json:"merged_into,omitempty"`
+	// The user who ran the command. Empty for changes the sync found.
+	By string `json:"by,omitempty"`
+}
+
+type Member struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Retry failed deliveries after RetryDelay, doubling each time up to
+// MaxRetryDelay, and give up after MaxAttempts
+const (
+	RetryDelay    = 30 * time.Second
+	MaxRetryDelay = time.Hour
+	MaxAttempts   = 10
+)
+
+// How often the queue is checked for deliveries that are due, besides
+// right after an event is queued
+const pollInterval = 5 * time.Second
+
+// Dispatcher queues events for the webhooks that want them and delivers
+// them in the background. A nil *Dispatcher drops all events, so callers
+// don't have to check whether webhooks are set up.
+type Dispatcher struct {
+	// Cancelled when the server shuts down, which stops the deliveries
+	ctx   context.Context
+	store *store.Store
+	// Only connects to public addresses. Replaced in tests.
+	client *http.Client
+	// Nudges the delivery loop when something is queued
+	wake chan struct{}
+	wg   sync.WaitGroup
+
+	// Replaced in tests
+	now        func() time.Time
+	retryDelay time.Duration
+}
+
+// New creates a dispatcher. Deliveries only happen once Start is called,
+// until then events are just queued.
+func New(ctx context.Context, st *store.Store) *Dispatcher {
+	return &Dispatcher{
+		ctx:        ctx,
+		store:      st,
+		client:     newHTTPClient(),
+		wake:       make(chan struct{}, 1),
+		now:        time.Now,
+		retryDelay: RetryDelay,
+	}
+}
+
+// The deliveries are sent to URLs anyone who can add a webhook chooses, so
+// they are kept off the bot's own network: connections to loopback, private
+// and link-local addresses are refused once the host has been resolved,
+// which also covers redirects and names that resolve to internal addresses.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: refusePrivate}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect on our behalf, past the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// Called with the resolved address right before each connection is made
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+		return fmt.Errorf("refusing to connect to %s, it isn't a public address", host)
+	}
+	return nil
+}
+
+// Carrier-grade NAT, which isn't covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// PublicIP reports whether webhooks may be delivered to an address: it
+// isn't loopback, private, link-local (like the 169.254.169.254 cloud
+// metadata endpoint), multicast or unspecified
+func PublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() &&
+		!ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// Start runs the delivery loop in the background
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run()
+	}()
+}
+
+// Wait blocks until the delivery loop has stopped
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// NewEvent creates an event of a type with a fresh ID and the current time
+func NewEvent(eventType string) Event {
+	return Event{ID: newID("evt_"), Type: eventType, Time: time.Now().UTC()}
+}
+
+// RecordAudit adds events to the audit log. It takes the store lock, so it
+// must not be called from inside Store.Update.
+func RecordAudit(ctx context.Context, st *store.Store, events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	err := st.Update(func() error {
+		entries := make([]store.AuditEntry, len(events))
+		for i, event := range events {
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			entries[i] = store.AuditEntry{Event: event.Type, Time: event.Time, Payload: payload}
+		}
+		audit, err := st.ReadAudit()
+		if err != nil {
+			return err
+		}
+		return st.WriteAudit(audit.Append(entries...))
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording events in the audit log", "error", err)
+	}
+}
+
+// Emit queues the events for every webhook subscribed to them. It takes
+// the store lock, so it must not be called from inside Store.Update.
+func (d *Dispatcher) Emit(ctx context.Context, events ...Event) {
+	if d == nil || len(events) == 0 {
+		return
+	}
+
+	err := d.store.Update(func() error {
+		payloads := make([][]byte, len(events))
+		for i, event := range events {
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			payloads[i] = payload
+		}
+
+		webhooks, err := d.store.ReadWebhooks()
+		if err != nil || len(webhooks) == 0 {
+			return err
+		}
+		queue, err := d.store.ReadWebhookQueue()
+		if err != nil {
+			return err
+		}
+
+		queued := 0
+		for i, event := range events {
+			payload := payloads[i]
+			for _, hook := range webhooks {
+				if !Subscribed(hook, event.Type) {
+					continue
+				}
+				queue = append(queue, d.newDelivery(hook.ID, event.Type, payload))
+				queued++
+			}
+		}
+		if queued == 0 {
+			return nil
+		}
+		slog.DebugContext(ctx, "Queued webhook deliveries", "count", queued)
+		return d.store.WriteWebhookQueue(queue)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error queueing webhook deliveries", "error", err)
+		return
+	}
+	d.nudge()
+}
+
+// Test queues a ping event for a single webhook
+func (d *Dispatcher) Test(ctx context.Context, webhookID, by string) error {
+	event := NewEvent(Ping)
+	event.By = by
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = d.store.Update(func() error {
+		queue, err := d.store.ReadWebhookQueue()
+		if err != nil {
+			return err
+		}
+		return d.store.WriteWebhookQueue(append(queue, d.newDelivery(webhookID, Ping, payload)))
+	})
+	if err == nil {
+		d.nudge()
+	}
+	return err
+}
+
+// Subscribed reports whether a webhook wants events of a type
+func Subscribed(hook store.Webhook, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dispatcher) newDelivery(webhookID, eventType string, payload []byte) store.Delivery {
+	now := d.now().UTC()
+	return store.Delivery{
+		ID:          newID("dlv_"),
+		WebhookID:   webhookID,
+		Event:       eventType,
+		Payload:     payload,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+}
+
+func (d *Dispatcher) nudge() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver whatever is due until the context is cancelled
+func (d *Dispatcher) run() {
+	slog.Info("Starting webhook delivery routine")
+	for {
+		d.DeliverDue(logging.WithRequestID(d.ctx, logging.NewRequestID()))
+
+		select {
+		case <-d.ctx.Done():
+			slog.Info("Stopping webhook delivery routine")
+			return
+		case <-d.wake:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// DeliverDue sends every queued delivery whose time has come, one at a
+// time, and updates the queue with the outcome
+func (d *Dispatcher) DeliverDue(ctx context.Context) {
+	var due []store.Delivery
+	var webhooks store.Webhooks
+	err := d.store.Update(func() error {
+		queue, err := d.store.ReadWebhookQueue()
+		if err != nil {
+			return err
+		}
+		now := d.now()
+		for _, delivery := range queue {
+			if !delivery.NextAttempt.After(now) {
+				due = append(due, delivery)
+			}
+		}
+		if len(due) > 0 {
+			webhooks, err = d.store.ReadWebhooks()
+		}
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading webhook queue", "error", err)
+		return
+	}
+
+	// Once an endpoint fails, leave the rest of its deliveries for the next
+	// round instead of waiting on it again for each one
+	failing := make(map[string]bool)
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if failing[delivery.WebhookID] {
+			continue
+		}
+
+		hook, exists := webhooks[delivery.WebhookID]
+		var sendErr error
+		if exists {
+			sendErr = d.send(ctx, hook, delivery)
+			if ctx.Err() != nil {
+				// Shutting down. The delivery stays queued as it was.
+				return
+			}
+			failing[hook.ID] = sendErr != nil
+		}
+		d.record(ctx, delivery, exists, sendErr)
+	}
+}
+
+// POST a delivery to its webhook
+func (d *Dispatcher) send(ctx context.Context, hook store.Webhook, delivery store.Delivery) error {
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "slack-connect-manager")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Update the queue and the webhook's status after a delivery attempt.
+// Deliveries for webhooks that were removed are dropped.
+func (d *Dispatcher) record(ctx context.Context, delivery store.Delivery, webhookExists bool, sendErr error) {
+	now := d.now().UTC()
+	result := "success"
+
+	err := d.store.Update(func() error {
+		queue, err := d.store.ReadWebhookQueue()
+		if err != nil {
+			return err
+		}
+		for i, queued := range queue {
+			if queued.ID != delivery.ID {
+				continue
+			}
+			switch {
+			case !webhookExists:
+				result = "dropped"
+				queue = append(queue[:i], queue[i+1:]...)
+			case sendErr == nil:
+				queue = append(queue[:i], queue[i+1:]...)
+			case queued.Attempts+1 >= MaxAttempts:
+				result = "dropped"
+				queue = append(queue[:i], queue[i+1:]...)
+			default:
+				result = "failure"
+				queued.Attempts++
+				queued.LastError = sendErr.Error()
+				queued.NextAttempt = now.Add(d.backoff(queued.Attempts))
+				queue[i] = queued
+			}
+			break
+		}
+		if err := d.store.WriteWebhookQueue(queue); err != nil {
+			return err
+		}
+
+		if !webhookExists {
+			return nil
+		}
+		webhooks, err := d.store.ReadWebhooks()
+		if err != nil {
+			return err
+		}
+		hook, exists := webhooks[delivery.WebhookID]
+		if !exists {
+			return nil
+		}
+		hook.LastAttemptAt = now
+		hook.LastError = ""
+		if sendErr != nil {
+			hook.LastError = sendErr.Error()
+		}
+		webhooks[hook.ID] = hook
+		return d.store.WriteWebhooks(webhooks)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating webhook queue", "error", err)
+		return
+	}
+
+	metrics.WebhookDeliveriesTotal.Inc(result)
+	attrs := []any{"webhook_id", delivery.WebhookID, "delivery_id", delivery.ID, "event", delivery.Event}
+	switch {
+	case !webhookExists:
+		slog.InfoContext(ctx, "Dropped delivery for a removed webhook", attrs...)
+	case sendErr == nil:
+		slog.DebugContext(ctx, "Delivered webhook", attrs...)
+	case result == "dropped":
+		slog.ErrorContext(ctx, "Giving up on webhook delivery", append(attrs, "attempts", MaxAttempts, "error", sendErr)...)
+	default:
+		slog.WarnContext(ctx, "Webhook delivery failed, will retry", append(attrs, "error", sendErr)...)
+	}
+}
+
+// How long to wait before the next attempt, after a number of failed ones
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.retryDelay
+	for i := 1; i < attempts && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxRetryDelay)
+}
+
+// Sign computes the X-Connect-Signature of a payload the same way Slack
+// signs its requests: "v0=" and the hex HMAC-SHA256 of "v0:<timestamp>:<body>".
+// Receivers should compute the same and compare in constant time.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret generates a signing secret for a new webhook
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewWebhookID generates the ID of a new webhook
+func NewWebhookID() string {
+	return newID("wh_")
+}
+
+func newID(prefix string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Only used to tell things apart, so the time will do
+		return prefix + strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return prefix + hex.EncodeToString(b)
+}
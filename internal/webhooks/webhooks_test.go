@@ -0,0 +1,251 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"slack-connect-manager/internal/store"
+)
+
+// An endpoint that records what it receives and answers with status
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+func setup(t *testing.T, status int, hooks ...store.Webhook) (*Dispatcher, *receiver, *store.Store) {
+	t.Helper()
+	rc := &receiver{status: status}
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+
+	st := store.New(t.TempDir())
+	webhooks := make(store.Webhooks)
+	for _, hook := range hooks {
+		hook.URL = srv.URL + hook.URL
+		webhooks[hook.ID] = hook
+	}
+	if err := st.WriteWebhooks(webhooks); err != nil {
+		t.Fatal(err)
+	}
+	d := New(context.Background(), st)
+	// The receiver listens on localhost, which deliveries normally refuse
+	d.client = srv.Client()
+	return d, rc, st
+}
+
+func queue(t *testing.T, st *store.Store) []store.Delivery {
+	t.Helper()
+	q, err := st.ReadWebhookQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestEmitAndDeliver(t *testing.T) {
+	d, rc, st := setup(t, http.StatusOK,
+		store.Webhook{ID: "wh_all", URL: "/all", Secret: "secret-1"},
+		store.Webhook{ID: "wh_members", URL: "/members", Secret: "secret-2", Events: []string{MemberAdded}},
+	)
+
+	created := NewEvent(TeamCreated)
+	created.Team = "acme"
+	added := NewEvent(MemberAdded)
+	added.Team = "acme"
+	added.Member = &Member{ID: "U1", Name: "Alice"}
+	added.By = "UADMIN"
+	d.Emit(context.Background(), created, added)
+
+	if n := len(queue(t, st)); n != 3 {
+		t.Fatalf("queued %d deliveries, want 3", n)
+	}
+
+	d.DeliverDue(context.Background())
+	if n := len(queue(t, st)); n != 0 {
+		t.Errorf("%d deliveries left in the queue", n)
+	}
+	if len(rc.requests) != 3 {
+		t.Fatalf("endpoint got %d requests, want 3", len(rc.requests))
+	}
+
+	got := make(map[string][]string)
+	for i, req := range rc.requests {
+		secret := map[string]string{"/all": "secret-1", "/members": "secret-2"}[req.URL.Path]
+		timestamp := req.Header.Get(HeaderTimestamp)
+		if sig := req.Header.Get(HeaderSignature); sig != Sign(secret, timestamp, rc.bodies[i]) {
+			t.Errorf("request %d: bad signature %q", i, sig)
+		}
+		if req.Header.Get(HeaderDelivery) == "" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request %d: headers %v", i, req.Header)
+		}
+
+		var event Event
+		if err := json.Unmarshal(rc.bodies[i], &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != req.Header.Get(HeaderEvent) {
+			t.Errorf("request %d: event %s sent as %s", i, event.Type, req.Header.Get(HeaderEvent))
+		}
+		got[req.URL.Path] = append(got[req.URL.Path], event.Type)
+		if event.Type == MemberAdded && (event.Member.ID != "U1" || event.By != "UADMIN" || event.Team != "acme") {
+			t.Errorf("member.added payload = %s", rc.bodies[i])
+		}
+	}
+	if len(got["/all"]) != 2 || len(got["/members"]) != 1 || got["/members"][0] != MemberAdded {
+		t.Errorf("deliveries by endpoint = %v", got)
+	}
+
+	webhooks, _ := st.ReadWebhooks()
+	if webhooks["wh_all"].LastAttemptAt.IsZero() || webhooks["wh_all"].LastError != "" {
+		t.Errorf("wh_all status = %+v", webhooks["wh_all"])
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	d, rc, st := setup(t, http.StatusInternalServerError, store.Webhook{ID: "wh_1", URL: "/", Secret: "s"})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	d.Emit(context.Background(), NewEvent(TeamCreated), NewEvent(TeamRemoved))
+	d.DeliverDue(context.Background())
+
+	// Only the first delivery is tried while the endpoint is failing
+	if len(rc.requests) != 1 {
+		t.Fatalf("endpoint got %d requests, want 1", len(rc.requests))
+	}
+	q := queue(t, st)
+	if len(q) != 2 || q[0].Attempts != 1 || !q[0].NextAttempt.Equal(now.Add(RetryDelay)) || q[0].LastError == "" {
+		t.Fatalf("queue after a failure = %+v", q)
+	}
+	webhooks, _ := st.ReadWebhooks()
+	if webhooks["wh_1"].LastError != "endpoint returned 500 Internal Server Error" {
+		t.Errorf("last error = %q", webhooks["wh_1"].LastError)
+	}
+
+	// The delay doubles, up to the maximum
+	for attempts, want := range map[int]time.Duration{1: RetryDelay, 2: 2 * RetryDelay, 3: 4 * RetryDelay, 9: MaxRetryDelay} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+
+	// It gives up after MaxAttempts
+	for i := 0; i < MaxAttempts*2; i++ {
+		now = now.Add(MaxRetryDelay)
+		d.DeliverDue(context.Background())
+	}
+	if q := queue(t, st); len(q) != 0 {
+		t.Errorf("queue after giving up = %+v", q)
+	}
+
+	// And delivers once the endpoint is back
+	rc.mu.Lock()
+	rc.status = http.StatusNoContent
+	rc.mu.Unlock()
+	d.Emit(context.Background(), NewEvent(TeamCreated))
+	d.DeliverDue(context.Background())
+	if q := queue(t, st); len(q) != 0 {
+		t.Errorf("queue after recovery = %+v", q)
+	}
+}
+
+func TestDeliveriesForRemovedWebhooksAreDropped(t *testing.T) {
+	d, rc, st := setup(t, http.StatusOK, store.Webhook{ID: "wh_1", URL: "/", Secret: "s"})
+	d.Emit(context.Background(), NewEvent(TeamCreated))
+	if err := st.WriteWebhooks(store.Webhooks{}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.DeliverDue(context.Background())
+	if len(rc.requests) != 0 || len(queue(t, st)) != 0 {
+		t.Errorf("got %d requests and %d queued", len(rc.requests), len(queue(t, st)))
+	}
+}
+
+func TestNilDispatcherDropsEvents(t *testing.T) {
+	var d *Dispatcher
+	d.Emit(context.Background(), NewEvent(TeamCreated))
+}
+
+func TestRecordAudit(t *testing.T) {
+	st := store.New(t.TempDir())
+	event := NewEvent(TeamCreated)
+	event.Team = "platform"
+	RecordAudit(context.Background(), st, event)
+
+	audit, err := st.ReadAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audit) != 1 || audit[0].Event != TeamCreated {
+		t.Fatalf("audit = %+v, want the team_created event", audit)
+	}
+	var got Event
+	if err := json.Unmarshal(audit[0].Payload, &got); err != nil || got.Team != "platform" {
+		t.Errorf("payload = %s, want the event", audit[0].Payload)
+	}
+	if len(queue(t, st)) != 0 {
+		t.Error("recording the audit log queued deliveries")
+	}
+}
+
+func TestPrivateAddressesAreRefused(t *testing.T) {
+	d, rc, st := setup(t, http.StatusOK, store.Webhook{ID: "wh_1", Secret: "s"})
+	d.client = newHTTPClient()
+
+	d.Emit(context.Background(), NewEvent(TeamCreated))
+	d.DeliverDue(context.Background())
+
+	if len(rc.requests) != 0 {
+		t.Errorf("got %d deliveries to localhost, want none", len(rc.requests))
+	}
+	hooks, _ := st.ReadWebhooks()
+	if !strings.Contains(hooks["wh_1"].LastError, "isn't a public address") {
+		t.Errorf("last error = %q, want the address to be refused", hooks["wh_1"].LastError)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "203.0.113.10", want: true},
+		{ip: "2001:db8::1", want: true},
+		{ip: "127.0.0.1", want: false},
+		{ip: "::1", want: false},
+		{ip: "10.1.2.3", want: false},
+		{ip: "172.16.0.1", want: false},
+		{ip: "192.168.1.1", want: false},
+		{ip: "169.254.169.254", want: false},
+		{ip: "fe80::1", want: false},
+		{ip: "fd00::1", want: false},
+		{ip: "100.64.0.1", want: false},
+		{ip: "0.0.0.0", want: false},
+	}
+	for _, tt := range tests {
+		if got := PublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("PublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
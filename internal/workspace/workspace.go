@@ -0,0 +1,284 @@
+// Package workspace runs the bot in each Slack workspace it serves. Every
+// workspace has its own bot token, data, sync loop, webhook deliveries and
+// scheduled reports.
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"slack-connect-manager/internal/commands"
+	"slack-connect-manager/internal/health"
+	"slack-connect-manager/internal/reports"
+	"slack-connect-manager/internal/slackapi"
+	"slack-connect-manager/internal/store"
+	"slack-connect-manager/internal/syncer"
+	"slack-connect-manager/internal/webhooks"
+)
+
+// Workspace is the bot running in one Slack workspace
+type Workspace struct {
+	TeamID   string
+	TeamName string
+	// The bot's user ID in the workspace
+	BotUserID string
+	Store     *store.Store
+	Slack     *slack.Client
+	Sync      *syncer.Worker
+	Webhooks  *webhooks.Dispatcher
+	Reports   *reports.Reporter
+	Router    *commands.Router
+
+	// Stops the sync loop, the webhook deliveries and the reports
+	cancel context.CancelFunc
+}
+
+// Wait blocks until the workspace's sync, webhook deliveries, reports and
+// background commands have stopped
+func (ws *Workspace) Wait() {
+	ws.Sync.Wait()
+	ws.Webhooks.Wait()
+	ws.Reports.Wait()
+	ws.Router.Wait()
+}
+
+// Manager starts and finds the workspaces. The workspace of the configured
+// bot token keeps its data at the top level of the store, the way it was
+// kept before there could be more than one. Workspaces installed with OAuth
+// keep theirs in store.Workspace.
+type Manager struct {
+	// Whether every workspace tracks its shared channels without them being
+	// added, and how often it looks for them. Set them before starting any
+	// workspaces.
+	AutoDiscover     bool
+	DiscoverInterval time.Duration
+	// How many channels each workspace syncs at once, and how long its quiet
+	// channels may go between syncs. The syncer's defaults are used if zero.
+	SyncConcurrency int
+	SyncMaxInterval time.Duration
+
+	// Cancelled when the server shuts down, which stops every workspace
+	ctx          context.Context
+	store        *store.Store
+	apiURL       string
+	health       *health.State
+	syncInterval time.Duration
+
+	mu         sync.Mutex
+	workspaces map[string]*Workspace
+	// The team of the configured bot token, if there is one. It's kept after
+	// an uninstall, so a reinstall finds its data at the top level again.
+	primary string
+	// Every workspace ever started, including uninstalled ones, so Wait
+	// covers them all
+	started []*Workspace
+}
+
+// NewManager creates a workspace manager. apiURL is only set to talk to a
+// fake Slack server. All workspaces stop when ctx is cancelled.
+func NewManager(ctx context.Context, st *store.Store, apiURL string, h *health.State, syncInterval time.Duration) *Manager {
+	return &Manager{
+		ctx:          ctx,
+		store:        st,
+		apiURL:       apiURL,
+		health:       h,
+		syncInterval: syncInterval,
+		workspaces:   make(map[string]*Workspace),
+	}
+}
+
+// AddPrimary starts the workspace of the configured bot token. It asks
+// Slack which workspace the token belongs to.
+func (m *Manager) AddPrimary(ctx context.Context, token string) (*Workspace, error) {
+	client := slackapi.New(token, m.apiURL)
+	authTest, err := client.AuthTestContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.health.Workspace(authTest.TeamID).RecordAuth(nil)
+
+	if err := m.store.EnsureFiles(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.primary = authTest.TeamID
+	return m.start(authTest.TeamID, authTest.Team, authTest.UserID, client), nil
+}
+
+// Load starts every workspace the app was installed in with OAuth. The
+// configured bot token wins over an installation in the same workspace.
+func (m *Manager) Load() error {
+	installations, err := m.store.ReadInstallations()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, teamID := range sortedTeamIDs(installations) {
+		if teamID == m.primary {
+			slog.Info("Using the configured bot token instead of the installed one", "team_id", teamID)
+			continue
+		}
+		inst := installations[teamID]
+		if err := m.ensureFiles(teamID); err != nil {
+			return fmt.Errorf("workspace %s: %w", teamID, err)
+		}
+		m.start(teamID, inst.TeamName, inst.BotUserID, slackapi.New(inst.BotToken, m.apiURL))
+	}
+	return nil
+}
+
+// Install records a new installation and starts the workspace. Installing
+// again, e.g. to grant new scopes, restarts it with the new token.
+func (m *Manager) Install(inst store.Installation) (*Workspace, error) {
+	err := m.store.Update(func() error {
+		installations, err := m.store.ReadInstallations()
+		if err != nil {
+			return err
+		}
+		installations[inst.TeamID] = inst
+		return m.store.WriteInstallations(installations)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.ensureFiles(inst.TeamID); err != nil {
+		return nil, err
+	}
+	if old, ok := m.workspaces[inst.TeamID]; ok {
+		old.cancel()
+	}
+	// Don't let the old token's auth failures linger
+	m.health.Forget(inst.TeamID)
+	slog.Info("Installed in workspace", "team_id", inst.TeamID, "team", inst.TeamName, "installed_by", inst.InstalledBy)
+	return m.start(inst.TeamID, inst.TeamName, inst.BotUserID, slackapi.New(inst.BotToken, m.apiURL)), nil
+}
+
+// Uninstall stops a workspace and forgets its bot token, e.g. after Slack
+// tells us the app was removed. Its data is kept in case it's installed again.
+func (m *Manager) Uninstall(teamID string) error {
+	err := m.store.Update(func() error {
+		installations, err := m.store.ReadInstallations()
+		if err != nil {
+			return err
+		}
+		if _, ok := installations[teamID]; !ok {
+			return nil
+		}
+		delete(installations, teamID)
+		return m.store.WriteInstallations(installations)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ws, ok := m.workspaces[teamID]
+	if !ok {
+		return nil
+	}
+	ws.cancel()
+	delete(m.workspaces, teamID)
+	m.health.Forget(teamID)
+	slog.Info("Uninstalled from workspace", "team_id", teamID)
+	return nil
+}
+
+// Get returns the workspace of a team, or nil if the bot isn't running there
+func (m *Manager) Get(teamID string) *Workspace {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.workspaces[teamID]
+}
+
+// Primary returns the workspace of the configured bot token, or nil if there
+// isn't one or it was uninstalled
+func (m *Manager) Primary() *Workspace {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.workspaces[m.primary]
+}
+
+// Wait blocks until every workspace has stopped
+func (m *Manager) Wait() {
+	m.mu.Lock()
+	started := append([]*Workspace(nil), m.started...)
+	m.mu.Unlock()
+	for _, ws := range started {
+		ws.Wait()
+	}
+}
+
+// The store holding a team's data
+func (m *Manager) storeFor(teamID string) (*store.Store, error) {
+	if teamID == m.primary {
+		return m.store, nil
+	}
+	return m.store.Workspace(teamID)
+}
+
+func (m *Manager) ensureFiles(teamID string) error {
+	st, err := m.storeFor(teamID)
+	if err != nil {
+		return err
+	}
+	return st.EnsureFiles()
+}
+
+// Start the sync loop, the webhook deliveries and the reports of a workspace. Must be
+// called with m.mu held, after ensureFiles.
+func (m *Manager) start(teamID, teamName, botUserID string, client *slack.Client) *Workspace {
+	st, _ := m.storeFor(teamID)
+	ctx, cancel := context.WithCancel(m.ctx)
+	hooks := webhooks.New(ctx, st)
+	worker := syncer.New(ctx, st, client, m.health.Workspace(teamID), m.syncInterval, hooks)
+	if m.SyncConcurrency > 0 {
+		worker.SetLimits(m.SyncConcurrency, m.SyncMaxInterval)
+	}
+	if m.AutoDiscover {
+		worker.EnableDiscovery(m.DiscoverInterval)
+	}
+	reporter := reports.New(ctx, st, client)
+	ws := &Workspace{
+		TeamID:    teamID,
+		TeamName:  teamName,
+		BotUserID: botUserID,
+		Store:     st,
+		Slack:     client,
+		Sync:      worker,
+		Webhooks:  hooks,
+		Reports:   reporter,
+		Router:    commands.NewRouter(&commands.Service{Store: st, Slack: client, Sync: worker, Webhooks: hooks}),
+		cancel:    cancel,
+	}
+	worker.Start()
+	hooks.Start()
+	reporter.Start()
+
+	m.workspaces[teamID] = ws
+	m.started = append(m.started, ws)
+	slog.Info("Serving workspace", "team_id", teamID, "team", teamName, "data", st.Location())
+	return ws
+}
+
+func sortedTeamIDs(installations store.Installations) []string {
+	ids := make([]string, 0, len(installations))
+	for id := range installations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}